@@ -0,0 +1,623 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	// the largest archive importEndedGame accepts, compressed or not
+	maxArchiveBytes      = int64(256 << 20)
+	archiveManifestName  = "game.json"
+	archiveFormatVersion = 1
+)
+
+// ArchiveManifest is the game.json of an ended game's archive. Drawings,
+// renders and exports are given as the names of files in the archive, which
+// are their blob keys on the server they came from, or "" where there is no
+// file.
+type ArchiveManifest struct {
+	Version         int                 `json:"version"`
+	GameId          string              `json:"gameId"`
+	GameName        string              `json:"gameName"`
+	GameMode        string              `json:"gameMode"`
+	Creator         string              `json:"creator"`
+	Players         []string            `json:"players"`
+	Teams           []ArchiveTeam       `json:"teams"`
+	Settings        ArchiveSettings     `json:"settings"`
+	RoundsCompleted int                 `json:"roundsCompleted"`
+	Prompts         [][]string          `json:"prompts"`
+	Drawings        [][]ArchiveDrawing  `json:"drawings"`
+	Scores          map[string]int      `json:"scores"`
+	Awards          []ArchiveAward      `json:"awards"`
+	Renders         map[string][]string `json:"renders"`
+	Exports         map[string]string   `json:"exports"`
+	PreviousGameId  string              `json:"previousGameId"`
+	NextGameId      string              `json:"nextGameId"`
+	EndedAt         time.Time           `json:"endedAt"`
+	Starred         bool                `json:"starred"`
+	ExportedAt      time.Time           `json:"exportedAt"`
+}
+
+type ArchiveTeam struct {
+	TeamName string   `json:"teamName"`
+	Players  []string `json:"players"`
+}
+
+// ArchiveSettings are the settings the game was created with
+type ArchiveSettings struct {
+	RoundTimer      int    `json:"roundTimer"`
+	TotalRounds     int    `json:"totalRounds"`
+	PromptPack      string `json:"promptPack"`
+	StartingPrompts string `json:"startingPrompts"`
+	TeamSize        int    `json:"teamSize"`
+	TeamSubmission  string `json:"teamSubmission"`
+	ReplayDuration  int    `json:"replayDuration"`
+	ExportFormat    string `json:"exportFormat"`
+	CaptionDuration int    `json:"captionDuration"`
+	DrawingDuration int    `json:"drawingDuration"`
+	// the rest of the reveal pacing, which archives from before it could be
+	// changed leave out
+	CaptionDurationPerChar int  `json:"captionDurationPerChar"`
+	MaxCaptionDuration     int  `json:"maxCaptionDuration"`
+	LoopCount              int  `json:"loopCount"`
+	TitleCard              bool `json:"titleCard"`
+	EndCard                bool `json:"endCard"`
+	// left out of older archives, whose captions all had frames of their own
+	// in the classic theme and were set in the default font
+	CaptionLayout string `json:"captionLayout"`
+	Font          string `json:"font"`
+	CaptionTheme  string `json:"captionTheme"`
+}
+
+// revealPacing is the pacing the archived game was rendered with
+func (s ArchiveSettings) revealPacing() RevealPacing {
+	pacing := RevealPacing{
+		captionDuration:        s.CaptionDuration,
+		drawingDuration:        s.DrawingDuration,
+		captionDurationPerChar: s.CaptionDurationPerChar,
+		maxCaptionDuration:     s.MaxCaptionDuration,
+		loopCount:              s.LoopCount,
+		titleCard:              s.TitleCard,
+		endCard:                s.EndCard,
+	}
+	if pacing.captionDuration == 0 {
+		pacing.captionDuration = defaultCaptionDuration
+	}
+	if pacing.drawingDuration == 0 {
+		pacing.drawingDuration = defaultDrawingDuration
+	}
+	return pacing
+}
+
+type ArchiveDrawing struct {
+	ImageId string         `json:"imageId"`
+	File    string         `json:"file"`
+	Owner   string         `json:"owner"`
+	Strokes *StrokeDrawing `json:"strokes,omitempty"`
+}
+
+type ArchiveAward struct {
+	Title   string   `json:"title"`
+	Players []string `json:"players"`
+	Chain   int      `json:"chain"`
+}
+
+// archiveManifest describes an ended game for its archive. Must be called
+// holding stateLock.
+func archiveManifest(endedGame *EndedGame) *ArchiveManifest {
+	manifest := &ArchiveManifest{
+		Version:         archiveFormatVersion,
+		GameId:          endedGame.gameId,
+		GameName:        endedGame.gameName,
+		GameMode:        endedGame.gameMode,
+		Creator:         endedGame.creator,
+		Players:         endedGame.players,
+		Teams:           []ArchiveTeam{},
+		RoundsCompleted: endedGame.roundsCompleted,
+		Prompts:         endedGame.prompts,
+		Drawings:        [][]ArchiveDrawing{},
+		Scores:          endedGame.scores,
+		Awards:          []ArchiveAward{},
+		Renders:         make(map[string][]string),
+		Exports:         make(map[string]string),
+		PreviousGameId:  endedGame.previousGameId,
+		NextGameId:      endedGame.nextGameId,
+		EndedAt:         endedGame.endedAt,
+		Starred:         endedGame.starred,
+		ExportedAt:      time.Now(),
+		Settings: ArchiveSettings{
+			RoundTimer:      endedGame.roundTimer,
+			TotalRounds:     endedGame.totalRounds,
+			PromptPack:      endedGame.promptPack,
+			StartingPrompts: endedGame.startingPrompts,
+			TeamSize:        endedGame.teamSize,
+			TeamSubmission:  endedGame.teamSubmission,
+			ReplayDuration:  endedGame.replayDuration,
+			ExportFormat:    endedGame.exportFormat,
+			CaptionDuration: endedGame.pacing.captionDuration,
+			DrawingDuration: endedGame.pacing.drawingDuration,
+
+			CaptionDurationPerChar: endedGame.pacing.captionDurationPerChar,
+			MaxCaptionDuration:     endedGame.pacing.maxCaptionDuration,
+			LoopCount:              endedGame.pacing.loopCount,
+			TitleCard:              endedGame.pacing.titleCard,
+			EndCard:                endedGame.pacing.endCard,
+			CaptionLayout:          endedGame.captionLayout,
+			Font:                   endedGame.font,
+			CaptionTheme:           endedGame.captionTheme,
+		},
+	}
+	for _, team := range endedGame.teams {
+		members := []string{}
+		for _, member := range team.members {
+			members = append(members, member.playerName)
+		}
+		manifest.Teams = append(manifest.Teams, ArchiveTeam{TeamName: team.teamName, Players: members})
+	}
+	for _, chain := range endedGame.drawings {
+		drawings := []ArchiveDrawing{}
+		for _, imageId := range chain {
+			drawing := ArchiveDrawing{}
+			if registered, ok := imageRegistry[imageId]; ok {
+				drawing = ArchiveDrawing{ImageId: imageId, File: registered.path, Owner: registered.owner, Strokes: endedGame.strokes[imageId]}
+			}
+			drawings = append(drawings, drawing)
+		}
+		manifest.Drawings = append(manifest.Drawings, drawings)
+	}
+	for _, award := range endedGame.awards {
+		manifest.Awards = append(manifest.Awards, ArchiveAward{Title: award.title, Players: award.players, Chain: award.chain})
+	}
+	for format, renders := range endedGame.renders {
+		files := []string{}
+		for _, render := range renders {
+			files = append(files, render.file)
+		}
+		manifest.Renders[format] = files
+	}
+	for name, key := range endedGame.exports {
+		manifest.Exports[name] = key
+	}
+	return manifest
+}
+
+// files lists every file the manifest refers to
+func (m *ArchiveManifest) files() []string {
+	files := []string{}
+	for _, chain := range m.Drawings {
+		for _, drawing := range chain {
+			files = append(files, drawing.File)
+		}
+	}
+	for _, renders := range m.Renders {
+		files = append(files, renders...)
+	}
+	for _, key := range m.Exports {
+		files = append(files, key)
+	}
+	return files
+}
+
+// dropFiles forgets files which couldn't be put in the archive, so that the
+// manifest only refers to what is there
+func (m *ArchiveManifest) dropFiles(missing map[string]bool) {
+	for _, chain := range m.Drawings {
+		for i := range chain {
+			if missing[chain[i].File] {
+				chain[i] = ArchiveDrawing{}
+			}
+		}
+	}
+	for _, renders := range m.Renders {
+		for i := range renders {
+			if missing[renders[i]] {
+				renders[i] = ""
+			}
+		}
+	}
+	for name, key := range m.Exports {
+		if missing[key] {
+			delete(m.Exports, name)
+		}
+	}
+}
+
+// writeArchive zips up the files of an ended game with its manifest. Files
+// which can't be read are left out, and game.json goes last so that it can
+// say so. It reads from the blob store but not the game state, so it doesn't
+// need stateLock.
+func writeArchive(w io.Writer, manifest *ArchiveManifest) error {
+	archive := zip.NewWriter(w)
+	written := make(map[string]bool)
+	missing := make(map[string]bool)
+	for _, key := range manifest.files() {
+		if key == "" || written[key] || missing[key] {
+			continue
+		}
+		data, err := blobStore.Get(key)
+		if err != nil {
+			fmt.Println("Leaving", key, "out of the archive of game", manifest.GameId, ":", err)
+			missing[key] = true
+			continue
+		}
+		// images and animations are already compressed
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: key, Method: zip.Store, Modified: manifest.EndedAt})
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(data); err != nil {
+			return err
+		}
+		written[key] = true
+	}
+	manifest.dropFiles(missing)
+
+	manifestJson, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := archive.CreateHeader(&zip.FileHeader{Name: archiveManifestName, Method: zip.Deflate, Modified: manifest.ExportedAt})
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(manifestJson); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// readArchive unzips the manifest of an archive and the files it refers to
+func readArchive(data []byte) (*ArchiveManifest, map[string][]byte, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("the file is not a zip archive")
+	}
+	entries := make(map[string]*zip.File)
+	for _, file := range archive.File {
+		entries[file.Name] = file
+	}
+	// the archive's size is already limited, but a small archive can
+	// decompress to a lot
+	remaining := maxArchiveBytes
+	readEntry := func(name string) ([]byte, error) {
+		entry, ok := entries[name]
+		if !ok {
+			return nil, fmt.Errorf("%s is missing from the archive", name)
+		}
+		reader, err := entry.Open()
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", name, err)
+		}
+		defer reader.Close()
+		contents, err := io.ReadAll(io.LimitReader(reader, remaining+1))
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", name, err)
+		}
+		remaining -= int64(len(contents))
+		if remaining < 0 {
+			return nil, fmt.Errorf("the archive is too large once decompressed")
+		}
+		return contents, nil
+	}
+
+	manifestJson, err := readEntry(archiveManifestName)
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest := &ArchiveManifest{}
+	if err := json.Unmarshal(manifestJson, manifest); err != nil {
+		return nil, nil, fmt.Errorf("error parsing %s: %v", archiveManifestName, err)
+	}
+	if manifest.Version != archiveFormatVersion {
+		return nil, nil, fmt.Errorf("unsupported archive version %d", manifest.Version)
+	}
+	files := make(map[string][]byte)
+	for _, key := range manifest.files() {
+		if key == "" || files[key] != nil {
+			continue
+		}
+		if !isBlobKey(key) {
+			return nil, nil, fmt.Errorf("invalid file name %s", key)
+		}
+		if files[key], err = readEntry(key); err != nil {
+			return nil, nil, err
+		}
+	}
+	return manifest, files, nil
+}
+
+// isArchiveId checks that a game ID from an archive is safe to put in URLs
+func isArchiveId(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// validateArchive checks a manifest and its files before anything is stored,
+// holding drawings and settings to the limits of games played here. Must be
+// called holding stateLock.
+func validateArchive(m *ArchiveManifest, files map[string][]byte) error {
+	if !isArchiveId(m.GameId) {
+		return fmt.Errorf("invalid gameId")
+	}
+	if _, ok := endedGames[m.GameId]; ok {
+		return fmt.Errorf("a game with ID %s already exists", m.GameId)
+	}
+	for _, game := range games {
+		if game.gameId == m.GameId {
+			return fmt.Errorf("a game with ID %s already exists", m.GameId)
+		}
+	}
+	if _, ok := getGameMode(m.GameMode); !ok {
+		return fmt.Errorf("unknown game mode %s", m.GameMode)
+	}
+	if m.Settings.ExportFormat != "" && !isExportFormat(m.Settings.ExportFormat) {
+		return fmt.Errorf("%s", exportFormatError())
+	}
+	if m.Settings.ReplayDuration < 0 || m.Settings.ReplayDuration > maxReplaySeconds*100 {
+		return fmt.Errorf("replayDuration must be between 0 and %d", maxReplaySeconds*100)
+	}
+	if err := m.Settings.revealPacing().validate(); err != nil {
+		return err
+	}
+	if m.Settings.CaptionLayout != "" && !isCaptionLayout(m.Settings.CaptionLayout) {
+		return fmt.Errorf("%s", captionLayoutError())
+	}
+	if len(m.Drawings) != len(m.Prompts) {
+		return fmt.Errorf("there must be as many chains of drawings as of prompts")
+	}
+	for c, chain := range m.Drawings {
+		if len(chain) != len(m.Prompts[c]) {
+			return fmt.Errorf("chain %d has a different number of drawings and prompts", c)
+		}
+		for _, prompt := range m.Prompts[c] {
+			if utf8.RuneCountInString(prompt) > maxPromptLength {
+				return fmt.Errorf("chain %d has a prompt longer than %d characters", c, maxPromptLength)
+			}
+		}
+		for _, drawing := range chain {
+			if drawing.File == "" {
+				continue
+			}
+			if !strings.HasPrefix(drawing.File, "images/") {
+				return fmt.Errorf("drawing %s is not an image", drawing.File)
+			}
+			config, _, err := image.DecodeConfig(bytes.NewReader(files[drawing.File]))
+			if err != nil {
+				return fmt.Errorf("drawing %s is not an image", drawing.File)
+			}
+			if err := checkUploadSize(config); err != nil {
+				return fmt.Errorf("drawing %s: %v", drawing.File, err)
+			}
+			if drawing.Strokes != nil {
+				if err := validateStrokeDrawing(drawing.Strokes); err != nil {
+					return fmt.Errorf("drawing %s has invalid strokes: %v", drawing.File, err)
+				}
+			}
+		}
+	}
+	for format, renders := range m.Renders {
+		exporter, ok := animationExporters[format]
+		if !ok {
+			return fmt.Errorf("unknown render format %s", format)
+		}
+		if len(renders) != len(m.Prompts) {
+			return fmt.Errorf("there must be a %s render for each chain", format)
+		}
+		for _, key := range renders {
+			if key != "" && (!strings.HasPrefix(key, exporter.Prefix()+"/") || path.Ext(key) != exporter.Ext()) {
+				return fmt.Errorf("%s is not a %s render", key, format)
+			}
+		}
+	}
+	for _, key := range m.Exports {
+		if !strings.HasPrefix(key, "exports/") {
+			return fmt.Errorf("%s is not an export", key)
+		}
+	}
+	return nil
+}
+
+// importArchive stores the files of a validated archive and adds the game to
+// endedGames. Renders missing from the archive are queued. Must be called
+// holding stateLock.
+func importArchive(m *ArchiveManifest, files map[string][]byte) (*EndedGame, error) {
+	// files are stored under their content hash here too, which is normally
+	// the name they had in the archive
+	keys := make(map[string]string)
+	for name, data := range files {
+		key, err := putContent(strings.Split(name, "/")[0], path.Ext(name), data)
+		if err != nil {
+			return nil, fmt.Errorf("unable to store %s: %v", name, err)
+		}
+		keys[name] = key
+	}
+
+	endedGame := EndedGame{
+		gameName:        m.GameName,
+		gameId:          m.GameId,
+		roundsCompleted: m.RoundsCompleted,
+		gameMode:        m.GameMode,
+		creator:         m.Creator,
+		players:         m.Players,
+		roundTimer:      m.Settings.RoundTimer,
+		totalRounds:     m.Settings.TotalRounds,
+		promptPack:      m.Settings.PromptPack,
+		startingPrompts: m.Settings.StartingPrompts,
+		teamSize:        m.Settings.TeamSize,
+		teamSubmission:  m.Settings.TeamSubmission,
+		replayDuration:  m.Settings.ReplayDuration,
+		exportFormat:    m.Settings.ExportFormat,
+		pacing:          m.Settings.revealPacing(),
+		captionLayout:   m.Settings.CaptionLayout,
+		font:            m.Settings.Font,
+		captionTheme:    m.Settings.CaptionTheme,
+		renders:         make(map[string][]*ChainRender),
+		exports:         make(map[string]string),
+		previousGameId:  m.PreviousGameId,
+		nextGameId:      m.NextGameId,
+		prompts:         m.Prompts,
+		drawings:        [][]string{},
+		strokes:         make(map[string]*StrokeDrawing),
+		scores:          m.Scores,
+		awards:          []Award{},
+		endedAt:         m.EndedAt,
+		starred:         m.Starred,
+	}
+	if endedGame.exportFormat == "" {
+		endedGame.exportFormat = defaultExportFormat
+	}
+	if endedGame.captionLayout == "" {
+		endedGame.captionLayout = defaultCaptionLayout
+	}
+	if endedGame.font == "" {
+		endedGame.font = defaultFontName
+	}
+	if endedGame.captionTheme == "" {
+		endedGame.captionTheme = defaultCaptionThemeName
+	}
+	if endedGame.scores == nil {
+		endedGame.scores = make(map[string]int)
+	}
+	for _, team := range m.Teams {
+		members := []*Player{}
+		for _, name := range team.Players {
+			members = append(members, &Player{playerName: name})
+		}
+		endedGame.teams = append(endedGame.teams, &Team{teamName: team.TeamName, members: members})
+	}
+	for _, award := range m.Awards {
+		endedGame.awards = append(endedGame.awards, Award{title: award.Title, players: award.Players, chain: award.Chain})
+	}
+	for _, chain := range m.Drawings {
+		imageIds := []string{}
+		for round, drawing := range chain {
+			if drawing.File == "" {
+				imageIds = append(imageIds, "")
+				continue
+			}
+			// keep the drawing's ID unless this server already uses it
+			imageId := drawing.ImageId
+			if _, taken := imageRegistry[imageId]; taken || imageId == "" {
+				imageId = generateShortHash()
+			}
+			imageRegistry[imageId] = &RegisteredImage{
+				imageId:   imageId,
+				path:      keys[drawing.File],
+				owner:     drawing.Owner,
+				gameId:    m.GameId,
+				round:     round,
+				strokes:   drawing.Strokes,
+				createdAt: m.EndedAt,
+			}
+			retainBlob(keys[drawing.File])
+			if drawing.Strokes != nil {
+				endedGame.strokes[imageId] = drawing.Strokes
+			}
+			imageIds = append(imageIds, imageId)
+		}
+		endedGame.drawings = append(endedGame.drawings, imageIds)
+	}
+	missing := map[string][]int{}
+	for format, renders := range m.Renders {
+		endedGame.renders[format] = make([]*ChainRender, len(renders))
+		for chain, key := range renders {
+			render := &ChainRender{total: len(m.Prompts[chain])}
+			if key != "" {
+				render.status = "done"
+				render.file = keys[key]
+				render.rendered.Store(int32(render.total))
+			} else {
+				missing[format] = append(missing[format], chain)
+			}
+			endedGame.renders[format][chain] = render
+		}
+	}
+	for name, key := range m.Exports {
+		endedGame.exports[name] = keys[key]
+	}
+
+	endedGames[endedGame.gameId] = &endedGame
+	retainEndedGameBlobs(&endedGame)
+	for format, chains := range missing {
+		for _, chain := range chains {
+			queueRender(&endedGame, format, chain)
+		}
+	}
+	for _, format := range exportFormatsToRender(endedGame.exportFormat) {
+		queueGameRenders(&endedGame, format)
+	}
+	return &endedGame, nil
+}
+
+// An admin endpoint which restores an ended game from an archive made by
+// exportEndedGame, such as one from another server. The archive is read
+// before stateLock is taken, so a slow upload doesn't hold up the server.
+func importEndedGame(w http.ResponseWriter, r *http.Request) {
+	allowCors(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, maxArchiveBytes+1<<20)
+		err := r.ParseMultipartForm(32 << 20)
+		if err != nil {
+			http.Error(w, "Error parsing multipart form", http.StatusBadRequest)
+			return
+		}
+		if adminSecret == "" || r.FormValue("adminSecret") != adminSecret {
+			http.Error(w, "Admin not authenticated", http.StatusUnauthorized)
+			return
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Error retrieving the file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		if err != nil {
+			http.Error(w, "Error reading the file", http.StatusBadRequest)
+			return
+		}
+		manifest, files, err := readArchive(data)
+		if err != nil {
+			http.Error(w, "Error reading the archive: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		stateLock.Lock()
+		defer stateLock.Unlock()
+		if err := validateArchive(manifest, files); err != nil {
+			http.Error(w, "Invalid archive: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		endedGame, err := importArchive(manifest, files)
+		if err != nil {
+			fmt.Println("Error importing game:", err)
+			http.Error(w, "Error importing the game", http.StatusInternalServerError)
+			return
+		}
+		fmt.Println("Imported game", endedGame.gameId)
+		responseStr := "{\"status\": \"OK\", \"message\": \"Game imported\", \"gameId\": " + jsonString(endedGame.gameId) + ", \"files\": " + fmt.Sprint(len(files)) + "}"
+		fmt.Fprint(w, responseStr)
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"unicode"
+
+	"golang.org/x/text/unicode/bidi"
+)
+
+// mirroredRunes are the characters drawn as their mirror image in right to
+// left text which bidi doesn't already mirror as paired brackets
+var mirroredRunes = map[rune]rune{
+	'<': '>', '>': '<',
+	'«': '»', '»': '«',
+	'‹': '›', '›': '‹',
+	'≤': '≥', '≥': '≤',
+}
+
+// bidiClass is the bidi class of r. Embedding, override and isolate controls
+// are treated as neutral, so text between them is ordered by the implicit
+// rules alone; captions are typed rather than marked up, so they hardly ever
+// contain any. Paragraph separators are treated as the spaces they are wrapped
+// as.
+func bidiClass(r rune) bidi.Class {
+	props, _ := bidi.LookupRune(r)
+	switch class := props.Class(); class {
+	case bidi.B:
+		return bidi.WS
+	case bidi.LRO, bidi.RLO, bidi.LRE, bidi.RLE, bidi.PDF, bidi.LRI, bidi.RLI, bidi.FSI, bidi.PDI, bidi.BN:
+		return bidi.ON
+	default:
+		return class
+	}
+}
+
+// paragraphIsRTL reports whether text reads right to left, which it does when
+// its first strongly directional character is from a right to left script
+func paragraphIsRTL(text string) bool {
+	for _, r := range text {
+		switch bidiClass(r) {
+		case bidi.L:
+			return false
+		case bidi.R, bidi.AL:
+			return true
+		}
+	}
+	return false
+}
+
+// strongDirection is the direction a resolved class counts as when resolving
+// the neutrals around it. Numbers count as right to left.
+func strongDirection(class bidi.Class) bidi.Class {
+	if class == bidi.L {
+		return bidi.L
+	}
+	return bidi.R
+}
+
+// resolveLevels works out the embedding level of each character of a
+// paragraph with the implicit rules of the Unicode bidi algorithm: even levels
+// are drawn left to right and odd levels right to left. Bracket pairs aren't
+// matched up, so brackets are resolved like any other neutral.
+func resolveLevels(runes []rune, rtl bool) []int {
+	n := len(runes)
+	embedding, base := bidi.L, 0
+	if rtl {
+		embedding, base = bidi.R, 1
+	}
+	classes := make([]bidi.Class, n)
+	for i, r := range runes {
+		classes[i] = bidiClass(r)
+	}
+
+	// W1: marks take the class of what they are on
+	prev := embedding
+	for i, class := range classes {
+		if class == bidi.NSM {
+			classes[i] = prev
+		} else {
+			prev = class
+		}
+	}
+	// W2 and W3: numbers in Arabic text are Arabic numbers, and Arabic
+	// letters are otherwise right to left like any other
+	lastStrong := embedding
+	for i, class := range classes {
+		switch class {
+		case bidi.L, bidi.R, bidi.AL:
+			lastStrong = class
+		case bidi.EN:
+			if lastStrong == bidi.AL {
+				classes[i] = bidi.AN
+			}
+		}
+		if class == bidi.AL {
+			classes[i] = bidi.R
+		}
+	}
+	// W4: a single separator between two numbers of a kind joins them
+	for i := 1; i < n-1; i++ {
+		before, after := classes[i-1], classes[i+1]
+		if before != after {
+			continue
+		}
+		if before == bidi.EN && (classes[i] == bidi.ES || classes[i] == bidi.CS) {
+			classes[i] = bidi.EN
+		} else if before == bidi.AN && classes[i] == bidi.CS {
+			classes[i] = bidi.AN
+		}
+	}
+	// W5: terminators such as currency signs go with the number they are on
+	for i := 0; i < n; {
+		if classes[i] != bidi.ET {
+			i++
+			continue
+		}
+		j := i
+		for j < n && classes[j] == bidi.ET {
+			j++
+		}
+		if (i > 0 && classes[i-1] == bidi.EN) || (j < n && classes[j] == bidi.EN) {
+			for k := i; k < j; k++ {
+				classes[k] = bidi.EN
+			}
+		}
+		i = j
+	}
+	// W6 and W7: any other separators are neutral, and numbers in left to
+	// right text are left to right
+	lastStrong = embedding
+	for i, class := range classes {
+		switch class {
+		case bidi.ES, bidi.ET, bidi.CS:
+			classes[i] = bidi.ON
+		case bidi.L, bidi.R:
+			lastStrong = class
+		case bidi.EN:
+			if lastStrong == bidi.L {
+				classes[i] = bidi.L
+			}
+		}
+	}
+	// N1 and N2: neutrals take the direction of the text around them if it
+	// agrees on one, and the paragraph's direction if not
+	isNeutral := func(class bidi.Class) bool {
+		return class == bidi.S || class == bidi.WS || class == bidi.ON
+	}
+	for i := 0; i < n; {
+		if !isNeutral(classes[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < n && isNeutral(classes[j]) {
+			j++
+		}
+		before, after := embedding, embedding
+		if i > 0 {
+			before = strongDirection(classes[i-1])
+		}
+		if j < n {
+			after = strongDirection(classes[j])
+		}
+		resolved := embedding
+		if before == after {
+			resolved = before
+		}
+		for k := i; k < j; k++ {
+			classes[k] = resolved
+		}
+		i = j
+	}
+	// I1 and I2
+	levels := make([]int, n)
+	for i, class := range classes {
+		levels[i] = base
+		switch {
+		case base == 0 && class == bidi.R:
+			levels[i] = 1
+		case base == 0 && (class == bidi.EN || class == bidi.AN):
+			levels[i] = 2
+		case base == 1 && class != bidi.R:
+			levels[i] = 2
+		}
+	}
+	return levels
+}
+
+// mirror is how r is drawn in right to left text, where brackets and the like
+// face the other way
+func mirror(r rune) rune {
+	if mirrored, ok := mirroredRunes[r]; ok {
+		return mirrored
+	}
+	if props, _ := bidi.LookupRune(r); props.IsBracket() {
+		return []rune(bidi.ReverseString(string(r)))[0]
+	}
+	return r
+}
+
+// isMark reports whether r is drawn on the character before it rather than
+// beside it
+func isMark(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me) || r == '\u200d' || unicode.Is(unicode.Variation_Selector, r)
+}
+
+// visualOrder reorders a line of a paragraph into the order its characters
+// are drawn in from left to right. Runs of right to left text are reversed,
+// keeping marks after the letters they are on, and their brackets mirrored.
+func visualOrder(line string, rtl bool) string {
+	runes := []rune(line)
+	levels := resolveLevels(runes, rtl)
+	base := 0
+	if rtl {
+		base = 1
+	}
+	// L1: spaces at the end of a line go back to the paragraph's direction
+	for i := len(runes) - 1; i >= 0 && unicode.IsSpace(runes[i]); i-- {
+		levels[i] = base
+	}
+
+	// characters are reordered a cluster at a time so marks stay with their
+	// letters
+	type cluster struct {
+		runes []rune
+		level int
+	}
+	clusters := []cluster{}
+	highest, lowestOdd := 0, 0
+	for i, r := range runes {
+		if isMark(r) && len(clusters) > 0 {
+			last := &clusters[len(clusters)-1]
+			last.runes = append(last.runes, r)
+			continue
+		}
+		clusters = append(clusters, cluster{runes: []rune{r}, level: levels[i]})
+		highest = max(highest, levels[i])
+		if levels[i]%2 == 1 && (lowestOdd == 0 || levels[i] < lowestOdd) {
+			lowestOdd = levels[i]
+		}
+	}
+	// L2: from the highest level down to the lowest odd one, reverse every
+	// run at that level or above
+	for level := highest; lowestOdd > 0 && level >= lowestOdd; level-- {
+		for i := 0; i < len(clusters); {
+			if clusters[i].level < level {
+				i++
+				continue
+			}
+			j := i
+			for j < len(clusters) && clusters[j].level >= level {
+				j++
+			}
+			for a, b := i, j-1; a < b; a, b = a+1, b-1 {
+				clusters[a], clusters[b] = clusters[b], clusters[a]
+			}
+			i = j
+		}
+	}
+
+	visual := make([]rune, 0, len(runes))
+	for _, c := range clusters {
+		for _, r := range c.runes {
+			if c.level%2 == 1 {
+				r = mirror(r)
+			}
+			visual = append(visual, r)
+		}
+	}
+	return string(visual)
+}
+
+// displayLine is a line of a paragraph as it is drawn from left to right:
+// shaped, then put in visual order
+func displayLine(line string, fonts FontChain, rtl bool) string {
+	return visualOrder(shapeArabic(line, fonts.has), rtl)
+}
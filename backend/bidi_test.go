@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// bidiTests are cases in the manner of the Unicode BidiCharacterTest.txt: a
+// paragraph, its direction, the level each character resolves to and the
+// order the characters are drawn in from left to right. None of them use
+// explicit embeddings or need brackets paired, which resolveLevels doesn't
+// support.
+var bidiTests = []struct {
+	name   string
+	text   string
+	rtl    bool
+	levels []int
+	visual string
+}{
+	{name: "left to right", text: "abc", levels: []int{0, 0, 0}, visual: "abc"},
+	{name: "hebrew in a left to right paragraph", text: "אבג", levels: []int{1, 1, 1}, visual: "גבא"},
+	{
+		name:   "hebrew between latin words",
+		text:   "abc אבג def",
+		levels: []int{0, 0, 0, 0, 1, 1, 1, 0, 0, 0, 0},
+		visual: "abc גבא def",
+	},
+	{
+		name:   "latin between hebrew words",
+		text:   "אבג abc דהו",
+		rtl:    true,
+		levels: []int{1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1},
+		visual: "והד abc גבא",
+	},
+	// W7 and I2: numbers in right to left text stay left to right
+	{name: "european number after hebrew", text: "אבג 123", rtl: true, levels: []int{1, 1, 1, 1, 2, 2, 2}, visual: "123 גבא"},
+	{name: "european number in a left to right paragraph", text: "א 12", levels: []int{1, 1, 2, 2}, visual: "12 א"},
+	{name: "number after latin", text: "abc 12", rtl: true, levels: []int{2, 2, 2, 2, 2, 2}, visual: "abc 12"},
+	// W2: digits after an Arabic letter are Arabic numbers
+	{name: "arabic number", text: "ا 12", rtl: true, levels: []int{1, 1, 2, 2}, visual: "12 ا"},
+	// W4: a plus sign joins european numbers but not Arabic ones
+	{name: "plus between arabic numbers", text: "ا 1+2", rtl: true, levels: []int{1, 1, 2, 1, 2}, visual: "2+1 ا"},
+	{name: "plus between european numbers", text: "א 1+2", rtl: true, levels: []int{1, 1, 2, 2, 2}, visual: "1+2 א"},
+	// W4: a separator between two numbers joins them
+	{name: "separated number", text: "א 1,2", rtl: true, levels: []int{1, 1, 2, 2, 2}, visual: "1,2 א"},
+	{name: "separator between words", text: "א, ב", rtl: true, levels: []int{1, 1, 1, 1}, visual: "ב ,א"},
+	// W5: a currency sign goes with its number
+	{name: "terminator", text: "א $12", rtl: true, levels: []int{1, 1, 2, 2, 2}, visual: "$12 א"},
+	{name: "terminator after number", text: "א 12%", rtl: true, levels: []int{1, 1, 2, 2, 2}, visual: "12% א"},
+	// N1 and N2: neutrals between text of different directions take the
+	// paragraph's
+	{name: "neutral between directions", text: "a - א", levels: []int{0, 0, 0, 0, 1}, visual: "a - א"},
+	{name: "neutral between directions right to left", text: "a - א", rtl: true, levels: []int{2, 1, 1, 1, 1}, visual: "א - a"},
+	// W1: marks take the direction of their letter and stay after it
+	{name: "mark", text: "אְב", levels: []int{1, 1, 1}, visual: "באְ"},
+	// L1: spaces at the end of the line are at the paragraph's level
+	{name: "trailing space", text: "abc ", rtl: true, levels: []int{2, 2, 2, 1}, visual: " abc"},
+	// L4: brackets are mirrored in right to left text
+	{name: "mirrored brackets", text: "א(ב)", rtl: true, levels: []int{1, 1, 1, 1}, visual: "(ב)א"},
+	{name: "mirrored angle brackets", text: "א<ב", rtl: true, levels: []int{1, 1, 1}, visual: "ב>א"},
+	// embedding controls count as neutrals
+	{name: "isolate controls", text: "a\u2067b", levels: []int{0, 0, 0}, visual: "a\u2067b"},
+}
+
+func TestResolveLevels(t *testing.T) {
+	for _, test := range bidiTests {
+		t.Run(test.name, func(t *testing.T) {
+			got := resolveLevels([]rune(test.text), test.rtl)
+			if fmt.Sprint(got) != fmt.Sprint(test.levels) {
+				t.Errorf("resolveLevels(%q, %v) = %v, want %v", test.text, test.rtl, got, test.levels)
+			}
+		})
+	}
+}
+
+func TestVisualOrder(t *testing.T) {
+	for _, test := range bidiTests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := visualOrder(test.text, test.rtl); got != test.visual {
+				t.Errorf("visualOrder(%q, %v) = %q, want %q", test.text, test.rtl, got, test.visual)
+			}
+		})
+	}
+}
+
+func TestParagraphIsRTL(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"", false},
+		{"abc אבג", false},
+		{"אבג abc", true},
+		{"سلام", true},
+		// digits and punctuation aren't strongly directional
+		{"123 - אבג", true},
+		{"123 - abc", false},
+		{"123", false},
+	}
+	for _, test := range tests {
+		if got := paragraphIsRTL(test.text); got != test.want {
+			t.Errorf("paragraphIsRTL(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
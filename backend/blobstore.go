@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// where images and GIFs are kept, set up from the command line in main()
+	blobStore       BlobStore = newLocalBlobStore(".", blobURLSigner{})
+	errBlobNotFound           = errors.New("blob not found")
+	// set when other instances keep their blobs in the same store. Their
+	// references aren't counted in blobRefs, and identical content resolves
+	// to the same key for every instance, so nothing is ever deleted from a
+	// shared store.
+	blobStoreShared = false
+	// blobs are namespaced by the first part of their key
+	blobPrefixes = []string{"images", "gifs", "apngs", "exports"}
+)
+
+// BlobStore keeps the images and GIFs a game produces. Keys are slash
+// separated paths like "images/1a2b3c4d.png". Only the files are shared
+// between instances using the same store: games, ended games and the image
+// registry stay in each instance's memory, so a load balancer has to send
+// every request about a game to the instance holding it. Instances sharing
+// keys must run with blobStoreShared set, or each would delete blobs the
+// others still use; giving each one its own -storage-root or -s3-prefix
+// instead keeps their blobs apart and lets them clean up after themselves.
+type BlobStore interface {
+	Put(key string, data []byte) error
+	// Get returns errBlobNotFound for a key which was never stored
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+	Exists(key string) bool
+	// URL is where clients can fetch the blob. baseURL is the URL the server
+	// was reached at, for stores which are served through serveBlob.
+	URL(key, baseURL string) string
+}
+
+// isBlobKey reports whether key is a clean path under one of the blob
+// prefixes, so keys taken from request paths can't escape the store
+func isBlobKey(key string) bool {
+	if key == "" || path.Clean(key) != key || strings.HasPrefix(key, "/") || strings.Contains(key, "..") {
+		return false
+	}
+	for _, prefix := range blobPrefixes {
+		if strings.HasPrefix(key, prefix+"/") && len(key) > len(prefix)+1 {
+			return true
+		}
+	}
+	return false
+}
+
+func blobContentType(key string) string {
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return contentType
+}
+
+// blobURLSigner makes URLs for blobs served through serveBlob. With signing
+// on, URLs carry an expiry time and an HMAC of the key and expiry, which
+// serveBlob checks. Every instance behind a load balancer must share the
+// secret.
+type blobURLSigner struct {
+	signed bool
+	secret []byte
+	expiry time.Duration
+}
+
+func (s blobURLSigner) signature(key string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(key + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s blobURLSigner) url(key, baseURL string) string {
+	blobURL := baseURL + "/" + key
+	if !s.signed {
+		return blobURL
+	}
+	expires := time.Now().Add(s.expiry).Unix()
+	return blobURL + "?expires=" + strconv.FormatInt(expires, 10) + "&signature=" + s.signature(key, expires)
+}
+
+// verify checks the expiry and signature of a request for a blob
+func (s blobURLSigner) verify(key string, r *http.Request) bool {
+	if !s.signed {
+		return true
+	}
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(r.URL.Query().Get("signature")), []byte(s.signature(key, expires)))
+}
+
+// localBlobStore keeps blobs as files under root
+type localBlobStore struct {
+	root   string
+	signer blobURLSigner
+}
+
+func newLocalBlobStore(root string, signer blobURLSigner) *localBlobStore {
+	return &localBlobStore{root: root, signer: signer}
+}
+
+func (s *localBlobStore) filePath(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func (s *localBlobStore) Put(key string, data []byte) error {
+	filePath := s.filePath(key)
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+	// blobs are stored outside stateLock, so the same key can be written by
+	// two requests at once while a third reads it. Renaming a finished file
+	// into place means readers only ever see a whole one.
+	file, err := os.CreateTemp(filepath.Dir(filePath), ".put-*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filePath)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+func (s *localBlobStore) Get(key string) ([]byte, error) {
+	data, err := os.ReadFile(s.filePath(key))
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	return data, err
+}
+
+func (s *localBlobStore) Delete(key string) error {
+	err := os.Remove(s.filePath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *localBlobStore) Exists(key string) bool {
+	_, err := os.Stat(s.filePath(key))
+	return err == nil
+}
+
+func (s *localBlobStore) URL(key, baseURL string) string {
+	return s.signer.url(key, baseURL)
+}
+
+// memoryBlobStore keeps blobs in the process, for trying the server out
+// without touching the disk. Everything is lost when it stops.
+type memoryBlobStore struct {
+	mu     sync.RWMutex
+	blobs  map[string][]byte
+	signer blobURLSigner
+}
+
+func newMemoryBlobStore(signer blobURLSigner) *memoryBlobStore {
+	return &memoryBlobStore{blobs: make(map[string][]byte), signer: signer}
+}
+
+func (s *memoryBlobStore) Put(key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *memoryBlobStore) Get(key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.blobs[key]
+	if !ok {
+		return nil, errBlobNotFound
+	}
+	return data, nil
+}
+
+func (s *memoryBlobStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, key)
+	return nil
+}
+
+func (s *memoryBlobStore) Exists(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.blobs[key]
+	return ok
+}
+
+func (s *memoryBlobStore) URL(key, baseURL string) string {
+	return s.signer.url(key, baseURL)
+}
+
+// configureBlobStore sets up blobStore from the command line flags
+func configureBlobStore(kind, root string, signed bool, expiry time.Duration, s3Config s3BlobStoreConfig) error {
+	signer := blobURLSigner{signed: signed, expiry: expiry}
+	if signed {
+		if expiry <= 0 {
+			return fmt.Errorf("signed URL expiry must be positive")
+		}
+		secret := os.Getenv("PT_URL_SECRET")
+		if secret == "" {
+			// fine for a single instance, but URLs won't survive a restart
+			secret = generateShortHash() + generateShortHash()
+			fmt.Println("PT_URL_SECRET is not set, signing URLs with a random secret")
+		}
+		signer.secret = []byte(secret)
+	}
+
+	switch kind {
+	case "local":
+		blobStore = newLocalBlobStore(root, signer)
+	case "memory":
+		if blobStoreShared {
+			return fmt.Errorf("memory storage can't be shared between instances")
+		}
+		blobStore = newMemoryBlobStore(signer)
+	case "s3":
+		s3Config.presign = signed
+		s3Config.expiry = expiry
+		store, err := newS3BlobStore(s3Config)
+		if err != nil {
+			return err
+		}
+		blobStore = store
+	default:
+		return fmt.Errorf("storage must be one of local, memory, s3")
+	}
+	return nil
+}
+
+// blobSigner returns the URL signer of a store served through serveBlob
+func blobSigner() (blobURLSigner, bool) {
+	switch store := blobStore.(type) {
+	case *localBlobStore:
+		return store.signer, true
+	case *memoryBlobStore:
+		return store.signer, true
+	}
+	return blobURLSigner{}, false
+}
+
+// blobCacheControl is how long clients may keep a blob served through
+// serveBlob: for good, as its key names its content, unless the URL it was
+// asked for at expires, when only the client itself may keep it and only
+// until then
+func blobCacheControl(signer blobURLSigner, r *http.Request) string {
+	if !signer.signed {
+		return immutableCacheControl
+	}
+	expires, _ := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	return "private, max-age=" + strconv.FormatInt(max(0, expires-time.Now().Unix()), 10)
+}
+
+// serveBlob serves /images/, /gifs/ and /apngs/ out of the blob store. Stores with
+// their own URLs, like S3, are still reachable here so older links keep
+// working, unless they presign their URLs: fetching here would get around the
+// expiry of those.
+func serveBlob(w http.ResponseWriter, r *http.Request) {
+	allowCors(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if r.Method == "GET" || r.Method == "HEAD" {
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		if !isBlobKey(key) {
+			http.NotFound(w, r)
+			return
+		}
+		signer, ok := blobSigner()
+		if s3Store, isS3 := blobStore.(*s3BlobStore); (ok && !signer.verify(key, r)) || (isS3 && s3Store.config.presign) {
+			http.Error(w, "Link has expired or is invalid", http.StatusForbidden)
+			return
+		}
+		// a blob's key names its content, so a client holding a copy with
+		// the same ETag already has the right bytes
+		if r.Header.Get("If-None-Match") == blobETag(key) && blobStore.Exists(key) {
+			w.Header().Set("ETag", blobETag(key))
+			w.Header().Set("Cache-Control", blobCacheControl(signer, r))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		data, err := blobStore.Get(key)
+		if err == errBlobNotFound {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			fmt.Println("Error reading blob:", err)
+			http.Error(w, "Error reading the file", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", blobETag(key))
+		w.Header().Set("Cache-Control", blobCacheControl(signer, r))
+		w.Header().Set("Content-Type", blobContentType(key))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == "GET" {
+			w.Write(data)
+		}
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
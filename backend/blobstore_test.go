@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeBlobCaching(t *testing.T) {
+	saved := blobStore
+	t.Cleanup(func() {
+		blobStore = saved
+	})
+	key := "images/drawing.png"
+
+	blobStore = newMemoryBlobStore(blobURLSigner{})
+	blobStore.Put(key, []byte("PNG"))
+	recorder := httptest.NewRecorder()
+	serveBlob(recorder, httptest.NewRequest("GET", blobStore.URL(key, ""), nil))
+	if got := recorder.Header().Get("Cache-Control"); got != immutableCacheControl {
+		t.Errorf("unsigned blob has Cache-Control %q, want %q", got, immutableCacheControl)
+	}
+
+	// a signed URL stops working when it expires, so nobody may keep what it
+	// got past then
+	blobStore = newMemoryBlobStore(blobURLSigner{signed: true, secret: []byte("secret"), expiry: time.Hour})
+	blobStore.Put(key, []byte("PNG"))
+	recorder = httptest.NewRecorder()
+	serveBlob(recorder, httptest.NewRequest("GET", blobStore.URL(key, ""), nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("signed URL got %d, want 200", recorder.Code)
+	}
+	got := recorder.Header().Get("Cache-Control")
+	maxAge, err := strconv.Atoi(strings.TrimPrefix(got, "private, max-age="))
+	if err != nil || maxAge <= 0 || maxAge > 3600 {
+		t.Errorf("signed blob has Cache-Control %q, want a private one lasting until it expires", got)
+	}
+
+	recorder = httptest.NewRecorder()
+	serveBlob(recorder, httptest.NewRequest("GET", "/"+key, nil))
+	if recorder.Code != http.StatusForbidden {
+		t.Errorf("unsigned request for a signed store got %d, want 403", recorder.Code)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+var (
+	// booklets are laid out on A4, measured in points
+	bookletPageWidth  = 595.0
+	bookletPageHeight = 842.0
+	bookletMargin     = 48.0
+	bookletGutter     = 24.0
+	// each page of a chain holds a grid of entries, and longer chains carry
+	// on over the next page
+	bookletColumns     = 2
+	bookletRows        = 2
+	bookletLabelHeight = 16.0
+	bookletCaptionSize = 72.0
+	bookletJPEGQuality = 90
+)
+
+// Booklet lays an ended game out as a PDF, page by page. Every page shares
+// one resource dictionary holding the fonts and all of the drawings. Each
+// font of the game's chain is embedded, if any text ends up set in it.
+type Booklet struct {
+	pdf         *PDFWriter
+	fonts       FontChain
+	pdfFonts    []*PDFFont
+	pagesId     int
+	resourcesId int
+	pageIds     []int
+	// the XObject name of each drawing, keyed by blob key, and the object
+	// each name refers to
+	images   map[string]string
+	imageIds map[string]int
+	content  bytes.Buffer
+}
+
+func newBooklet(fonts FontChain) *Booklet {
+	b := &Booklet{
+		pdf:      newPDFWriter(),
+		fonts:    fonts,
+		images:   make(map[string]string),
+		imageIds: make(map[string]int),
+	}
+	for _, f := range fonts {
+		b.pdfFonts = append(b.pdfFonts, newPDFFont(f))
+	}
+	b.pagesId = b.pdf.reserve()
+	b.resourcesId = b.pdf.reserve()
+	return b
+}
+
+// top converts a distance from the top of the page to a PDF y coordinate,
+// which counts up from the bottom
+func (b *Booklet) top(y float64) float64 {
+	return bookletPageHeight - y
+}
+
+// width measures text set at size, in points
+func (b *Booklet) width(text string, size float64) float64 {
+	return float64(b.fonts.width(text, size)) / 64
+}
+
+// wrap breaks text into lines no wider than maxWidth points at size, in the
+// order they are drawn in, and reports whether the text reads right to left
+func (b *Booklet) wrap(text string, size, maxWidth float64) ([]string, bool) {
+	rtl := paragraphIsRTL(text)
+	lines := wrapText(text, b.fonts, size, int(maxWidth))
+	for i, line := range lines {
+		lines[i] = displayLine(line, b.fonts, rtl)
+	}
+	return lines, rtl
+}
+
+// text writes a line with its baseline at y points from the top of the page,
+// switching fonts wherever the chain falls back to another
+func (b *Booklet) text(x, y, size, gray float64, line string) {
+	fmt.Fprintf(&b.content, "BT %.2f g %.2f %.2f Td", gray, x, b.top(y))
+	for _, run := range b.fonts.runs(line) {
+		fmt.Fprintf(&b.content, " /F%d %.2f Tf %s TJ", run.font+1, size, b.pdfFonts[run.font].show(run.text))
+	}
+	b.content.WriteString(" ET\n")
+}
+
+// centredText writes a line centred between x and x+width
+func (b *Booklet) centredText(x, width, y, size, gray float64, line string) {
+	b.text(x+(width-b.width(line, size))/2, y, size, gray, line)
+}
+
+// blockWidth is how wide the widest of lines is at size, in points
+func (b *Booklet) blockWidth(lines []string, size float64) float64 {
+	width := 0.0
+	for _, line := range lines {
+		width = max(width, b.width(line, size))
+	}
+	return width
+}
+
+// paragraphText writes a line of a paragraph of lines blockWidth wide centred
+// between x and x+width. Lines of right to left text are lined up on the
+// right edge of the paragraph instead of each being centred.
+func (b *Booklet) paragraphText(x, width, blockWidth, y, size, gray float64, line string, rtl bool) {
+	if !rtl {
+		b.centredText(x, width, y, size, gray, line)
+		return
+	}
+	b.text(x+(width+blockWidth)/2-b.width(line, size), y, size, gray, line)
+}
+
+// textBox wraps text centred in a box whose top left corner is x, y points
+// from the top left of the page, shrinking it from maxSize until it fits.
+// Text which doesn't fit even at minSize is cut off at the edge of the box.
+func (b *Booklet) textBox(x, y, width, height, maxSize, minSize float64, text string) {
+	padding := min(12, width/8, height/8)
+	size := maxSize
+	lines, rtl := b.wrap(text, size, width-2*padding)
+	for size > minSize && float64(len(lines))*size*1.3 > height-2*padding {
+		size--
+		lines, rtl = b.wrap(text, size, width-2*padding)
+	}
+	lineHeight := size * 1.3
+	blockWidth := b.blockWidth(lines, size)
+	fmt.Fprintf(&b.content, "q %.2f %.2f %.2f %.2f re W n\n", x, b.top(y+height), width, height)
+	baseline := y + (height-float64(len(lines))*lineHeight)/2 + size
+	for _, line := range lines {
+		b.paragraphText(x, width, blockWidth, baseline, size, 0, line, rtl)
+		baseline += lineHeight
+	}
+	b.content.WriteString("Q\n")
+}
+
+// frame outlines a box whose top left corner is x, y points from the top left
+// of the page
+func (b *Booklet) frame(x, y, width, height float64) {
+	fmt.Fprintf(&b.content, "q 0.8 G 0.5 w %.2f %.2f %.2f %.2f re S Q\n", x, b.top(y+height), width, height)
+}
+
+// addImage embeds img the first time key is seen, flattened onto white as
+// JPEG, and returns the name pages draw it by
+func (b *Booklet) addImage(key string, img image.Image) (string, error) {
+	if name, ok := b.images[key]; ok {
+		return name, nil
+	}
+	bounds := img.Bounds()
+	flattened := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flattened, flattened.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+	draw.Draw(flattened, flattened.Bounds(), img, bounds.Min, draw.Over)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, flattened, &jpeg.Options{Quality: bookletJPEGQuality}); err != nil {
+		return "", err
+	}
+	id := b.pdf.reserve()
+	b.pdf.writeStream(id, fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /DeviceRGB /BitsPerComponent 8 /Filter /DCTDecode", bounds.Dx(), bounds.Dy()), buf.Bytes())
+	name := "Im" + strconv.Itoa(len(b.images)+1)
+	b.images[key] = name
+	b.imageIds[name] = id
+	return name, nil
+}
+
+// drawImage fits an embedded image inside a box, keeping its aspect ratio
+func (b *Booklet) drawImage(name string, bounds image.Rectangle, x, y, width, height float64) {
+	scale := min(width/float64(bounds.Dx()), height/float64(bounds.Dy()))
+	w, h := float64(bounds.Dx())*scale, float64(bounds.Dy())*scale
+	x += (width - w) / 2
+	y += (height - h) / 2
+	fmt.Fprintf(&b.content, "q %.2f 0 0 %.2f %.2f %.2f cm /%s Do Q\n", w, h, x, b.top(y+h), name)
+}
+
+// endPage writes the page drawn so far, with its number at the bottom
+func (b *Booklet) endPage() {
+	b.centredText(0, bookletPageWidth, bookletPageHeight-bookletMargin/2, 9, 0.5, strconv.Itoa(len(b.pageIds)+1))
+	contentId := b.pdf.reserve()
+	b.pdf.writeStream(contentId, "/Filter /FlateDecode", deflate(b.content.Bytes()))
+	b.content.Reset()
+	pageId := b.pdf.reserve()
+	b.pdf.writeObject(pageId, fmt.Sprintf("<</Type /Page /Parent %d 0 R /MediaBox [0 0 %.0f %.0f] /Resources %d 0 R /Contents %d 0 R>>",
+		b.pagesId, bookletPageWidth, bookletPageHeight, b.resourcesId, contentId))
+	b.pageIds = append(b.pageIds, pageId)
+}
+
+// finish writes everything the pages share and returns the PDF
+func (b *Booklet) finish(title string) []byte {
+	fonts := ""
+	for i, f := range b.pdfFonts {
+		if len(f.used) == 0 {
+			continue
+		}
+		id := b.pdf.reserve()
+		f.write(b.pdf, id)
+		fonts += fmt.Sprintf("/F%d %d 0 R ", i+1, id)
+	}
+
+	kids := []string{}
+	for _, id := range b.pageIds {
+		kids = append(kids, strconv.Itoa(id)+" 0 R")
+	}
+	b.pdf.writeObject(b.pagesId, fmt.Sprintf("<</Type /Pages /Kids [%s] /Count %d>>", strings.Join(kids, " "), len(b.pageIds)))
+
+	xObjects := ""
+	for i := 1; i <= len(b.imageIds); i++ {
+		name := "Im" + strconv.Itoa(i)
+		xObjects += fmt.Sprintf("/%s %d 0 R ", name, b.imageIds[name])
+	}
+	b.pdf.writeObject(b.resourcesId, fmt.Sprintf("<</Font <<%s>> /XObject <<%s>>>>", fonts, xObjects))
+
+	catalogId := b.pdf.reserve()
+	b.pdf.writeObject(catalogId, fmt.Sprintf("<</Type /Catalog /Pages %d 0 R>>", b.pagesId))
+	infoId := b.pdf.reserve()
+	b.pdf.writeObject(infoId, fmt.Sprintf("<</Title %s /Producer %s>>", pdfString(title), pdfString("Painter's Telegraph")))
+	return b.pdf.finish(catalogId, infoId)
+}
+
+// coverPage lists the game's name, when it was played and who played it
+func (b *Booklet) coverPage(game *ExportGame) {
+	width := bookletPageWidth - 2*bookletMargin
+	y := 220.0
+	titleSize := 36.0
+	titleLines, rtl := b.wrap(game.gameName, titleSize, width)
+	titleWidth := b.blockWidth(titleLines, titleSize)
+	for _, line := range titleLines {
+		b.paragraphText(bookletMargin, width, titleWidth, y, titleSize, 0, line, rtl)
+		y += titleSize * 1.25
+	}
+	y += 8
+	b.centredText(bookletMargin, width, y, 14, 0.4, "Played "+game.endedAt.Format("2 January 2006"))
+	y += 60
+	b.centredText(bookletMargin, width, y, 16, 0, "Players")
+	y += 28
+	for _, player := range game.players {
+		lines, rtl := b.wrap(player, 12, width)
+		nameWidth := b.blockWidth(lines, 12)
+		for _, line := range lines {
+			if y > bookletPageHeight-bookletMargin-24 {
+				break
+			}
+			b.paragraphText(bookletMargin, width, nameWidth, y, 12, 0.2, line, rtl)
+			y += 18
+		}
+	}
+	b.endPage()
+}
+
+// chainPages lays a chain out in reading order, each entry showing who made
+// it, the caption and the drawing under it
+func (b *Booklet) chainPages(game *ExportGame, c int) error {
+	chain := game.chains[c]
+	cellWidth := (bookletPageWidth - 2*bookletMargin - float64(bookletColumns-1)*bookletGutter) / float64(bookletColumns)
+	gridTop := bookletMargin + 40
+	gridHeight := bookletPageHeight - gridTop - bookletMargin - 20
+	rowHeight := (gridHeight - float64(bookletRows-1)*bookletGutter) / float64(bookletRows)
+	drawingSize := min(cellWidth, rowHeight-bookletLabelHeight-bookletCaptionSize-6)
+	perPage := bookletColumns * bookletRows
+
+	for start := 0; start < len(chain.captions); start += perPage {
+		heading := "Chain " + strconv.Itoa(c+1)
+		if start > 0 {
+			heading += " (continued)"
+		}
+		b.text(bookletMargin, bookletMargin+16, 20, 0, heading)
+		for round := start; round < min(start+perPage, len(chain.captions)); round++ {
+			x := bookletMargin + float64((round-start)%bookletColumns)*(cellWidth+bookletGutter)
+			y := gridTop + float64((round-start)/bookletColumns)*(rowHeight+bookletGutter)
+			label := entryLabel(round, chain.authors[round])
+			b.centredText(x, cellWidth, y+10, 9, 0.35, displayLine(label, b.fonts, paragraphIsRTL(label)))
+			y += bookletLabelHeight
+
+			caption := chain.captions[round]
+			if caption == "" {
+				caption = nonSubmissionString_caption
+			}
+			b.textBox(x, y, cellWidth, bookletCaptionSize, 14, 6, caption)
+			b.frame(x, y, cellWidth, bookletCaptionSize)
+			y += bookletCaptionSize + 6
+
+			key := chain.drawingPaths[round]
+			var drawing image.Image
+			var err error
+			if key != "" {
+				drawing, err = loadImage(key)
+			} else {
+				// every missing drawing looks the same, so one copy does
+				key = "missing drawing"
+				drawing, err = getNonSubmissionImage("drawing", captionTheme(defaultCaptionThemeName), game.fonts)
+			}
+			if err != nil {
+				return fmt.Errorf("error loading drawing image: %v", err)
+			}
+			name, err := b.addImage(key, drawing)
+			if err != nil {
+				return err
+			}
+			drawingX := x + (cellWidth-drawingSize)/2
+			b.drawImage(name, drawing.Bounds(), drawingX, y, drawingSize, drawingSize)
+			b.frame(drawingX, y, drawingSize, drawingSize)
+		}
+		b.endPage()
+	}
+	return nil
+}
+
+// renderBooklet makes a printable PDF of a game: a cover page, then each
+// chain on a page of its own, or over as many pages as it takes. Text is set
+// in the game's fonts, which are embedded in the file.
+func renderBooklet(game *ExportGame) ([]byte, error) {
+	b := newBooklet(game.fonts)
+	b.coverPage(game)
+	for c := range game.chains {
+		if err := b.chainPages(game, c); err != nil {
+			return nil, err
+		}
+	}
+	return b.finish(game.gameName), nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+)
+
+var (
+	// how many registered images, chain entries and GIFs of ended games point
+	// at each blob, and how many requests are storing it. A blob is deleted
+	// when its last reference is released.
+	blobRefs = make(map[string]int)
+	// blob keys name their content, so a blob never changes once stored
+	immutableCacheControl = "public, max-age=31536000, immutable"
+)
+
+// contentKey is where data is stored under prefix, named by its SHA-256
+func contentKey(prefix, ext string, data []byte) string {
+	sum := sha256.Sum256(data)
+	return prefix + "/" + hex.EncodeToString(sum[:]) + ext
+}
+
+// putContent stores data under prefix, named by the SHA-256 of the data.
+// Storing the same content again resolves to the blob already there. Must be
+// called holding stateLock, and the blob kept by retaining it before letting
+// go of the lock.
+func putContent(prefix, ext string, data []byte) (string, error) {
+	key := contentKey(prefix, ext, data)
+	if blobStore.Exists(key) {
+		return key, nil
+	}
+	return key, blobStore.Put(key, data)
+}
+
+// storeContent is putContent for callers not holding stateLock. Identical
+// content resolves to the same blob, so it takes a reference to the blob
+// before storing it, which stops anyone else releasing their copy of the
+// content from deleting it in the meantime. The caller drops that reference
+// with releaseBlob, holding stateLock, once it has retained the blob itself
+// or decided not to keep it.
+func storeContent(prefix, ext string, data []byte) (string, error) {
+	key := contentKey(prefix, ext, data)
+	stateLock.Lock()
+	retainBlob(key)
+	stateLock.Unlock()
+	if _, err := putContent(prefix, ext, data); err != nil {
+		stateLock.Lock()
+		releaseBlob(key)
+		stateLock.Unlock()
+		return "", err
+	}
+	return key, nil
+}
+
+// blobETag is the content hash in a blob's key
+func blobETag(key string) string {
+	name := path.Base(key)
+	return "\"" + strings.TrimSuffix(name, path.Ext(name)) + "\""
+}
+
+func retainBlob(key string) {
+	blobRefs[key]++
+}
+
+// releaseBlob drops a reference to a blob, deleting it once nothing points
+// at it, unless other instances share the store and may still point at it
+func releaseBlob(key string) {
+	blobRefs[key]--
+	if blobRefs[key] > 0 {
+		return
+	}
+	delete(blobRefs, key)
+	if blobStoreShared {
+		return
+	}
+	if err := blobStore.Delete(key); err != nil {
+		fmt.Println("Error deleting blob:", err)
+	}
+}
+
+// endedGameBlobs lists the blobs the ended game's drawings and exports point at,
+// once for each time they are used
+func endedGameBlobs(endedGame *EndedGame) []string {
+	keys := []string{}
+	for _, chain := range endedGame.drawings {
+		for _, imageId := range chain {
+			if registered, ok := imageRegistry[imageId]; ok {
+				keys = append(keys, registered.path)
+			}
+		}
+	}
+	for _, renders := range endedGame.renders {
+		for _, render := range renders {
+			if render.file != "" {
+				keys = append(keys, render.file)
+			}
+		}
+	}
+	for _, key := range endedGame.exports {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func retainEndedGameBlobs(endedGame *EndedGame) {
+	for _, key := range endedGameBlobs(endedGame) {
+		retainBlob(key)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// withMemoryBlobStore runs the test against an empty store and refcounts
+func withMemoryBlobStore(t *testing.T) {
+	store, refs := blobStore, blobRefs
+	blobStore, blobRefs = newMemoryBlobStore(blobURLSigner{}), make(map[string]int)
+	t.Cleanup(func() {
+		blobStore, blobRefs = store, refs
+	})
+}
+
+func TestStoreContentSurvivesIdenticalDiscard(t *testing.T) {
+	withMemoryBlobStore(t)
+	data := []byte("a blank canvas")
+
+	// two requests store the same drawing at once
+	first, err := storeContent(imagesDir, ".png", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := storeContent(imagesDir, ".png", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatalf("identical content was stored as %s and %s", first, second)
+	}
+
+	// the first finds its round has ended and lets its copy go, then the
+	// second keeps its own
+	stateLock.Lock()
+	releaseBlob(first)
+	retainBlob(second)
+	releaseBlob(second)
+	stateLock.Unlock()
+	if !blobStore.Exists(second) {
+		t.Fatalf("%s was deleted while the second request was still storing it", second)
+	}
+	if blobRefs[second] != 1 {
+		t.Errorf("%s has %d references, want 1", second, blobRefs[second])
+	}
+
+	stateLock.Lock()
+	releaseBlob(second)
+	stateLock.Unlock()
+	if blobStore.Exists(second) {
+		t.Errorf("%s is still stored after its last reference was released", second)
+	}
+}
+
+func TestSharedStoreKeepsReleasedBlobs(t *testing.T) {
+	withMemoryBlobStore(t)
+	registry := imageRegistry
+	imageRegistry = make(map[string]*RegisteredImage)
+	blobStoreShared = true
+	t.Cleanup(func() {
+		imageRegistry, blobStoreShared = registry, false
+	})
+
+	// an upload nobody submitted, of a drawing another instance may have
+	// stored too and still use
+	key, err := storeContent(imagesDir, ".png", []byte("a blank canvas"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateLock.Lock()
+	registered := registerImage(key, "player", &Game{gameId: "ended"}, nil)
+	registered.createdAt = time.Now().Add(-2 * uploadGracePeriod)
+	releaseBlob(key)
+	report := sweep(time.Now(), false)
+	stateLock.Unlock()
+	if len(report.uploads) != 1 {
+		t.Fatalf("the janitor removed uploads %q, want the orphaned one", report.uploads)
+	}
+	if len(report.blobs) > 0 {
+		t.Errorf("the janitor reported %q deleted from a shared store", report.blobs)
+	}
+	if !blobStore.Exists(key) {
+		t.Errorf("%s was deleted from a shared store", key)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+var (
+	// the formats chains can be exported in. GIFs are always made, as that
+	// is what the gifs of an ended game list.
+	exportFormats      = []string{"gif", "apng"}
+	animationExporters = map[string]AnimationExporter{
+		"gif":  gifExporter{},
+		"apng": apngExporter{},
+	}
+	defaultExportFormat = "gif"
+	// how long the frames of an exported chain are shown, in centiseconds
+	defaultCaptionDuration = 300
+	defaultDrawingDuration = 500
+)
+
+// AnimationExporter turns the frames of a chain into an animation file
+type AnimationExporter interface {
+	// Encode makes the file, playing it loopCount times, or forever if
+	// loopCount is 0
+	Encode(animation *Animation, loopCount int) ([]byte, error)
+	// Prefix and Ext are the blob prefix and file extension the file is
+	// stored under
+	Prefix() string
+	Ext() string
+}
+
+func isExportFormat(format string) bool {
+	for _, f := range exportFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// exportFormatsToRender lists the formats rendered as soon as a game ends
+func exportFormatsToRender(format string) []string {
+	if format == "gif" {
+		return []string{"gif"}
+	}
+	return []string{"gif", format}
+}
+
+func exportFormatError() string {
+	return "format must be one of " + strings.Join(exportFormats, ", ")
+}
+
+type gifExporter struct{}
+
+func (gifExporter) Encode(animation *Animation, loopCount int) ([]byte, error) {
+	return encodeGif(animation, loopCount, gifPalette)
+}
+
+func (gifExporter) Prefix() string { return "gifs" }
+func (gifExporter) Ext() string    { return ".gif" }
+
+// apngExporter makes animated PNGs, which keep every color of every frame.
+// Browsers show them as plain PNGs, so they are stored with a .png extension.
+type apngExporter struct{}
+
+func (apngExporter) Encode(animation *Animation, loopCount int) ([]byte, error) {
+	return encodeAPNG(animation, loopCount)
+}
+
+func (apngExporter) Prefix() string { return "apngs" }
+func (apngExporter) Ext() string    { return ".png" }
+
+// Animation collects the frames of a chain as they are made, for an
+// AnimationExporter to encode. Only the part of each frame which changed from
+// the one before is kept, so the many frames of a stroke replay cost little
+// more than the finished drawing does.
+type Animation struct {
+	frames []animationFrame
+	// a copy of the last frame added, which the next is compared against
+	last *image.RGBA
+	// whether any frame has pixels which aren't opaque
+	alpha bool
+}
+
+// animationFrame is the part of a frame which differs from the frame before,
+// which for the first frame is all of it, and how long the frame is shown
+// for in centiseconds
+type animationFrame struct {
+	patch *image.RGBA
+	delay int
+	// whether any pixels are mostly transparent, which a GIF can only show by
+	// clearing the frame
+	transparent bool
+}
+
+// Add appends a frame shown for delay centiseconds. Every frame must be the
+// same size as the first.
+func (a *Animation) Add(frame image.Image, delay int) error {
+	rgba := toRGBA(frame)
+	changed := rgba.Bounds()
+	if a.last == nil {
+		a.last = image.NewRGBA(changed)
+	} else if changed != a.last.Bounds() {
+		return fmt.Errorf("animation frames must all be the same size")
+	} else {
+		changed = changedRect(a.last, rgba)
+	}
+	patch := image.NewRGBA(changed)
+	draw.Draw(patch, changed, rgba, changed.Min, draw.Src)
+	draw.Draw(a.last, changed, rgba, changed.Min, draw.Src)
+
+	transparent := false
+	for i := 3; i < len(rgba.Pix); i += 4 {
+		if rgba.Pix[i] < 128 {
+			transparent = true
+			break
+		}
+	}
+	a.alpha = a.alpha || !rgba.Opaque()
+	a.frames = append(a.frames, animationFrame{patch: patch, delay: delay, transparent: transparent})
+	return nil
+}
+
+// replay draws the frames back in order onto one canvas, calling f with the
+// canvas as each frame leaves it and the part of it the frame changed. The
+// canvas is reused from one frame to the next, so f mustn't keep it.
+func (a *Animation) replay(f func(canvas *image.RGBA, changed image.Rectangle, frame animationFrame) error) error {
+	if len(a.frames) == 0 {
+		return nil
+	}
+	canvas := image.NewRGBA(a.frames[0].patch.Bounds())
+	for _, frame := range a.frames {
+		changed := frame.patch.Bounds()
+		draw.Draw(canvas, changed, frame.patch, changed.Min, draw.Src)
+		if err := f(canvas, changed, frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePNGChunk writes a chunk with its length and CRC
+func writePNGChunk(buf *bytes.Buffer, chunkType string, data []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(chunkType))
+	crc.Write(data)
+	buf.WriteString(chunkType)
+	buf.Write(data)
+	binary.Write(buf, binary.BigEndian, crc.Sum32())
+}
+
+// changedRect is the part of frame which differs from previous, or an empty
+// rectangle if they are the same
+func changedRect(previous, frame *image.RGBA) image.Rectangle {
+	bounds := frame.Bounds()
+	changed := image.Rectangle{}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row := frame.Pix[y*frame.Stride : y*frame.Stride+bounds.Dx()*4]
+		previousRow := previous.Pix[y*previous.Stride : y*previous.Stride+bounds.Dx()*4]
+		if bytes.Equal(row, previousRow) {
+			continue
+		}
+		minX, maxX := bounds.Dx(), 0
+		for x := 0; x < bounds.Dx(); x++ {
+			if !bytes.Equal(row[x*4:x*4+4], previousRow[x*4:x*4+4]) {
+				minX = min(minX, x)
+				maxX = max(maxX, x+1)
+			}
+		}
+		changed = changed.Union(image.Rect(minX, y, maxX, y+1))
+	}
+	return changed
+}
+
+// pngRows filters the rect of img into PNG scanlines, as RGBA or as RGB when
+// alpha is false. Each row gets whichever filter leaves the smallest sum of
+// absolute values, the heuristic the PNG specification suggests.
+func pngRows(img *image.RGBA, rect image.Rectangle, alpha bool) []byte {
+	channels := 3
+	if alpha {
+		channels = 4
+	}
+	rowLength := rect.Dx() * channels
+	previous := make([]byte, rowLength)
+	current := make([]byte, rowLength)
+	filtered := make([][]byte, 5)
+	for f := range filtered {
+		filtered[f] = make([]byte, rowLength+1)
+		filtered[f][0] = byte(f)
+	}
+	out := make([]byte, 0, (rowLength+1)*rect.Dy())
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		// color.RGBA is alpha-premultiplied but PNG is not
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			p := img.Pix[img.PixOffset(x, y):]
+			i := (x - rect.Min.X) * channels
+			a := uint32(p[3])
+			if a == 255 || a == 0 {
+				copy(current[i:i+3], p[:3])
+			} else {
+				current[i] = uint8(uint32(p[0]) * 255 / a)
+				current[i+1] = uint8(uint32(p[1]) * 255 / a)
+				current[i+2] = uint8(uint32(p[2]) * 255 / a)
+			}
+			if alpha {
+				current[i+3] = p[3]
+			}
+		}
+		best, bestSum := 0, -1
+		for f := range filtered {
+			sum := 0
+			for i := 0; i < rowLength; i++ {
+				var left, up, upLeft byte
+				if i >= channels {
+					left, upLeft = current[i-channels], previous[i-channels]
+				}
+				up = previous[i]
+				var predicted byte
+				switch f {
+				case 1:
+					predicted = left
+				case 2:
+					predicted = up
+				case 3:
+					predicted = byte((int(left) + int(up)) / 2)
+				case 4:
+					predicted = paeth(left, up, upLeft)
+				}
+				v := current[i] - predicted
+				filtered[f][i+1] = v
+				if d := int(int8(v)); d < 0 {
+					sum -= d
+				} else {
+					sum += d
+				}
+			}
+			if bestSum < 0 || sum < bestSum {
+				best, bestSum = f, sum
+			}
+		}
+		out = append(out, filtered[best]...)
+		previous, current = current, previous
+	}
+	return out
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := p-int(a), p-int(b), p-int(c)
+	if pa < 0 {
+		pa = -pa
+	}
+	if pb < 0 {
+		pb = -pb
+	}
+	if pc < 0 {
+		pc = -pc
+	}
+	if pa <= pb && pa <= pc {
+		return a
+	} else if pb <= pc {
+		return b
+	}
+	return c
+}
+
+// encodeAPNG encodes the animation as an animated PNG which plays loopCount
+// times, or forever if loopCount is 0. After the first frame only the part
+// which changed is stored, replacing that part of what is already shown.
+func encodeAPNG(animation *Animation, loopCount int) ([]byte, error) {
+	if len(animation.frames) == 0 {
+		return nil, fmt.Errorf("an APNG needs at least one frame")
+	}
+	bounds := animation.frames[0].patch.Bounds()
+
+	var buf bytes.Buffer
+	buf.WriteString("\x89PNG\r\n\x1a\n")
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint32(header[0:], uint32(bounds.Dx()))
+	binary.BigEndian.PutUint32(header[4:], uint32(bounds.Dy()))
+	header[8] = 8 // bits per channel
+	header[9] = 2 // RGB
+	if animation.alpha {
+		header[9] = 6 // RGBA
+	}
+	writePNGChunk(&buf, "IHDR", header)
+	animationControl := make([]byte, 8)
+	binary.BigEndian.PutUint32(animationControl[0:], uint32(len(animation.frames)))
+	binary.BigEndian.PutUint32(animationControl[4:], uint32(loopCount))
+	writePNGChunk(&buf, "acTL", animationControl)
+
+	sequence := uint32(0)
+	err := animation.replay(func(canvas *image.RGBA, changed image.Rectangle, frame animationFrame) error {
+		rect := changed
+		if rect.Empty() {
+			// nothing changed, so a single pixel stands in for the frame
+			rect = image.Rect(0, 0, 1, 1)
+		}
+		frameControl := make([]byte, 26)
+		binary.BigEndian.PutUint32(frameControl[0:], sequence)
+		binary.BigEndian.PutUint32(frameControl[4:], uint32(rect.Dx()))
+		binary.BigEndian.PutUint32(frameControl[8:], uint32(rect.Dy()))
+		binary.BigEndian.PutUint32(frameControl[12:], uint32(rect.Min.X))
+		binary.BigEndian.PutUint32(frameControl[16:], uint32(rect.Min.Y))
+		binary.BigEndian.PutUint16(frameControl[20:], uint16(min(max(frame.delay, 0), 65535)))
+		binary.BigEndian.PutUint16(frameControl[22:], 100)
+		// dispose_op none keeps the frame for the next one to be drawn on, and
+		// blend_op source replaces the region outright
+		frameControl[24] = 0
+		frameControl[25] = 0
+		first := sequence == 0
+		writePNGChunk(&buf, "fcTL", frameControl)
+		sequence++
+
+		var compressed bytes.Buffer
+		writer := zlib.NewWriter(&compressed)
+		writer.Write(pngRows(canvas, rect, animation.alpha))
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		if first {
+			// the first frame is also the still image shown by viewers
+			// without APNG support
+			writePNGChunk(&buf, "IDAT", compressed.Bytes())
+			return nil
+		}
+		frameData := make([]byte, 4, 4+compressed.Len())
+		binary.BigEndian.PutUint32(frameData, sequence)
+		writePNGChunk(&buf, "fdAT", append(frameData, compressed.Bytes()...))
+		sequence++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	writePNGChunk(&buf, "IEND", nil)
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+// replayFrames makes stand-ins for a stroke replay: a blank canvas with a
+// line drawn a little further across it in each frame
+func replayFrames(count int) []*image.RGBA {
+	frames := []*image.RGBA{}
+	for i := 0; i < count; i++ {
+		frame := image.NewRGBA(image.Rect(0, 0, 200, 100))
+		draw.Draw(frame, frame.Bounds(), &image.Uniform{drawingBackground}, image.Point{}, draw.Src)
+		draw.Draw(frame, image.Rect(10, 40, 10+i*10, 50), &image.Uniform{color.RGBA{200, 30, 30, 255}}, image.Point{}, draw.Src)
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func TestAnimationKeepsChanges(t *testing.T) {
+	frames := replayFrames(10)
+	animation := &Animation{}
+	for _, frame := range frames {
+		if err := animation.Add(frame, strokeReplayFrameDelay); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, frame := range animation.frames[1:] {
+		if want := image.Rect(10+i*10, 40, 20+i*10, 50); frame.patch.Bounds() != want {
+			t.Errorf("frame %d kept %v, want only the %v which changed", i+1, frame.patch.Bounds(), want)
+		}
+	}
+
+	i := 0
+	animation.replay(func(canvas *image.RGBA, changed image.Rectangle, frame animationFrame) error {
+		if !bytes.Equal(canvas.Pix, frames[i].Pix) {
+			t.Errorf("frame %d replayed differently from how it was added", i)
+		}
+		i++
+		return nil
+	})
+	if i != len(frames) {
+		t.Errorf("replayed %d frames, want %d", i, len(frames))
+	}
+
+	if err := animation.Add(image.NewRGBA(image.Rect(0, 0, 10, 10)), 100); err == nil {
+		t.Errorf("a frame of another size was added")
+	}
+}
+
+func TestEncodeGifOnlyStoresChanges(t *testing.T) {
+	frames := replayFrames(10)
+	for _, options := range []PaletteOptions{
+		{method: "mediancut", scope: "frame"},
+		{method: "mediancut", scope: "gif"},
+	} {
+		animation := &Animation{}
+		for _, frame := range frames {
+			animation.Add(frame, strokeReplayFrameDelay)
+		}
+		data, err := encodeGif(animation, 0, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(decoded.Image) != len(frames) {
+			t.Fatalf("with scope %s, the GIF has %d frames, want %d", options.scope, len(decoded.Image), len(frames))
+		}
+
+		// each frame is drawn over the last, which must add up to the frames
+		// as they were, having so few colors
+		canvas := image.NewRGBA(frames[0].Bounds())
+		for i, frame := range decoded.Image {
+			if i > 0 && frame.Bounds().Dx()*frame.Bounds().Dy() > 100 {
+				t.Errorf("with scope %s, frame %d covers %v rather than what changed", options.scope, i, frame.Bounds())
+			}
+			draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Src)
+			if !bytes.Equal(canvas.Pix, frames[i].Pix) {
+				t.Errorf("with scope %s, frame %d shows differently from the frame it was made from", options.scope, i)
+			}
+		}
+	}
+}
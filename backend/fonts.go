@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/freetype"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+var (
+	// Roboto and the Go fonts ship in fontsDir, covering Latin, Greek and
+	// Cyrillic. Text in other scripts, or emoji, shows up as missing glyphs
+	// unless fonts covering it, such as Noto's, are added there and named in
+	// -font-fallbacks.
+	fontsDir = "fonts"
+	// the font text is set in unless a game picks another
+	defaultFontName = "Roboto-Regular"
+	// the fonts in fontsDir, keyed by file name without the extension. They
+	// are loaded once at startup and only read from after that, so render
+	// workers share them freely.
+	loadedFonts = make(map[string]*LoadedFont)
+	// the fonts tried in order for characters a game's font has no glyph for
+	fallbackFonts []*LoadedFont
+)
+
+// LoadedFont is a parsed font along with its file, which documents embed.
+// freetype draws the glyphs, but only reads the old kern table, so kerning
+// comes from sfnt, which reads the GPOS table most fonts keep it in now.
+type LoadedFont struct {
+	name    string
+	data    []byte
+	font    *truetype.Font
+	kerning *sfnt.Font
+}
+
+// kern is the adjustment between two glyphs at scale, or 0 for pairs the
+// font doesn't kern
+func (f *LoadedFont) kern(scale fixed.Int26_6, i0, i1 truetype.Index) fixed.Int26_6 {
+	if f.kerning == nil {
+		return 0
+	}
+	kern, err := f.kerning.Kern(nil, sfnt.GlyphIndex(i0), sfnt.GlyphIndex(i1), scale, font.HintingNone)
+	if err != nil {
+		return 0
+	}
+	return kern
+}
+
+// monospaced reports whether the font says all its glyphs are the same width
+func (f *LoadedFont) monospaced() bool {
+	return f.kerning != nil && f.kerning.PostTable() != nil && f.kerning.PostTable().IsFixedPitch
+}
+
+// loadFonts parses every TrueType font in dir. fallbacks names the fonts to
+// try, in order, for characters a game's font lacks, and when it is empty
+// every font is tried in order of name, monospaced fonts last. The default
+// font has to load, as nothing can be drawn without it.
+func loadFonts(dir string, fallbacks []string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("error reading fonts directory: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.ToLower(filepath.Ext(entry.Name())) != ".ttf" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			fmt.Println("Error reading font:", err)
+			continue
+		}
+		f, err := freetype.ParseFont(data)
+		if err != nil {
+			fmt.Println("Error parsing font "+entry.Name()+":", err)
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+		kerning, err := sfnt.Parse(data)
+		if err != nil {
+			fmt.Println("Error reading the kerning of font "+entry.Name()+":", err)
+			kerning = nil
+		}
+		loadedFonts[name] = &LoadedFont{name: name, data: data, font: f, kerning: kerning}
+	}
+	if _, ok := loadedFonts[defaultFontName]; !ok {
+		return fmt.Errorf("the default font %s is missing from %s", defaultFontName, dir)
+	}
+
+	if len(fallbacks) == 0 {
+		// a caption falling back to a monospaced font stands out more than
+		// one falling back to a proportional font
+		fallbacks = fontNames()
+		sort.SliceStable(fallbacks, func(i, j int) bool {
+			return !loadedFonts[fallbacks[i]].monospaced() && loadedFonts[fallbacks[j]].monospaced()
+		})
+	}
+	for _, name := range fallbacks {
+		f, ok := loadedFonts[name]
+		if !ok {
+			return fmt.Errorf("unknown fallback font %s", name)
+		}
+		fallbackFonts = append(fallbackFonts, f)
+	}
+	fmt.Println("Loaded", len(loadedFonts), "fonts")
+	return nil
+}
+
+func fontNames() []string {
+	names := []string{}
+	for name := range loadedFonts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// FontChain is the font a game's text is set in followed by the fallback
+// fonts. Each character is drawn in the first font of the chain which has a
+// glyph for it.
+type FontChain []*LoadedFont
+
+// fontChain builds the chain for a game's font. Fonts this server doesn't
+// have, such as those of games imported from elsewhere, give way to the
+// default font.
+func fontChain(name string) FontChain {
+	primary, ok := loadedFonts[name]
+	if !ok {
+		primary = loadedFonts[defaultFontName]
+	}
+	chain := FontChain{primary}
+	for _, f := range fallbackFonts {
+		if f != primary {
+			chain = append(chain, f)
+		}
+	}
+	return chain
+}
+
+// fontFor is the index of the first font in the chain with a glyph for r.
+// Characters no font has are left to the first, which draws its missing
+// glyph box for them.
+func (c FontChain) fontFor(r rune) int {
+	for i, f := range c {
+		if f.font.Index(r) != 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+// has reports whether any font of the chain has a glyph for r
+func (c FontChain) has(r rune) bool {
+	return c[c.fontFor(r)].font.Index(r) != 0
+}
+
+// TextRun is a stretch of text drawn in one font of a chain
+type TextRun struct {
+	font int
+	text string
+}
+
+// runs splits text into the stretches drawn in each font
+func (c FontChain) runs(text string) []TextRun {
+	runs := []TextRun{}
+	start, current := 0, -1
+	for i, r := range text {
+		f := c.fontFor(r)
+		if f != current && i > start {
+			runs = append(runs, TextRun{font: current, text: text[start:i]})
+			start = i
+		}
+		current = f
+	}
+	if start < len(text) {
+		runs = append(runs, TextRun{font: current, text: text[start:]})
+	}
+	return runs
+}
+
+// fontScale is the scale freetype draws text at size with, at the 72 DPI
+// everything is drawn at
+func fontScale(size float64) fixed.Int26_6 {
+	return fixed.Int26_6(size * 72 * (64.0 / 72.0))
+}
+
+// PlacedGlyph is a character of a line, the font of the chain it is drawn in
+// and how far along the line it starts
+type PlacedGlyph struct {
+	font int
+	char rune
+	x    fixed.Int26_6
+}
+
+// LineMeasure measures a line as characters are added to the end of it, so
+// wrapping text measures each character once rather than once for every line
+// it is tried on
+type LineMeasure struct {
+	fonts FontChain
+	scale fixed.Int26_6
+	width fixed.Int26_6
+	// the font and glyph of the last character, which the next one is kerned
+	// against when it is in the same font, or -1 for an empty line
+	font  int
+	glyph truetype.Index
+}
+
+func newLineMeasure(fonts FontChain, size float64) *LineMeasure {
+	return &LineMeasure{fonts: fonts, scale: fontScale(size), font: -1}
+}
+
+// add puts r on the end of the line, giving the font it is drawn in and how
+// far along the line it starts
+func (m *LineMeasure) add(r rune) (int, fixed.Int26_6) {
+	font := m.fonts.fontFor(r)
+	f := m.fonts[font]
+	index := f.font.Index(r)
+	if font == m.font {
+		m.width += f.kern(m.scale, m.glyph, index)
+	}
+	x := m.width
+	m.width += f.font.HMetric(m.scale, index).AdvanceWidth
+	m.font, m.glyph = font, index
+	return font, x
+}
+
+func (m *LineMeasure) addString(text string) {
+	for _, r := range text {
+		m.add(r)
+	}
+}
+
+// widthWith is how wide the line would be with text on the end, in whole
+// pixels, leaving the line as it is
+func (m LineMeasure) widthWith(text string) int {
+	m.addString(text)
+	return m.width.Ceil()
+}
+
+func (m *LineMeasure) empty() bool {
+	return m.font == -1
+}
+
+// place works out where each character of text goes when set at size, and
+// how wide the whole line is, in pixels. Characters next to each other in
+// the same font are kerned.
+func (c FontChain) place(text string, size float64) ([]PlacedGlyph, fixed.Int26_6) {
+	measure := newLineMeasure(c, size)
+	glyphs := []PlacedGlyph{}
+	for _, r := range text {
+		font, x := measure.add(r)
+		glyphs = append(glyphs, PlacedGlyph{font: font, char: r, x: x})
+	}
+	return glyphs, measure.width
+}
+
+// width measures text set at size, in pixels
+func (c FontChain) width(text string, size float64) fixed.Int26_6 {
+	_, width := c.place(text, size)
+	return width
+}
+
+func fontChainToJSON(chain FontChain) string {
+	names := []string{}
+	for _, f := range chain {
+		names = append(names, f.name)
+	}
+	return jsonStringList(names)
+}
+
+// An endpoint listing the fonts a game can be created with, and the fallback
+// fonts used for characters a game's font lacks
+func listFonts(w http.ResponseWriter, r *http.Request) {
+	allowCors(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if r.Method == "GET" {
+		responseStr := "{\"status\":\"OK\", \"fonts\": " + jsonStringList(fontNames()) + ", \"defaultFont\": " + jsonString(defaultFontName) + ", \"fallbackFonts\": " + fontChainToJSON(fallbackFonts) + "}"
+		fmt.Fprint(w, responseStr)
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
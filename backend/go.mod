@@ -4,4 +4,8 @@ go 1.23.2
 
 require golang.org/x/image v0.21.0
 
-require github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
+require github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0
+
+require gopkg.in/yaml.v3 v3.0.1
+
+require golang.org/x/text v0.19.0
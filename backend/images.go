@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	imageFitModes   = []string{"fit", "fill", "letterbox"}
+	imageResamplers = map[string]draw.Interpolator{
+		"catmullrom": draw.CatmullRom,
+		"bilinear":   draw.ApproxBiLinear,
+	}
+	// how uploaded drawings are stored, set from the command line in main()
+	uploadPipeline = &ImagePipeline{
+		mode:         "letterbox",
+		width:        drawingSize,
+		height:       drawingSize,
+		resampler:    draw.CatmullRom,
+		background:   drawingBackground,
+		minDimension: 256,
+		maxDimension: drawingSize,
+	}
+	// the formats uploadDrawing accepts, keyed by the content type
+	// http.DetectContentType sniffs for them. Stroke JSON sniffs as plain text.
+	uploadContentTypes = map[string]string{
+		"image/jpeg": "jpeg",
+		"image/png":  "png",
+		"image/gif":  "gif",
+		"image/webp": "webp",
+		"image/bmp":  "bmp",
+	}
+	uploadFormatNames    = "JPEG, PNG, GIF, WebP, BMP and stroke JSON"
+	errUnsupportedUpload = errors.New("unsupported file type")
+)
+
+// ImagePipeline scales images to the size the game works with.
+//
+//   - "fit" keeps the image's own aspect ratio, scaling it so that its longest
+//     side is at most maxDimension and its shortest side at least minDimension.
+//     If an image is too long and thin for both, maxDimension wins.
+//   - "fill" scales the image to cover width by height and crops the overflow
+//     evenly from both sides.
+//   - "letterbox" scales the image to fit inside width by height and pads the
+//     rest with the background color.
+type ImagePipeline struct {
+	mode         string
+	width        int
+	height       int
+	resampler    draw.Interpolator
+	background   color.RGBA
+	minDimension int
+	maxDimension int
+}
+
+func isImageFitMode(mode string) bool {
+	for _, m := range imageFitModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+func imageResamplerNames() []string {
+	names := []string{}
+	for name := range imageResamplers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// framePipeline letterboxes anything going into a reveal GIF onto the same
+// square frame, so uploads kept at their own aspect ratio still line up with
+// caption frames and stroke replays
+func framePipeline() *ImagePipeline {
+	return &ImagePipeline{
+		mode:       "letterbox",
+		width:      drawingSize,
+		height:     drawingSize,
+		resampler:  uploadPipeline.resampler,
+		background: uploadPipeline.background,
+	}
+}
+
+// scaledSize returns the size the image is scaled to before any padding or
+// cropping
+func (p *ImagePipeline) scaledSize(srcWidth, srcHeight int) (int, int) {
+	w, h := float64(srcWidth), float64(srcHeight)
+	var scale float64
+	switch p.mode {
+	case "fit":
+		scale = 1
+		if p.minDimension > 0 && math.Min(w, h) < float64(p.minDimension) {
+			scale = float64(p.minDimension) / math.Min(w, h)
+		}
+		if p.maxDimension > 0 && math.Max(w, h)*scale > float64(p.maxDimension) {
+			scale = float64(p.maxDimension) / math.Max(w, h)
+		}
+	case "fill":
+		scale = math.Max(float64(p.width)/w, float64(p.height)/h)
+	default:
+		scale = math.Min(float64(p.width)/w, float64(p.height)/h)
+	}
+	return max(1, int(math.Round(w*scale))), max(1, int(math.Round(h*scale)))
+}
+
+// process scales img according to the pipeline and returns a new image on an
+// opaque background
+func (p *ImagePipeline) process(img image.Image) image.Image {
+	src := img.Bounds()
+	if src.Empty() {
+		return image.NewRGBA(image.Rect(0, 0, 1, 1))
+	}
+	scaledWidth, scaledHeight := p.scaledSize(src.Dx(), src.Dy())
+
+	outWidth, outHeight := p.width, p.height
+	if p.mode == "fit" {
+		outWidth, outHeight = scaledWidth, scaledHeight
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, outWidth, outHeight))
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{p.background}, image.Point{}, draw.Src)
+
+	// centre the scaled image. With "fill" this is a negative offset, and
+	// whatever hangs over the edges is clipped away.
+	x := (outWidth - scaledWidth) / 2
+	y := (outHeight - scaledHeight) / 2
+	target := image.Rect(x, y, x+scaledWidth, y+scaledHeight)
+	if target.Dx() == src.Dx() && target.Dy() == src.Dy() {
+		draw.Draw(dst, target, img, src.Min, draw.Over)
+	} else {
+		p.resampler.Scale(dst, target, img, src, draw.Over, nil)
+	}
+	return dst
+}
+
+// configureUploadPipeline sets up uploadPipeline from the command line flags
+func configureUploadPipeline(mode, resampler, background string, minDimension, maxDimension int) error {
+	if !isImageFitMode(mode) {
+		return fmt.Errorf("image fit must be one of %s", strings.Join(imageFitModes, ", "))
+	}
+	interpolator, ok := imageResamplers[resampler]
+	if !ok {
+		return fmt.Errorf("image resampler must be one of %s", strings.Join(imageResamplerNames(), ", "))
+	}
+	backgroundColor, err := parseHexColor(background)
+	if err != nil {
+		return err
+	}
+	if minDimension < 1 || maxDimension < minDimension {
+		return fmt.Errorf("image dimensions must satisfy 1 <= min <= max")
+	}
+	uploadPipeline.mode = mode
+	uploadPipeline.resampler = interpolator
+	uploadPipeline.background = backgroundColor
+	uploadPipeline.minDimension = minDimension
+	uploadPipeline.maxDimension = maxDimension
+	return nil
+}
+
+// checkUploadSize checks an image's header against the upload limits
+func checkUploadSize(config image.Config) error {
+	if config.Width > maxUploadDimension || config.Height > maxUploadDimension || config.Width*config.Height > maxUploadPixels {
+		return fmt.Errorf("Image is too large, the limit is %d pixels on a side and %d pixels in total", maxUploadDimension, maxUploadPixels)
+	}
+	return nil
+}
+
+// decodeUpload decodes an uploaded drawing, going by what the file contains
+// rather than its name or the content type the client sent. The image's
+// header is checked against the upload limits before the pixels are decoded,
+// and JPEGs are turned upright according to their EXIF orientation. Animated
+// GIFs give their first frame. Stroke JSON, the same object submitDrawing
+// takes as strokes, is rasterized and its strokes are returned alongside.
+func decodeUpload(data []byte) (image.Image, *StrokeDrawing, error) {
+	contentType := http.DetectContentType(data)
+	if format, ok := uploadContentTypes[contentType]; ok {
+		config, decodedFormat, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error decoding %s image", format)
+		}
+		if decodedFormat != format {
+			return nil, nil, errUnsupportedUpload
+		}
+		if err := checkUploadSize(config); err != nil {
+			return nil, nil, err
+		}
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error decoding %s image", format)
+		}
+		if format == "jpeg" {
+			img = applyOrientation(img, jpegOrientation(data))
+		}
+		return img, nil, nil
+	}
+
+	if strings.HasPrefix(contentType, "text/plain") && bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		drawing := &StrokeDrawing{}
+		if err := json.Unmarshal(data, drawing); err != nil {
+			return nil, nil, fmt.Errorf("Error decoding stroke JSON: %v", err)
+		}
+		if err := validateStrokeDrawing(drawing); err != nil {
+			return nil, nil, fmt.Errorf("Invalid strokes: %v", err)
+		}
+		return rasterizeStrokes(drawing), drawing, nil
+	}
+	return nil, nil, errUnsupportedUpload
+}
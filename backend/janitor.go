@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// every handler which touches game state holds stateLock, so the janitor
+	// can run alongside requests
+	stateLock sync.Mutex
+	// uploads which never made it into a chain are kept this long in case
+	// they are still on their way in
+	uploadGracePeriod = time.Hour
+	// ended games are kept this long unless starred, or forever when 0
+	endedGameRetention = 30 * 24 * time.Hour
+	janitorInterval    = 10 * time.Minute
+)
+
+// withStateLock wraps a handler so it holds stateLock while it runs
+func withStateLock(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stateLock.Lock()
+		defer stateLock.Unlock()
+		handler(w, r)
+	}
+}
+
+// JanitorReport lists what a sweep removes, or would remove on a dry run
+type JanitorReport struct {
+	endedGames []string
+	uploads    []string
+	blobs      []string
+}
+
+// referencedImages collects the image IDs which are still in use: everything
+// in a chain of a running or ended game, and any team's pending drafts
+func referencedImages() map[string]bool {
+	referenced := make(map[string]bool)
+	for _, game := range games {
+		for _, chain := range game.drawings {
+			for _, imageId := range chain {
+				referenced[imageId] = true
+			}
+		}
+		for _, team := range game.teams {
+			for _, draft := range team.drafts {
+				referenced[draft] = true
+			}
+		}
+	}
+	for _, endedGame := range endedGames {
+		for _, chain := range endedGame.drawings {
+			for _, imageId := range chain {
+				referenced[imageId] = true
+			}
+		}
+	}
+	return referenced
+}
+
+// uploadStillOpen reports whether the round an image was uploaded for is
+// still taking drawings, so the upload may yet be submitted
+func uploadStillOpen(registered *RegisteredImage) bool {
+	for _, game := range games {
+		if game.gameId == registered.gameId {
+			return !game.votingOpen && game.currentRound == registered.round
+		}
+	}
+	return false
+}
+
+// sweep finds expired ended games and orphaned uploads, and unless dryRun is
+// set deletes them along with any blobs left without references, which in a
+// shared store are left for good. Must be called holding stateLock.
+func sweep(now time.Time, dryRun bool) JanitorReport {
+	report := JanitorReport{endedGames: []string{}, uploads: []string{}, blobs: []string{}}
+	releases := []string{}
+
+	if endedGameRetention > 0 {
+		for gameId, endedGame := range endedGames {
+			if endedGame.starred || now.Sub(endedGame.endedAt) < endedGameRetention {
+				continue
+			}
+			report.endedGames = append(report.endedGames, gameId)
+			releases = append(releases, endedGameBlobs(endedGame)...)
+		}
+	}
+	expiredGames := make(map[string]bool)
+	for _, gameId := range report.endedGames {
+		expiredGames[gameId] = true
+	}
+
+	// an expired game's drawings go along with it, and so do uploads nobody
+	// submitted once their round is over and the grace period has passed
+	referenced := referencedImages()
+	for _, endedGame := range endedGames {
+		if !expiredGames[endedGame.gameId] {
+			continue
+		}
+		for _, chain := range endedGame.drawings {
+			for _, imageId := range chain {
+				delete(referenced, imageId)
+			}
+		}
+	}
+	for imageId, registered := range imageRegistry {
+		if expiredGames[registered.gameId] || (!referenced[imageId] && now.Sub(registered.createdAt) >= uploadGracePeriod && !uploadStillOpen(registered)) {
+			report.uploads = append(report.uploads, imageId)
+			releases = append(releases, registered.path)
+		}
+	}
+
+	// work out which blobs lose their last reference
+	remaining := make(map[string]int)
+	for _, key := range releases {
+		if _, ok := remaining[key]; !ok {
+			remaining[key] = blobRefs[key]
+		}
+		remaining[key]--
+	}
+	for key, refs := range remaining {
+		if refs <= 0 && !blobStoreShared {
+			report.blobs = append(report.blobs, key)
+		}
+	}
+	sort.Strings(report.endedGames)
+	sort.Strings(report.uploads)
+	sort.Strings(report.blobs)
+	if dryRun {
+		return report
+	}
+
+	for _, gameId := range report.endedGames {
+		delete(endedGames, gameId)
+	}
+	for _, imageId := range report.uploads {
+		delete(imageRegistry, imageId)
+	}
+	for _, key := range releases {
+		releaseBlob(key)
+	}
+	return report
+}
+
+// runJanitor sweeps every janitorInterval for as long as the server runs
+func runJanitor() {
+	for range time.Tick(janitorInterval) {
+		stateLock.Lock()
+		report := sweep(time.Now(), false)
+		stateLock.Unlock()
+		if len(report.endedGames)+len(report.uploads)+len(report.blobs) > 0 {
+			fmt.Println("Janitor removed", len(report.endedGames), "ended games,", len(report.uploads), "uploads and", len(report.blobs), "files")
+		}
+	}
+}
+
+func janitorReportToJSON(report JanitorReport, dryRun bool) string {
+	reportJson := "{\"status\": \"OK\", \"dryRun\": " + fmt.Sprint(dryRun) + ","
+	reportJson += "\"endedGames\": " + jsonStringList(report.endedGames) + ","
+	reportJson += "\"uploads\": " + jsonStringList(report.uploads) + ","
+	reportJson += "\"files\": " + jsonStringList(report.blobs) + "}"
+	return reportJson
+}
+
+// An admin endpoint which reports what the janitor would remove right now.
+// With dryRun set to "false" it removes it straight away.
+func runJanitorNow(w http.ResponseWriter, r *http.Request) {
+	allowCors(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if r.Method == "POST" {
+		bodyObj := parseBodyObject(r)
+		if adminSecret == "" || bodyObj["adminSecret"] != adminSecret {
+			http.Error(w, "Admin not authenticated", http.StatusUnauthorized)
+			return
+		}
+		dryRun := bodyObj["dryRun"] != "false"
+		report := sweep(time.Now(), dryRun)
+		fmt.Fprint(w, janitorReportToJSON(report, dryRun))
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// An admin endpoint to star an ended game, keeping it past the retention
+// period, or to unstar it
+func starEndedGame(w http.ResponseWriter, r *http.Request) {
+	allowCors(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if r.Method == "POST" {
+		bodyObj := parseBodyObject(r)
+		if adminSecret == "" || bodyObj["adminSecret"] != adminSecret {
+			http.Error(w, "Admin not authenticated", http.StatusUnauthorized)
+			return
+		}
+		endedGame, ok := endedGames[bodyObj["gameId"]]
+		if !ok {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Game not found\"}"
+			fmt.Fprint(w, responseStr)
+			return
+		}
+		endedGame.starred = bodyObj["starred"] != "false"
+		responseStr := "{\"status\": \"OK\", \"message\": \"Game updated\", \"starred\": " + fmt.Sprint(endedGame.starred) + "}"
+		fmt.Fprint(w, responseStr)
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	// characters lines don't start with, such as closing punctuation and the
+	// small kana, even where the text around them has no spaces to break at
+	noBreakBefore = ",.:;!?)]}%…‥、。，．：；！？）］｝％」』】〕〉》〙〗〟’”・ー々〻ゝゞヽヾぁぃぅぇぉっゃゅょゎゕゖァィゥェォッャュョヮヵヶ"
+	// characters lines don't end with, such as opening punctuation
+	noBreakAfter = "([{（［｛「『【〔〈《〘〖〝‘“"
+	// what text cut short ends with
+	ellipsis = "…"
+)
+
+// TextSegment is a piece of text which lines can break before and after but
+// not within
+type TextSegment struct {
+	text string
+	// whether a space separated the segment from the next one
+	spaceAfter bool
+}
+
+// isCJK reports whether r is from a script written without spaces between
+// words, which lines can break between any two characters of
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul, unicode.Bopomofo) ||
+		(r >= 0x3000 && r <= 0x303F) || (r >= 0xFF00 && r <= 0xFFEF)
+}
+
+// canBreakBetween reports whether a line can break between two characters
+// with no space between them, which it can next to Chinese, Japanese and
+// Korean text unless punctuation holds the characters together
+func canBreakBetween(before, after rune) bool {
+	if !isCJK(before) && !isCJK(after) {
+		return false
+	}
+	return !strings.ContainsRune(noBreakBefore, after) && !strings.ContainsRune(noBreakAfter, before) && !isMark(after)
+}
+
+// breakSegments splits text into the pieces lines can break between: words
+// separated by spaces, and the characters of text written without them.
+// Spaces are collapsed, as lines are joined back up with single spaces.
+func breakSegments(text string) []TextSegment {
+	segments := []TextSegment{}
+	var segment strings.Builder
+	var prev rune
+	flush := func(spaceAfter bool) {
+		if segment.Len() > 0 {
+			segments = append(segments, TextSegment{text: segment.String(), spaceAfter: spaceAfter})
+			segment.Reset()
+		}
+	}
+	for _, r := range text {
+		if unicode.IsSpace(r) {
+			flush(true)
+		} else {
+			if segment.Len() > 0 && canBreakBetween(prev, r) {
+				flush(false)
+			}
+			segment.WriteRune(r)
+		}
+		prev = r
+	}
+	flush(false)
+	return segments
+}
+
+// clusterEnd is where the character starting at i ends in text, along with
+// any marks on it
+func clusterEnd(text string, i int) int {
+	_, n := utf8.DecodeRuneInString(text[i:])
+	for i += n; i < len(text); i += n {
+		var r rune
+		r, n = utf8.DecodeRuneInString(text[i:])
+		if !isMark(r) {
+			break
+		}
+	}
+	return i
+}
+
+// splitToFit breaks the longest start off text which fits in maxWidth on the
+// end of line, for text too wide to fit with nowhere better to break, and
+// adds it to line. At least one character is broken off when line is empty,
+// and marks stay with the characters they are on.
+func splitToFit(text string, line *LineMeasure, maxWidth int) (string, string) {
+	cut := 0
+	for cut < len(text) {
+		end := clusterEnd(text, cut)
+		if !line.empty() && line.widthWith(text[cut:end]) > maxWidth {
+			break
+		}
+		line.addString(text[cut:end])
+		cut = end
+	}
+	return text[:cut], text[cut:]
+}
+
+// ellipsize cuts lines down to the first keep of them, ending the last of
+// those with an ellipsis, shortened until it fits in maxWidth at size
+func ellipsize(lines []string, keep int, fonts FontChain, size float64, maxWidth int) []string {
+	if keep >= len(lines) {
+		return lines
+	}
+	lines = append([]string{}, lines[:keep]...)
+	last := lines[keep-1]
+	// the longest start of the line which fits with the ellipsis after it,
+	// dropping whole characters along with any marks on them, and spaces
+	// before the ellipsis
+	measure := newLineMeasure(fonts, size)
+	cut := 0
+	for i := 0; i < len(last); {
+		end := clusterEnd(last, i)
+		measure.addString(last[i:end])
+		if r, _ := utf8.DecodeRuneInString(last[i:]); !unicode.IsSpace(r) && measure.widthWith(ellipsis) <= maxWidth {
+			cut = end
+		}
+		i = end
+	}
+	lines[keep-1] = last[:cut] + ellipsis
+	return lines
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+var loadTestFonts sync.Once
+
+// testFonts is the default font's chain, loaded from the fonts shipped with
+// the server
+func testFonts(t *testing.T) FontChain {
+	loadTestFonts.Do(func() {
+		if err := loadFonts(fontsDir, nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return fontChain(defaultFontName)
+}
+
+func TestBreakSegments(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		// the segments, with a space after those which had one
+		want []string
+	}{
+		{name: "words", text: "a cat on a hat", want: []string{"a ", "cat ", "on ", "a ", "hat"}},
+		{name: "collapses spaces", text: "  a \t\n cat  ", want: []string{"a ", "cat "}},
+		{name: "empty", text: " ", want: []string{}},
+		{name: "between Japanese characters", text: "猫が帽子", want: []string{"猫", "が", "帽", "子"}},
+		{name: "between latin and Chinese", text: "hello世界", want: []string{"hello", "世", "界"}},
+		{name: "not before closing punctuation", text: "帽子。です", want: []string{"帽", "子。", "で", "す"}},
+		{name: "not before small kana", text: "ちょっと", want: []string{"ちょっ", "と"}},
+		{name: "not inside brackets", text: "「猫」だ", want: []string{"「猫」", "だ"}},
+		{name: "not before marks", text: "か\u3099き", want: []string{"か\u3099", "き"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := []string{}
+			for _, segment := range breakSegments(test.text) {
+				if segment.spaceAfter {
+					got = append(got, segment.text+" ")
+				} else {
+					got = append(got, segment.text)
+				}
+			}
+			if strings.Join(got, "|") != strings.Join(test.want, "|") || len(got) != len(test.want) {
+				t.Errorf("breakSegments(%q) = %q, want %q", test.text, got, test.want)
+			}
+		})
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	fonts := testFonts(t)
+	tests := []struct {
+		name     string
+		text     string
+		maxWidth int
+		// the lines joined up with spaces, or "" for the text with its
+		// spaces collapsed
+		joined string
+	}{
+		{name: "fits on one line", text: "a cat on a hat", maxWidth: 400},
+		{name: "breaks between words", text: "the quick brown fox jumps over the lazy dog", maxWidth: 120},
+		{name: "collapses spaces", text: "  lots   of\tspace  between  ", maxWidth: 80},
+		{name: "breaks long words", text: "supercalifragilisticexpialidocious", maxWidth: 100, joined: "supercalifragilisticexpialidocious"},
+		{name: "breaks between Japanese characters", text: "猫が帽子の上に座っている。", maxWidth: 60, joined: "猫が帽子の上に座っている。"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines := wrapText(test.text, fonts, 20, test.maxWidth)
+			for _, line := range lines {
+				if width := fonts.width(line, 20).Ceil(); width > test.maxWidth {
+					t.Errorf("line %q is %d pixels wide, more than %d", line, width, test.maxWidth)
+				}
+			}
+			want, got := test.joined, strings.Join(lines, "")
+			if want == "" {
+				want, got = strings.Join(strings.Fields(test.text), " "), strings.Join(lines, " ")
+			}
+			if got != want {
+				t.Errorf("wrapText(%q) = %q, which joins up to %q", test.text, lines, got)
+			}
+		})
+	}
+}
+
+func TestWrapTextKeepsPunctuationWithCharacters(t *testing.T) {
+	fonts := testFonts(t)
+	// wide enough for the punctuation and a character either side of it
+	for maxWidth := 60; maxWidth <= 200; maxWidth += 10 {
+		lines := wrapText("「猫」が帽子の上に、座っている。", fonts, 20, maxWidth)
+		for i, line := range lines {
+			first, last := []rune(line)[0], []rune(line)[len([]rune(line))-1]
+			if i > 0 && strings.ContainsRune(noBreakBefore, first) {
+				t.Errorf("at %d pixels, line %q starts with %q", maxWidth, line, first)
+			}
+			if i < len(lines)-1 && strings.ContainsRune(noBreakAfter, last) {
+				t.Errorf("at %d pixels, line %q ends with %q", maxWidth, line, last)
+			}
+		}
+	}
+}
+
+func TestSplitToFitKeepsMarks(t *testing.T) {
+	fonts := testFonts(t)
+	// e followed by a combining acute accent, which mustn't be split off it
+	text := strings.Repeat("e\u0301", 20)
+	for maxWidth := 1; maxWidth <= 100; maxWidth++ {
+		head, rest := splitToFit(text, newLineMeasure(fonts, 20), maxWidth)
+		if head == "" {
+			t.Fatalf("at %d pixels, nothing was broken off", maxWidth)
+		}
+		if strings.HasPrefix(rest, "\u0301") {
+			t.Errorf("at %d pixels, %q was split from its mark", maxWidth, head)
+		}
+	}
+}
+
+func TestEllipsize(t *testing.T) {
+	fonts := testFonts(t)
+	lines := []string{"the quick brown", "fox jumps over", "the lazy dog"}
+	tests := []struct {
+		keep     int
+		maxWidth int
+		want     []string
+	}{
+		{keep: 3, maxWidth: 10, want: lines},
+		{keep: 2, maxWidth: 400, want: []string{"the quick brown", "fox jumps over…"}},
+		// the space before "over" is dropped along with it
+		{keep: 2, maxWidth: fonts.width("fox jumps o", 20).Ceil(), want: []string{"the quick brown", "fox jumps…"}},
+		{keep: 1, maxWidth: 1, want: []string{"…"}},
+	}
+	for _, test := range tests {
+		got := ellipsize(lines, test.keep, fonts, 20, test.maxWidth)
+		if strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("ellipsize(%q, %d) at %d pixels = %q, want %q", lines, test.keep, test.maxWidth, got, test.want)
+		}
+	}
+}
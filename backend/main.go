@@ -1,45 +1,46 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"image"
-	"image/color"
-	"image/color/palette"
-	"image/gif"
 	"image/png"
+	"io"
+	"math"
 	mrand "math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/golang/freetype"
-	"github.com/golang/freetype/truetype"
-	"golang.org/x/image/draw"
-	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
 )
 
 var games map[string]*Game = make(map[string]*Game)
 var endedGames map[string]*EndedGame = make(map[string]*EndedGame)
 var players map[string]*Player = make(map[string]*Player)
 var (
-	newPlayerMessage               = "{\"status\": \"OK\", \"message\":\"You have not yet joined a game\"}"
-	joinedGameMessage              = "{\"status\": \"OK\", \"message\":\"You have joined the game\"}"
-	gameStartedMessage             = "{\"status\": \"OK\", \"message\":\"Write an interesting prompt!\",\"startPrompt\":\"Write an interesting prompt!\"}"
-	drawPromptMessage              = "{\"status\": \"OK\", \"message\":\"Draw the prompt!\""
-	captionPromptMessage           = "{\"status\": \"OK\", \"message\":\"Write a caption for the drawing!\""
-	gameEndedMessage               = "{\"status\": \"OK\", \"message\":\"The game has ended, check the results!\""
-	nonSubmissionString_drawing    = "Uh oh. Looks like someone forgot to submit their drawing =/"
-	nonSubmissionString_caption    = "Uh oh. Looks like someone forgot to submit their caption =/"
-	fontName                       = "Roboto-Regular.ttf"
-	imagesDir                      = "images"
-	nonSubmissionImageName_drawing = "non_submission_drawing.png"
-	nonSubmissionImageName_caption = "non_submission_caption.png"
-	baseUrl                        = ""
+	newPlayerMessage            = "{\"status\": \"OK\", \"message\":\"You have not yet joined a game\"}"
+	joinedGameMessage           = "{\"status\": \"OK\", \"message\":\"You have joined the game\"}"
+	gameStartedMessage          = "{\"status\": \"OK\", \"message\":\"Write an interesting prompt!\",\"startPrompt\":\"Write an interesting prompt!\"}"
+	drawPromptMessage           = "{\"status\": \"OK\", \"message\":\"Draw the prompt!\""
+	captionPromptMessage        = "{\"status\": \"OK\", \"message\":\"Write a caption for the drawing!\""
+	gameEndedMessage            = "{\"status\": \"OK\", \"message\":\"The game has ended, check the results!\""
+	nonSubmissionString_drawing = "Uh oh. Looks like someone forgot to submit their drawing =/"
+	nonSubmissionString_caption = "Uh oh. Looks like someone forgot to submit their caption =/"
+	imagesDir                   = "images"
+	maxBodySize                 = 10 << 20
+	// the most characters a prompt or caption can have, as captions are laid
+	// out again at every font size tried until they fit
+	maxPromptLength = 280
 )
 
 type Player struct {
@@ -58,19 +59,82 @@ type Game struct {
 	creator      string
 	promptsSet   bool
 	gameStarted  bool
+	mode         GameMode
 	players      []*Player
 	spectators   []*Player
 	prompts      [][]string
 	drawings     [][]string
+	// the strokes of drawings submitted as vector strokes, keyed by drawing,
+	// and how many centiseconds the reveal GIF spends replaying each one
+	strokes        map[string]*StrokeDrawing
+	replayDuration int
+	// the format chains are exported in alongside GIFs, and how their reveal
+	// animations are timed
+	exportFormat string
+	pacing       RevealPacing
+	// whether captions get frames of their own or are overlaid on drawings,
+	// the font text is set in and how caption cards look
+	captionLayout string
+	font          string
+	captionTheme  string
+	// totalRounds as given to createGame, before startGame resolves -1
+	requestedRounds int
+	// the ended game this game is a rematch of, if any
+	previousGameId string
+	// starting prompts drawn from a prompt pack
+	promptPack      *PromptPack
+	startingPrompts string
+	usedPackPrompts map[string]bool
+	promptChoices   map[string][]string
+	// post-game voting, keyed by voter and then category
+	votingOpen bool
+	votes      map[string]map[string]*Vote
+	// the exports of each chain by format, queued when voting opens so the
+	// reveal is ready to vote on, and handed to the ended game
+	renders map[string][]*ChainRender
+	// the seats in the rotation, one per player unless teamSize > 1
+	teamSize       int
+	teamSubmission string
+	teams          []*Team
 }
 
 type EndedGame struct {
 	gameName        string
 	gameId          string
 	roundsCompleted int
+	gameMode        string
+	teams           []*Team
 	prompts         [][]string
 	drawings        [][]string
-	gifs            []string
+	strokes         map[string]*StrokeDrawing
+	renders         map[string][]*ChainRender // exports of each chain, keyed by format
+	scores          map[string]int
+	awards          []Award
+	// the settings the game was created with, kept for rematches
+	creator         string
+	players         []string
+	roundTimer      int
+	totalRounds     int
+	promptPack      string
+	startingPrompts string
+	teamSize        int
+	teamSubmission  string
+	replayDuration  int
+	exportFormat    string
+	// how the reveal animations are timed and laid out
+	pacing        RevealPacing
+	captionLayout string
+	font          string
+	captionTheme  string
+	// links to the games before and after this one in a series of rematches
+	previousGameId string
+	nextGameId     string
+	// when the game ended, and whether an admin starred it to keep it past
+	// the retention period
+	endedAt time.Time
+	starred bool
+	// the blob keys of storyboards and posters drawn so far, by exportKey
+	exports map[string]string
 }
 
 func getPlayerIndex(playerName string, game *Game) int {
@@ -83,13 +147,35 @@ func getPlayerIndex(playerName string, game *Game) int {
 }
 
 func parseBodyObject(r *http.Request) map[string]string {
-	body := make([]byte, r.ContentLength)
-	r.Body.Read(body)
+	return parseBodyBytes(readBody(r))
+}
+
+// readBody reads the whole request body, for endpoints which need more than
+// the string fields parseBodyObject returns
+func readBody(r *http.Request) []byte {
+	body, _ := io.ReadAll(io.LimitReader(r.Body, int64(maxBodySize)))
+	return body
+}
+
+// parseBodyBytes returns the string fields of a JSON body. Fields holding
+// anything other than a string are skipped.
+func parseBodyBytes(body []byte) map[string]string {
 	bodyObj := make(map[string]string)
 	json.Unmarshal(body, &bodyObj)
 	return bodyObj
 }
 
+// jsonString quotes and escapes s for use as a JSON string value
+func jsonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+func jsonStringList(list []string) string {
+	b, _ := json.Marshal(list)
+	return string(b)
+}
+
 func allowCors(w *http.ResponseWriter) {
 	(*w).Header().Set("Access-Control-Allow-Origin", "*")
 	(*w).Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
@@ -111,12 +197,50 @@ func getPlayerQueuedMessage(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, responseStr)
 			return
 		}
-		fmt.Fprintf(w, player.queuedMessage)
+		fmt.Fprint(w, strings.ReplaceAll(player.queuedMessage, baseUrlPlaceholder, getBaseURL(r)))
 	} else {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
+// newGame sets up a game which has not started yet. Optional settings such as
+// prompt packs and teams are left off and can be filled in by the caller.
+func newGame(gameName, creator string, roundTimer, totalRounds int, mode GameMode) *Game {
+	hash := make([]byte, 16)
+	rand.Read(hash)
+	gameId := hex.EncodeToString(hash)
+
+	return &Game{
+		gameName:        gameName,
+		gameId:          gameId,
+		roundTimer:      roundTimer,
+		totalRounds:     totalRounds,
+		requestedRounds: totalRounds,
+		creator:         creator,
+		currentRound:    0,
+		promptsSet:      false,
+		mode:            mode,
+		players:         []*Player{},
+		spectators:      []*Player{},
+		prompts:         [][]string{},
+		drawings:        [][]string{},
+		strokes:         make(map[string]*StrokeDrawing),
+		replayDuration:  defaultReplaySeconds * 100,
+		exportFormat:    defaultExportFormat,
+		pacing:          defaultRevealPacing(),
+		captionLayout:   defaultCaptionLayout,
+		font:            defaultFontName,
+		captionTheme:    defaultCaptionThemeName,
+
+		usedPackPrompts: make(map[string]bool),
+		promptChoices:   make(map[string][]string),
+		votes:           make(map[string]map[string]*Vote),
+		teamSize:        1,
+		teamSubmission:  "first",
+		teams:           []*Team{},
+	}
+}
+
 // An endpoint to create a new game
 func createGame(w http.ResponseWriter, r *http.Request) {
 	allowCors(&w)
@@ -125,10 +249,6 @@ func createGame(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		return
 	} else if r.Method == "POST" {
-		if baseUrl == "" {
-			baseUrl = getBaseURL(r)
-		}
-
 		// Create a new game
 		jsonObject := parseBodyObject(r)
 		playerName := jsonObject["playerName"]
@@ -168,24 +288,102 @@ func createGame(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, "{\"status\": \"ERROR\", \"message\": \"roundTimer must be an integer\"}")
 			return
 		}
-
-		hash := make([]byte, 16)
-		rand.Read(hash)
-		_gameId := hex.EncodeToString(hash)
-
-		game := &Game{
-			gameName:     _gameName,
-			gameId:       _gameId,
-			roundTimer:   _roundTimer,
-			totalRounds:  _totalRounds,
-			creator:      playerName,
-			currentRound: 0,
-			promptsSet:   false,
-			players:      []*Player{},
-			spectators:   []*Player{},
-			prompts:      [][]string{},
-			drawings:     [][]string{},
+		_gameMode, ok := getGameMode(jsonObject["gameMode"])
+		if !ok {
+			fmt.Fprintf(w, "{\"status\": \"ERROR\", \"message\": \"Unknown gameMode "+jsonObject["gameMode"]+"\"}")
+			return
+		}
+		var _promptPack *PromptPack
+		if jsonObject["promptPack"] != "" {
+			_promptPack, ok = promptPacks[jsonObject["promptPack"]]
+			if !ok {
+				fmt.Fprintf(w, "{\"status\": \"ERROR\", \"message\": \"Unknown promptPack "+jsonObject["promptPack"]+"\"}")
+				return
+			}
+		}
+		if jsonObject["teamSize"] == "" {
+			jsonObject["teamSize"] = "1"
+		}
+		_teamSize, err := strconv.Atoi(jsonObject["teamSize"])
+		if err != nil || _teamSize < 1 {
+			fmt.Fprintf(w, "{\"status\": \"ERROR\", \"message\": \"teamSize must be a positive integer\"}")
+			return
+		}
+		if jsonObject["teamSubmission"] == "" {
+			jsonObject["teamSubmission"] = "first"
+		}
+		if !isTeamSubmissionOption(jsonObject["teamSubmission"]) {
+			fmt.Fprintf(w, "{\"status\": \"ERROR\", \"message\": \"teamSubmission must be one of "+strings.Join(teamSubmissionOptions, ", ")+"\"}")
+			return
+		}
+		if jsonObject["replaySeconds"] == "" {
+			jsonObject["replaySeconds"] = strconv.Itoa(defaultReplaySeconds)
+		}
+		_replaySeconds, err := parseReplaySeconds(jsonObject["replaySeconds"])
+		if err != nil {
+			fmt.Fprint(w, "{\"status\": \"ERROR\", \"message\": "+jsonString(err.Error())+"}")
+			return
+		}
+		if jsonObject["exportFormat"] == "" {
+			jsonObject["exportFormat"] = defaultExportFormat
+		}
+		if !isExportFormat(jsonObject["exportFormat"]) {
+			fmt.Fprintf(w, "{\"status\": \"ERROR\", \"message\": \"exportFormat must be one of "+strings.Join(exportFormats, ", ")+"\"}")
+			return
+		}
+		_pacing, err := parseRevealPacing(jsonObject, defaultRevealPacing())
+		if err != nil {
+			fmt.Fprint(w, "{\"status\": \"ERROR\", \"message\": "+jsonString(err.Error())+"}")
+			return
 		}
+		if jsonObject["captionLayout"] == "" {
+			jsonObject["captionLayout"] = defaultCaptionLayout
+		}
+		if !isCaptionLayout(jsonObject["captionLayout"]) {
+			fmt.Fprintf(w, "{\"status\": \"ERROR\", \"message\": \""+captionLayoutError()+"\"}")
+			return
+		}
+		if jsonObject["font"] == "" {
+			jsonObject["font"] = defaultFontName
+		}
+		if _, ok := loadedFonts[jsonObject["font"]]; !ok {
+			fmt.Fprint(w, "{\"status\": \"ERROR\", \"message\": "+jsonString("Unknown font "+jsonObject["font"])+"}")
+			return
+		}
+		if jsonObject["captionTheme"] == "" {
+			jsonObject["captionTheme"] = defaultCaptionThemeName
+		}
+		if _, ok := captionThemes[jsonObject["captionTheme"]]; !ok {
+			fmt.Fprint(w, "{\"status\": \"ERROR\", \"message\": "+jsonString("Unknown captionTheme "+jsonObject["captionTheme"])+"}")
+			return
+		}
+		_startingPrompts := jsonObject["startingPrompts"]
+		if _startingPrompts != "" {
+			if !isStartingPromptOption(_startingPrompts) {
+				fmt.Fprintf(w, "{\"status\": \"ERROR\", \"message\": \"startingPrompts must be one of "+strings.Join(startingPromptOptions, ", ")+"\"}")
+				return
+			}
+			if _promptPack == nil {
+				fmt.Fprintf(w, "{\"status\": \"ERROR\", \"message\": \"startingPrompts requires a promptPack\"}")
+				return
+			}
+			if _gameMode.OpensWithDrawing(0) {
+				fmt.Fprintf(w, "{\"status\": \"ERROR\", \"message\": \"gameMode "+_gameMode.Name()+" has no starting prompts\"}")
+				return
+			}
+		}
+
+		game := newGame(_gameName, playerName, _roundTimer, _totalRounds, _gameMode)
+		game.promptPack = _promptPack
+		game.startingPrompts = _startingPrompts
+		game.teamSize = _teamSize
+		game.teamSubmission = jsonObject["teamSubmission"]
+		game.replayDuration = _replaySeconds * 100
+		game.exportFormat = jsonObject["exportFormat"]
+		game.pacing = _pacing
+		game.captionLayout = jsonObject["captionLayout"]
+		game.font = jsonObject["font"]
+		game.captionTheme = jsonObject["captionTheme"]
 
 		// Add the game to the games map
 		games[game.gameName] = game
@@ -238,11 +436,18 @@ func listEndedGames(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func endedGameStateToJSON(endedGame EndedGame) string {
+// endedGameStateToJSON describes an ended game, with drawings and exports
+// given as URLs on baseURL. The animations and renders are those of format.
+func endedGameStateToJSON(endedGame EndedGame, baseURL, format string) string {
 	gameJsonString := ""
 	gameJsonString += "{"
 	gameJsonString += "\"gameName\": \"" + endedGame.gameName + "\","
 	gameJsonString += "\"gameId\": \"" + endedGame.gameId + "\","
+	gameJsonString += "\"gameMode\": \"" + endedGame.gameMode + "\","
+	gameJsonString += "\"teams\": " + teamsToJSON(endedGame.teams) + ","
+	gameJsonString += "\"previousGameId\": \"" + endedGame.previousGameId + "\","
+	gameJsonString += "\"nextGameId\": \"" + endedGame.nextGameId + "\","
+	gameJsonString += "\"series\": " + jsonStringList(gameSeries(&endedGame)) + ","
 	gameJsonString += "\"prompts\": ["
 	for i, prompt := range endedGame.prompts {
 		gameJsonString += "["
@@ -262,7 +467,7 @@ func endedGameStateToJSON(endedGame EndedGame) string {
 	for i, drawing := range endedGame.drawings {
 		gameJsonString += "["
 		for j := range drawing {
-			gameJsonString += "\"" + endedGame.drawings[i][j] + "\""
+			gameJsonString += "\"" + imageURL(baseURL, endedGame.drawings[i][j]) + "\""
 			if j < len(drawing)-1 {
 				gameJsonString += ","
 			}
@@ -273,29 +478,64 @@ func endedGameStateToJSON(endedGame EndedGame) string {
 		}
 	}
 	gameJsonString += "],"
-	gameJsonString += "\"gifs\": ["
-	for _, gif := range endedGame.gifs {
-		gameJsonString += "\"" + gif + "\","
-	}
-	if len(endedGame.gifs) > 0 {
-		gameJsonString = gameJsonString[:len(gameJsonString)-1]
+	gameJsonString += "\"drawingIds\": ["
+	for i, drawing := range endedGame.drawings {
+		gameJsonString += jsonStringList(drawing)
+		if i < len(endedGame.drawings)-1 {
+			gameJsonString += ","
+		}
 	}
-	gameJsonString += "]"
+	gameJsonString += "],"
+	gameJsonString += "\"scores\": " + scoresToJSON(endedGame.scores) + ","
+	gameJsonString += "\"awards\": " + awardsToJSON(endedGame.awards) + ","
+	gameJsonString += "\"gifs\": " + jsonStringList(renderedURLs(endedGame.renders["gif"], baseURL)) + ","
+	gameJsonString += "\"exportFormat\": \"" + endedGame.exportFormat + "\","
+	gameJsonString += "\"pacing\": " + revealPacingToJSON(endedGame.pacing) + ","
+	gameJsonString += "\"captionLayout\": \"" + endedGame.captionLayout + "\","
+	gameJsonString += "\"font\": " + jsonString(endedGame.font) + ","
+	gameJsonString += "\"captionTheme\": " + jsonString(endedGame.captionTheme) + ","
+	gameJsonString += "\"replaySeconds\": " + fmt.Sprint(endedGame.replayDuration/100) + ","
+	gameJsonString += "\"format\": \"" + format + "\","
+	gameJsonString += "\"animations\": " + jsonStringList(renderedURLs(endedGame.renders[format], baseURL)) + ","
+	gameJsonString += "\"renderStatus\": \"" + renderStatus(endedGame.renders[format]) + "\","
+	gameJsonString += "\"renders\": " + rendersToJSON(endedGame.renders[format], baseURL) + ","
+	gameJsonString += "\"downloads\": " + exportsToJSON(&endedGame, baseURL)
 	gameJsonString += "}"
 	return gameJsonString
 }
 
-func gameStateToJSON(game Game) string {
+func gameStateToJSON(game Game, baseURL string) string {
 	// Convert the game state to JSON
 	gameJsonString := ""
 	gameJsonString += "{"
 	gameJsonString += "\"gameName\": \"" + game.gameName + "\","
 	gameJsonString += "\"gameId\": \"" + game.gameId + "\","
+	gameJsonString += "\"gameMode\": \"" + game.mode.Name() + "\","
 	gameJsonString += "\"roundTimer\": " + fmt.Sprint(game.roundTimer) + ","
 	gameJsonString += "\"totalRounds\": " + fmt.Sprint(game.totalRounds) + ","
 	gameJsonString += "\"currentRound\": " + fmt.Sprint(game.currentRound) + ","
 	gameJsonString += "\"promptsSet\": " + fmt.Sprint(game.promptsSet) + ","
 	gameJsonString += "\"gameStarted\": " + fmt.Sprint(game.gameStarted) + ","
+	gameJsonString += "\"votingOpen\": " + fmt.Sprint(game.votingOpen) + ","
+	if game.renders != nil {
+		gameJsonString += "\"gifs\": " + jsonStringList(renderedURLs(game.renders["gif"], baseURL)) + ","
+		gameJsonString += "\"renderStatus\": \"" + renderStatus(game.renders["gif"]) + "\","
+		gameJsonString += "\"renders\": " + rendersToJSON(game.renders["gif"], baseURL) + ","
+	}
+	gameJsonString += "\"teamSize\": " + fmt.Sprint(game.teamSize) + ","
+	gameJsonString += "\"teamSubmission\": \"" + game.teamSubmission + "\","
+	gameJsonString += "\"replaySeconds\": " + fmt.Sprint(game.replayDuration/100) + ","
+	gameJsonString += "\"pacing\": " + revealPacingToJSON(game.pacing) + ","
+	gameJsonString += "\"captionLayout\": \"" + game.captionLayout + "\","
+	gameJsonString += "\"font\": " + jsonString(game.font) + ","
+	gameJsonString += "\"captionTheme\": " + jsonString(game.captionTheme) + ","
+	gameJsonString += "\"exportFormat\": \"" + game.exportFormat + "\","
+	gameJsonString += "\"teams\": " + teamsToJSON(game.teams) + ","
+	gameJsonString += "\"previousGameId\": \"" + game.previousGameId + "\","
+	if game.promptPack != nil {
+		gameJsonString += "\"promptPack\": " + jsonString(game.promptPack.Name) + ","
+		gameJsonString += "\"startingPrompts\": \"" + game.startingPrompts + "\","
+	}
 	gameJsonString += "\"players\": ["
 	for i, player := range game.players {
 		gameJsonString += "{"
@@ -335,7 +575,7 @@ func gameStateToJSON(game Game) string {
 	for i, drawing := range game.drawings {
 		gameJsonString += "["
 		for j := range drawing {
-			gameJsonString += "\"" + game.drawings[i][j] + "\""
+			gameJsonString += "\"" + imageURL(baseURL, game.drawings[i][j]) + "\""
 			if j < len(drawing)-1 {
 				gameJsonString += ","
 			}
@@ -345,6 +585,14 @@ func gameStateToJSON(game Game) string {
 			gameJsonString += ","
 		}
 	}
+	gameJsonString += "],"
+	gameJsonString += "\"drawingIds\": ["
+	for i, drawing := range game.drawings {
+		gameJsonString += jsonStringList(drawing)
+		if i < len(game.drawings)-1 {
+			gameJsonString += ","
+		}
+	}
 	gameJsonString += "]"
 	gameJsonString += "}"
 	return gameJsonString
@@ -363,8 +611,8 @@ func getGameState(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, responseStr)
 			return
 		}
-		gameStateJSON := gameStateToJSON(*game)
-		fmt.Fprintf(w, gameStateJSON)
+		gameStateJSON := gameStateToJSON(*game, getBaseURL(r))
+		fmt.Fprint(w, gameStateJSON)
 	} else {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
@@ -384,8 +632,23 @@ func getEndedGame(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, responseStr)
 			return
 		}
-		endedGameStateJSON := endedGameStateToJSON(*endedGame)
-		fmt.Fprintf(w, endedGameStateJSON)
+		// the export format can be picked with ?format=, and is rendered
+		// the first time it is asked for
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = jsonObject["format"]
+		}
+		if format == "" {
+			format = endedGame.exportFormat
+		}
+		if !isExportFormat(format) {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"" + exportFormatError() + "\"}"
+			fmt.Fprint(w, responseStr)
+			return
+		}
+		queueGameRenders(endedGame, format)
+		endedGameStateJSON := endedGameStateToJSON(*endedGame, getBaseURL(r), format)
+		fmt.Fprint(w, endedGameStateJSON)
 	} else {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
@@ -421,27 +684,33 @@ func startGame(w http.ResponseWriter, r *http.Request) {
 		if len(game.players) == 0 {
 			responseStr := "{\"status\": \"ERROR\", \"message\": \"No players in game\"}"
 			fmt.Fprintf(w, responseStr)
+		} else if game.gameStarted == false && game.promptPack != nil && len(game.promptPack.Prompts) < packPromptsNeeded(game) {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Not enough prompts in the prompt pack for this many players\"}"
+			fmt.Fprintf(w, responseStr)
 		} else if game.gameStarted == false {
+			// shuffle the order of the players
+			for i := range game.players {
+				j := mrand.Intn(i + 1)
+				game.players[i], game.players[j] = game.players[j], game.players[i]
+			}
+			buildTeams(game)
+
 			if game.totalRounds <= 0 {
-				game.totalRounds = len(game.players)
+				game.totalRounds = len(game.teams)
 			}
 			game.gameStarted = true
-			game.prompts = make([][]string, len(game.players))
-			game.drawings = make([][]string, len(game.players))
+			game.prompts = make([][]string, len(game.teams))
+			game.drawings = make([][]string, len(game.teams))
 			for i := range game.prompts {
 				game.prompts[i] = make([]string, game.totalRounds)
 				game.drawings[i] = make([]string, game.totalRounds)
 			}
 
-			// shuffle the order of the players
-			for i := range game.players {
-				j := mrand.Intn(i + 1)
-				game.players[i], game.players[j] = game.players[j], game.players[i]
-			}
-
 			for _, p := range game.players {
-				p.queuedMessage = gameStartedMessage
+				p.queuedMessage = game.mode.StartMessage()
 			}
+			openRound(game)
+			applyStartingPrompts(game)
 
 			responseStr := "{\"status\": \"OK\", \"message\": \"Game started\"}"
 			fmt.Fprintf(w, responseStr)
@@ -454,19 +723,62 @@ func startGame(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func _endGame(gameName string) {
-	game := games[gameName]
-	gifs := createGifsFromGame(game)
+// newEndedGame snapshots a game as it ends, before its votes are tallied
+func newEndedGame(game *Game) *EndedGame {
+	playerNames := []string{}
+	for _, p := range game.players {
+		playerNames = append(playerNames, p.playerName)
+	}
+	promptPackName := ""
+	if game.promptPack != nil {
+		promptPackName = game.promptPack.Name
+	}
 
-	endedGame := EndedGame{
+	return &EndedGame{
 		gameName:        game.gameName,
 		gameId:          game.gameId,
 		roundsCompleted: game.currentRound,
+		gameMode:        game.mode.Name(),
+		teams:           game.teams,
+		creator:         game.creator,
+		players:         playerNames,
+		roundTimer:      game.roundTimer,
+		totalRounds:     game.requestedRounds,
+		promptPack:      promptPackName,
+		startingPrompts: game.startingPrompts,
+		teamSize:        game.teamSize,
+		teamSubmission:  game.teamSubmission,
+		replayDuration:  game.replayDuration,
+		exportFormat:    game.exportFormat,
+		pacing:          game.pacing,
+		captionLayout:   game.captionLayout,
+		font:            game.font,
+		captionTheme:    game.captionTheme,
+		renders:         make(map[string][]*ChainRender),
+		exports:         make(map[string]string),
+		previousGameId:  game.previousGameId,
 		prompts:         game.prompts,
 		drawings:        game.drawings,
-		gifs:            gifs,
+		strokes:         game.strokes,
+	}
+}
+
+func _endGame(gameName string) {
+	game := games[gameName]
+	endedGame := newEndedGame(game)
+	endedGame.scores, endedGame.awards = tallyVotes(game)
+	endedGame.endedAt = time.Now()
+	endedGames[game.gameId] = endedGame
+	retainEndedGameBlobs(endedGame)
+	// the renders queued when voting opened carry on where they are, and
+	// already hold their files. The rest are rendered in the background, and
+	// getEndedGame reports how far along they are.
+	if game.renders != nil {
+		endedGame.renders = game.renders
+	}
+	for _, format := range exportFormatsToRender(endedGame.exportFormat) {
+		queueGameRenders(endedGame, format)
 	}
-	endedGames[game.gameId] = &endedGame
 
 	for _, p := range game.players {
 		p.queuedMessage = gameEndedMessage + ",\"endedGameId\": " + "\"" + game.gameId + "\"}"
@@ -509,10 +821,17 @@ func _endRound(gameName string) bool {
 	if !ok {
 		return false
 	}
+	if game.votingOpen {
+		// ending the voting round closes the polls and ends the game
+		_endGame(gameName)
+		return true
+	}
 
 	if game.promptsSet == false {
-		for i, p := range game.players {
-			p.queuedMessage = drawPromptMessage + ",\"prompt\": \"" + game.prompts[i][game.currentRound] + "\"}"
+		resolveTeamDrafts(game, game.prompts)
+		fillMissingStartingPrompts(game)
+		for i, team := range game.teams {
+			queueTeamMessage(team, drawPromptMessage+",\"prompt\": \""+game.prompts[i][game.currentRound]+"\"}")
 		}
 
 		game.promptsSet = true
@@ -520,17 +839,19 @@ func _endRound(gameName string) bool {
 		// }
 	} else {
 		// set queued messages for players to caption the drawings
-		for i, p := range game.players {
-			offsetIndex := (1 + i + game.currentRound) % len(game.players)
-			p.queuedMessage = captionPromptMessage + ",\"image\": \"" + game.drawings[offsetIndex][game.currentRound] + "\"}"
+		resolveTeamDrafts(game, game.drawings)
+		for i, team := range game.teams {
+			offsetIndex := (1 + i + game.currentRound) % len(game.teams)
+			imageId := game.drawings[offsetIndex][game.currentRound]
+			queueTeamMessage(team, captionPromptMessage+",\"image\": \""+imageURL(baseUrlPlaceholder, imageId)+"\",\"imageId\": \""+imageId+"\"}")
 		}
 
 		game.currentRound++
 		if game.currentRound == game.totalRounds {
-			_endGame(gameName)
+			_startVoting(game)
 			return true
 		}
-		game.promptsSet = false
+		openRound(game)
 		return true
 	}
 }
@@ -653,9 +974,10 @@ func joinGame(w http.ResponseWriter, r *http.Request) {
 
 func progressGameIfReady(game *Game) {
 	// Progress the game by calling _endRound() if all prompts are set and promptsSet is false
-	// or if promptsSet is true and all drawings for this round are submitted
+	// or if promptsSet is true and all drawings for this round are submitted.
+	// Rounds which the game mode opens with drawing only wait on drawings
 	roundNumber := game.currentRound
-	if game.promptsSet == false {
+	if game.promptsSet == false && !game.mode.OpensWithDrawing(roundNumber) {
 		for _, promptSlice := range game.prompts {
 			if promptSlice[roundNumber] == "" {
 				return
@@ -698,26 +1020,46 @@ func submitPrompt(w http.ResponseWriter, r *http.Request) {
 				fmt.Fprintf(w, responseStr)
 				return
 			}
+			if utf8.RuneCountInString(prompt) > maxPromptLength {
+				responseStr := "{\"status\": \"ERROR\", \"message\": \"Prompt must be at most " + strconv.Itoa(maxPromptLength) + " characters\"}"
+				fmt.Fprint(w, responseStr)
+				return
+			}
+			if game.votingOpen {
+				responseStr := "{\"status\": \"ERROR\", \"message\": \"Game is in the voting round\"}"
+				fmt.Fprintf(w, responseStr)
+				return
+			}
 			if game.promptsSet == true {
 				responseStr := "{\"status\": \"ERROR\", \"message\": \"Prompts already set for this round\"}"
 				fmt.Fprintf(w, responseStr)
 				return
 			}
-			playerIndex := getPlayerIndex(playerName, game)
-			if playerIndex == -1 {
+			seatIndex := getSeatIndex(playerName, game)
+			if seatIndex == -1 {
 				responseStr := "{\"status\": \"ERROR\", \"message\": \"Player not in game\"}"
 				fmt.Fprintf(w, responseStr)
 				return
 			}
+			team := game.teams[seatIndex]
 
-			gameRotationIndex := (playerIndex + game.currentRound) % len(game.players)
+			gameRotationIndex := (seatIndex + game.currentRound) % len(game.teams)
 			if len(game.prompts) == 0 || len(game.prompts[gameRotationIndex]) == 0 {
 				responseStr := "{\"status\": \"ERROR\", \"message\": \"Game prompts slice not initialized\"}"
 				fmt.Fprintf(w, responseStr)
 				return
 			}
+			if game.currentRound == 0 && game.startingPrompts == "choose" && !isPromptChoice(game, team.teamName, prompt) {
+				responseStr := "{\"status\": \"ERROR\", \"message\": \"Prompt must be one of the offered choices\"}"
+				fmt.Fprintf(w, responseStr)
+				return
+			}
 			if game.prompts[gameRotationIndex][game.currentRound] == "" {
-				game.prompts[gameRotationIndex][game.currentRound] = prompt
+				if draftMessage := submitTeamEntry(game, team, playerName, game.prompts, gameRotationIndex, prompt); draftMessage != "" {
+					responseStr := "{\"status\": \"OK\", \"message\": \"" + draftMessage + "\"}"
+					fmt.Fprintf(w, responseStr)
+					return
+				}
 				responseStr := "{\"status\": \"OK\", \"message\": \"Prompt submitted\"}"
 				fmt.Fprintf(w, responseStr)
 				progressGameIfReady(game)
@@ -736,65 +1078,125 @@ func submitPrompt(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// drawingSlot finds the chain a player is drawing in this round, or says why
+// they can't submit a drawing. Must be called holding stateLock.
+func drawingSlot(gameName, playerName, playerSecret string) (*Game, int, string) {
+	if !authenticatePlayer(playerName, playerSecret) {
+		return nil, 0, "Player not authenticated"
+	}
+	game, ok := games[gameName]
+	if !ok {
+		return nil, 0, "Game not found"
+	}
+	if game.gameStarted == false {
+		return nil, 0, "Game not started"
+	}
+	if game.votingOpen {
+		return nil, 0, "Game is in the voting round"
+	}
+	if game.promptsSet == false {
+		return nil, 0, "Prompts not yet set for this round"
+	}
+	seatIndex := getSeatIndex(playerName, game)
+	if seatIndex == -1 {
+		return nil, 0, "Player not in game"
+	}
+	gameRotationIndex := (seatIndex + game.currentRound) % len(game.teams)
+	if len(game.drawings) == 0 || len(game.drawings[gameRotationIndex]) == 0 {
+		return nil, 0, "Game drawings slice not initialized"
+	}
+	if game.drawings[gameRotationIndex][game.currentRound] != "" {
+		return nil, 0, "Drawing already submitted"
+	}
+	return game, seatIndex, ""
+}
+
+// Submit a drawing to the current game, either as the imageId of an uploaded
+// image or as vector strokes which are rasterized here. Strokes are drawn and
+// stored before stateLock is taken for good, so a big drawing doesn't hold up
+// the server, and the game is checked again once it is.
 func submitDrawing(w http.ResponseWriter, r *http.Request) {
 	allowCors(&w)
 	if r.Method == "OPTIONS" {
 		w.WriteHeader(http.StatusOK)
 	} else if r.Method == "POST" {
-		// Submit a prompt to the current game
-		bodyObj := parseBodyObject(r)
+		body := readBody(r)
+		bodyObj := parseBodyBytes(body)
 
 		gameName := bodyObj["gameName"]
 		playerName := bodyObj["playerName"]
 		playerSecret := bodyObj["playerSecret"]
 		drawing := bodyObj["drawing"]
+		var strokeBody struct {
+			Strokes *StrokeDrawing `json:"strokes"`
+		}
 
-		if authenticatePlayer(playerName, playerSecret) {
-			game, ok := games[gameName]
-			if !ok {
-				responseStr := "{\"status\": \"ERROR\", \"message\": \"Game not found\"}"
-				fmt.Fprintf(w, responseStr)
+		outputPath := ""
+		if drawing == "" {
+			stateLock.Lock()
+			_, _, message := drawingSlot(gameName, playerName, playerSecret)
+			stateLock.Unlock()
+			if message != "" {
+				fmt.Fprint(w, "{\"status\": \"ERROR\", \"message\": "+jsonString(message)+"}")
 				return
 			}
-
-			if game.gameStarted == false {
-				responseStr := "{\"status\": \"ERROR\", \"message\": \"Game not started\"}"
+			err := json.Unmarshal(body, &strokeBody)
+			if err != nil || strokeBody.Strokes == nil {
+				responseStr := "{\"status\": \"ERROR\", \"message\": \"Either drawing or strokes is required\"}"
 				fmt.Fprintf(w, responseStr)
 				return
 			}
-			if game.promptsSet == false {
-				responseStr := "{\"status\": \"ERROR\", \"message\": \"Prompts not yet set for this round\"}"
+			err = validateStrokeDrawing(strokeBody.Strokes)
+			if err != nil {
+				responseStr := "{\"status\": \"ERROR\", \"message\": " + jsonString("Invalid strokes: "+err.Error()) + "}"
 				fmt.Fprintf(w, responseStr)
 				return
 			}
-			playerIndex := getPlayerIndex(playerName, game)
-			if playerIndex == -1 {
-				responseStr := "{\"status\": \"ERROR\", \"message\": \"Player not in game\"}"
+			outputPath, err = saveImage(uploadPipeline.process(rasterizeStrokes(strokeBody.Strokes)))
+			if err != nil {
+				responseStr := "{\"status\": \"ERROR\", \"message\": \"" + err.Error() + "\"}"
 				fmt.Fprintf(w, responseStr)
 				return
 			}
+		}
+
+		stateLock.Lock()
+		defer stateLock.Unlock()
+		if outputPath != "" {
+			// registering the drawing retains it, or it is deleted here
+			defer releaseBlob(outputPath)
+		}
+		game, seatIndex, message := drawingSlot(gameName, playerName, playerSecret)
+		if message != "" {
+			fmt.Fprint(w, "{\"status\": \"ERROR\", \"message\": "+jsonString(message)+"}")
+			return
+		}
+		team := game.teams[seatIndex]
+		gameRotationIndex := (seatIndex + game.currentRound) % len(game.teams)
 
-			gameRotationIndex := (playerIndex + game.currentRound) % len(game.players)
-			if len(game.drawings) == 0 || len(game.drawings[gameRotationIndex]) == 0 {
-				responseStr := "{\"status\": \"ERROR\", \"message\": \"Game drawings slice not initialized\"}"
+		if outputPath != "" {
+			drawing = registerImage(outputPath, playerName, game, strokeBody.Strokes).imageId
+			game.strokes[drawing] = strokeBody.Strokes
+		} else {
+			registered, ok := imageRegistry[drawing]
+			if !ok || registered.owner != playerName || registered.gameId != game.gameId || registered.round != game.currentRound {
+				responseStr := "{\"status\": \"ERROR\", \"message\": \"drawing must be the imageId of an image you uploaded for this round\"}"
 				fmt.Fprintf(w, responseStr)
 				return
 			}
-			if game.drawings[gameRotationIndex][game.currentRound] == "" {
-				game.drawings[gameRotationIndex][game.currentRound] = drawing
-				responseStr := "{\"status\": \"OK\", \"message\": \"Drawing submitted\"}"
-				fmt.Fprintf(w, responseStr)
-				progressGameIfReady(game)
-
-			} else {
-				responseStr := "{\"status\": \"ERROR\", \"message\": \"Drawing already submitted\"}"
-				fmt.Fprintf(w, responseStr)
+			// stroke JSON sent through /uploadDrawing replays like strokes sent here
+			if registered.strokes != nil {
+				game.strokes[drawing] = registered.strokes
 			}
-		} else {
-			responseStr := "{\"status\": \"ERROR\", \"message\": \"Player not authenticated\"}"
+		}
+		if draftMessage := submitTeamEntry(game, team, playerName, game.drawings, gameRotationIndex, drawing); draftMessage != "" {
+			responseStr := "{\"status\": \"OK\", \"message\": \"" + draftMessage + "\"}"
 			fmt.Fprintf(w, responseStr)
 			return
 		}
+		responseStr := "{\"status\": \"OK\", \"message\": \"Drawing submitted\"}"
+		fmt.Fprintf(w, responseStr)
+		progressGameIfReady(game)
 	} else {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
@@ -810,17 +1212,25 @@ func generateShortHash() string {
 	return hex.EncodeToString(b)
 }
 
-func resizeImage(img image.Image, width, height int) image.Image {
-	// Create a new RGBA image with the desired dimensions
-	dst := image.NewRGBA(image.Rect(0, 0, width, height))
-
-	// Use the Nearest-Neighbor algorithm for scaling
-	draw.NearestNeighbor.Scale(dst, dst.Rect, img, img.Bounds(), draw.Over, nil)
-
-	// For better quality, you can use Catmull-Rom interpolation:
-	// draw.CatmullRom.Scale(dst, dst.Rect, img, img.Bounds(), draw.Over, nil)
+// saveImage stores img as a PNG under images/ in the blob store and returns
+// its key. Images are named by the SHA-256 of the encoded PNG, so saving the
+// same pixels twice gives the same key and stores them once. Like
+// storeContent, the key comes back holding a reference for the caller to
+// release.
+func saveImage(img image.Image) (string, error) {
+	// Save the image in PNG format
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		return "", fmt.Errorf("Error encoding image to PNG")
+	}
 
-	return dst
+	outputPath, err := storeContent(imagesDir, ".png", buf.Bytes())
+	if err != nil {
+		fmt.Println("Error storing image:", err)
+		return "", fmt.Errorf("Unable to store the image")
+	}
+	return outputPath, nil
 }
 
 func getBaseURL(r *http.Request) string {
@@ -836,6 +1246,38 @@ func getBaseURL(r *http.Request) string {
 	return fmt.Sprintf("%s://%s", scheme, host)
 }
 
+// uploadSlot finds the game a player is uploading a drawing for, or gives the
+// status and message to refuse the upload with. Must be called holding
+// stateLock.
+func uploadSlot(gameName, playerName, playerSecret, round string) (*Game, int, string) {
+	if !authenticatePlayer(playerName, playerSecret) {
+		return nil, http.StatusUnauthorized, "Player not authenticated"
+	}
+
+	// Uploads belong to a round of a game the player is in
+	game, ok := games[gameName]
+	if !ok {
+		return nil, http.StatusNotFound, "Game not found"
+	}
+	if !game.gameStarted || game.votingOpen {
+		return nil, http.StatusConflict, "The game is not accepting drawings"
+	}
+	if getSeatIndex(playerName, game) == -1 {
+		return nil, http.StatusForbidden, "Player not in game"
+	}
+	roundNumber, err := strconv.Atoi(round)
+	if err != nil || roundNumber != game.currentRound {
+		return nil, http.StatusConflict, "round must be the game's current round"
+	}
+	if uploadsThisRound(game, playerName) >= maxUploadsPerRound {
+		return nil, http.StatusTooManyRequests, fmt.Sprintf("Upload limit of %d per round reached", maxUploadsPerRound)
+	}
+	return game, http.StatusOK, ""
+}
+
+// An endpoint to upload a drawing for the current round. The upload is read,
+// decoded and stored before stateLock is taken for good, so a slow or large
+// upload doesn't hold up the server, and the game is checked again once it is.
 func uploadDrawing(w http.ResponseWriter, r *http.Request) {
 	allowCors(&w)
 	if r.Method == "OPTIONS" {
@@ -850,12 +1292,16 @@ func uploadDrawing(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Get form values for authentication
+		gameName := r.FormValue("gameName")
 		playerName := r.FormValue("playerName")
 		playerSecret := r.FormValue("playerSecret")
+		round := r.FormValue("round")
 
-		// Authenticate the player
-		if !authenticatePlayer(playerName, playerSecret) {
-			http.Error(w, "Player not authenticated", http.StatusUnauthorized)
+		stateLock.Lock()
+		_, status, message := uploadSlot(gameName, playerName, playerSecret, round)
+		stateLock.Unlock()
+		if message != "" {
+			http.Error(w, message, status)
 			return
 		}
 
@@ -867,74 +1313,52 @@ func uploadDrawing(w http.ResponseWriter, r *http.Request) {
 		}
 		defer file.Close()
 
-		// Decode the image
-		img, format, err := image.Decode(file)
+		data, err := io.ReadAll(file)
 		if err != nil {
-			http.Error(w, "Error decoding image", http.StatusBadRequest)
-			return
-		}
-		if format != "jpeg" && format != "png" {
-			http.Error(w, "Unsupported file type", http.StatusUnsupportedMediaType)
+			http.Error(w, "Error reading the file", http.StatusBadRequest)
 			return
 		}
 
-		resizedImage := resizeImage(img, 1024, 1024)
-
-		// Generate a short hash for the filename
-		hash := generateShortHash()
-		if hash == "" {
-			http.Error(w, "Error generating file name", http.StatusInternalServerError)
+		// Decode the image
+		img, strokes, err := decodeUpload(data)
+		if err == errUnsupportedUpload {
+			http.Error(w, "Unsupported file type, accepted formats are "+uploadFormatNames, http.StatusUnsupportedMediaType)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// Ensure the images directory exists
-		if _, err := os.Stat("images"); os.IsNotExist(err) {
-			err = os.Mkdir("images", os.ModePerm)
-			if err != nil {
-				http.Error(w, "Error creating images directory", http.StatusInternalServerError)
-				return
-			}
-		}
+		resizedImage := uploadPipeline.process(img)
 
-		// Create the output file
-		outputPath := fmt.Sprintf("images/%s.png", hash)
-		outFile, err := os.Create(outputPath)
+		// Only the decoded pixels are written back out, so no EXIF, comments or
+		// other metadata from the original file survive
+		outputPath, err := saveImage(resizedImage)
 		if err != nil {
-			http.Error(w, "Unable to create the file for writing", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer outFile.Close()
 
-		// Save the image in PNG format
-		err = png.Encode(outFile, resizedImage)
-		if err != nil {
-			http.Error(w, "Error encoding image to PNG", http.StatusInternalServerError)
+		stateLock.Lock()
+		defer stateLock.Unlock()
+		// registering the drawing retains it, or it is deleted here
+		defer releaseBlob(outputPath)
+		game, status, message := uploadSlot(gameName, playerName, playerSecret, round)
+		if message != "" {
+			http.Error(w, message, status)
 			return
 		}
+		registered := registerImage(outputPath, playerName, game, strokes)
 
-		// Return the relative URL of the saved image
-		baseUrl := getBaseURL(r)
-		imageUrl := fmt.Sprintf("%s/%s", baseUrl, outputPath)
-		responseStr := "{\"status\": \"OK\", \"message\": \"Image uploaded\", \"imageUrl\": \"" + imageUrl + "\"}"
-		fmt.Fprintf(w, responseStr)
+		// Return the ID to submit the drawing with, and a URL to preview it
+		imageUrl := imageURL(getBaseURL(r), registered.imageId)
+		responseStr := "{\"status\": \"OK\", \"message\": \"Image uploaded\", \"imageId\": \"" + registered.imageId + "\", \"imageUrl\": \"" + imageUrl + "\"}"
+		fmt.Fprint(w, responseStr)
 	} else {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 	}
 }
 
-func parseImagePathFromUrl(inputUrl string) string {
-	// given  a URL like http://localhost:8080/images/12345678.png it should return "images/12345678.png"
-	returnString := ""
-	finalSlashIndex := strings.LastIndex(inputUrl, "/")
-	if finalSlashIndex != -1 {
-		returnString = imagesDir + string(os.PathSeparator) + inputUrl[finalSlashIndex+1:]
-	} else {
-		returnString = inputUrl
-	}
-
-	return returnString
-}
-
 func extractHashFromImagePath(imagePath string) string {
 	filename := filepath.Base(imagePath)      // e.g., "12345678.png"
 	ext := filepath.Ext(filename)             // e.g., ".png"
@@ -943,337 +1367,343 @@ func extractHashFromImagePath(imagePath string) string {
 }
 
 func loadImage(path string) (image.Image, error) {
-	file, err := os.Open(path)
+	data, err := blobStore.Get(path)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
-	img, _, err := image.Decode(file)
+	img, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
 		return nil, err
 	}
 	return img, nil
 }
 
-// Helper function to convert an image to *image.Paletted
-func toPaletted(img image.Image) *image.Paletted {
-	bounds := img.Bounds()
-	palettedImg := image.NewPaletted(bounds, palette.Plan9)
-	draw.FloydSteinberg.Draw(palettedImg, bounds, img, image.Point{})
-	return palettedImg
-}
-
-func wrapText(text string, face font.Face, maxWidth int) []string {
+// wrapText breaks text into lines no wider than maxWidth at size, breaking
+// between words, and between the characters of scripts such as Chinese and
+// Japanese which don't space their words. Text too wide to fit with nowhere to
+// break, such as a very long word, is broken wherever it has to be, keeping
+// the joined up forms of its Arabic letters. Lines are measured as they grow,
+// kerning across words included. The lines come back shaped, in the order
+// they are read in, not yet in the order they are drawn.
+func wrapText(text string, fonts FontChain, size float64, maxWidth int) []string {
 	var lines []string
-	words := strings.Fields(text)
-	if len(words) == 0 {
-		return lines
-	}
-
-	spaceWidth, _ := face.GlyphAdvance(' ')
-	spaceWidthInt := int(spaceWidth >> 6)
-
-	var lineWords []string
-	lineWidth := 0
-
-	for _, word := range words {
-		wordWidth := calcTextWidth(word, face)
-		if lineWidth+wordWidth > maxWidth && len(lineWords) > 0 {
+	line := ""
+	measure := newLineMeasure(fonts, size)
+	spaceBefore := false
+	for _, segment := range breakSegments(shapeArabic(text, fonts.has)) {
+		piece := segment.text
+		if line != "" && spaceBefore {
+			piece = " " + segment.text
+		}
+		if line != "" && measure.widthWith(piece) > maxWidth {
 			// Start a new line
-			lines = append(lines, strings.Join(lineWords, " "))
-			lineWords = []string{word}
-			lineWidth = wordWidth + spaceWidthInt
-		} else {
-			if len(lineWords) > 0 {
-				lineWidth += spaceWidthInt
+			lines = append(lines, line)
+			line, piece = "", segment.text
+			measure = newLineMeasure(fonts, size)
+		}
+		for {
+			head, rest := splitToFit(piece, measure, maxWidth)
+			line += head
+			if rest == "" {
+				break
 			}
-			lineWords = append(lineWords, word)
-			lineWidth += wordWidth
+			lines = append(lines, line)
+			line, piece = "", rest
+			measure = newLineMeasure(fonts, size)
 		}
+		spaceBefore = segment.spaceAfter
 	}
 	// Add the last line
-	if len(lineWords) > 0 {
-		lines = append(lines, strings.Join(lineWords, " "))
+	if line != "" {
+		lines = append(lines, line)
 	}
-
 	return lines
 }
 
-func calcTextWidth(text string, face font.Face) int {
-	width := 0
-	for _, x := range text {
-		awidth, ok := face.GlyphAdvance(x)
-		if ok != true {
-			continue
-		}
-		width += int(awidth >> 6)
-	}
-	return width
+// TextLayout is text wrapped to fit a box at the largest size it fits at
+type TextLayout struct {
+	fonts    FontChain
+	fontSize float64
+	// the lines in the order they are drawn in, left to right
+	lines      []string
+	lineHeight int
+	// whether the text reads right to left, and which edge of the box the
+	// lines are lined up on, or "" or "center" to centre them
+	rtl   bool
+	align string
 }
 
-func createCaptionImage(caption string) string {
-	// This function creates an image with the caption text
-	captionImagePath := ""
-	// Create a new 1024x1024 image with a white background
-	imgWidth := 1024
-	imgHeight := 1024
-	img := image.NewRGBA(image.Rect(0, 0, imgWidth, imgHeight))
-	white := color.White
-	draw.Draw(img, img.Bounds(), &image.Uniform{white}, image.Point{}, draw.Src)
-
-	// Load the font
-	fontBytes, err := os.ReadFile("fonts/" + fontName)
-	if err != nil {
-		fmt.Println("Error loading font:", err)
-		return ""
-	}
-	f, err := freetype.ParseFont(fontBytes)
-	if err != nil {
-		fmt.Println("Error parsing font:", err)
-		return ""
-	}
-
-	// Initialize the context
-	c := freetype.NewContext()
-	c.SetDPI(72)
-	c.SetFont(f)
-	c.SetClip(img.Bounds())
-	c.SetDst(img)
-	c.SetSrc(image.Black) // Set text color
-
-	// Starting font size
-	fontSize := 48.0
-	minFontSize := 12.0
-	maxWidth := imgWidth - 40 // Allow some padding
+// height is how tall the laid out lines are, in pixels
+func (l TextLayout) height() int {
+	return l.lineHeight * len(l.lines)
+}
 
-	var lines []string
-	var totalTextHeight int
-	var face font.Face
-	var lineHeight int
-
-	// Adjust font size to fit text vertically
-	for fontSize >= minFontSize {
-		c.SetFontSize(fontSize)
-		face = truetype.NewFace(f, &truetype.Options{
-			Size: fontSize,
-		})
-		lines = wrapText(caption, face, maxWidth)
-		lineHeight = c.PointToFixed(fontSize * 1.5).Ceil() // Adjust line spacing
-		totalTextHeight = lineHeight * len(lines)
-		if totalTextHeight <= imgHeight-40 { // Allow some vertical padding
+// layoutText wraps text to maxWidth, shrinking it from maxFontSize until its
+// lines fit in maxHeight. Text which doesn't fit even at minFontSize is cut
+// short with an ellipsis after as many lines as fit.
+func layoutText(fonts FontChain, text string, maxWidth, maxHeight int, maxFontSize, minFontSize float64) TextLayout {
+	var layout TextLayout
+	rtl := paragraphIsRTL(text)
+	for fontSize := maxFontSize; fontSize >= minFontSize; fontSize -= 2 {
+		layout = TextLayout{
+			fonts:      fonts,
+			fontSize:   fontSize,
+			lines:      wrapText(text, fonts, fontSize, maxWidth),
+			lineHeight: int(math.Ceil(fontSize * 1.5)),
+			rtl:        rtl,
+		}
+		if layout.height() <= maxHeight {
 			break
 		}
-		fontSize -= 2 // Decrease font size and try again
 	}
-
-	if fontSize < minFontSize {
-		fmt.Println("Text is too long to fit into the image")
-		return ""
+	if layout.height() > maxHeight {
+		layout.lines = ellipsize(layout.lines, max(1, maxHeight/layout.lineHeight), fonts, layout.fontSize, maxWidth)
 	}
-
-	// Starting vertical position
-	y := (imgHeight - totalTextHeight) / 2
-
-	// Draw each line
-	for _, line := range lines {
-		textWidth := calcTextWidth(line, face)
-		x := (imgWidth - textWidth) / 2
-		pt := freetype.Pt(x, y+int(c.PointToFixed(fontSize)>>6))
-		_, err = c.DrawString(line, pt)
-		if err != nil {
-			fmt.Println("Error drawing text:", err)
-			return ""
-		}
-		y += lineHeight
+	for i, line := range layout.lines {
+		layout.lines[i] = displayLine(line, fonts, rtl)
 	}
+	return layout
+}
 
-	// Generate a short hash for the filename (implement your own generateShortHash)
-	hash := generateShortHash()
-	if hash == "" {
-		fmt.Println("Error generating file name")
-		return ""
+// drawTextLayout draws laid out lines in rect of img, clipped to rect. The
+// lines are centred unless the layout lines them up on the left or right edge,
+// though centred lines of right to left text are lined up on the right edge of
+// the block they make. Each character is drawn where the layout placed it, in
+// whichever font of the chain has it.
+func drawTextLayout(img *image.RGBA, rect image.Rectangle, layout TextLayout, textColor image.Image) error {
+	c := freetype.NewContext()
+	c.SetDPI(72)
+	c.SetFontSize(layout.fontSize)
+	c.SetClip(rect)
+	c.SetDst(img)
+	c.SetSrc(textColor)
+
+	placed := make([][]PlacedGlyph, len(layout.lines))
+	widths := make([]int, len(layout.lines))
+	blockWidth := 0
+	for i, line := range layout.lines {
+		glyphs, width := layout.fonts.place(line, layout.fontSize)
+		placed[i], widths[i] = glyphs, width.Ceil()
+		blockWidth = max(blockWidth, widths[i])
 	}
 
-	// Ensure the images directory exists
-	if _, err := os.Stat("images"); os.IsNotExist(err) {
-		err = os.Mkdir("images", os.ModePerm)
-		if err != nil {
-			fmt.Println("Error creating images directory")
-			return ""
+	y := rect.Min.Y + (rect.Dy()-layout.height())/2
+	for i, glyphs := range placed {
+		x := rect.Min.X + (rect.Dx()-widths[i])/2
+		switch {
+		case layout.align == "left":
+			x = rect.Min.X
+		case layout.align == "right":
+			x = rect.Max.X - widths[i]
+		case layout.rtl:
+			x = rect.Min.X + (rect.Dx()+blockWidth)/2 - widths[i]
+		}
+		start := freetype.Pt(x, y+int(layout.fontSize))
+		for _, glyph := range glyphs {
+			c.SetFont(layout.fonts[glyph.font].font)
+			pt := fixed.Point26_6{X: start.X + glyph.x, Y: start.Y}
+			if _, err := c.DrawString(string(glyph.char), pt); err != nil {
+				return fmt.Errorf("error drawing text: %v", err)
+			}
 		}
+		y += layout.lineHeight
 	}
+	return nil
+}
 
-	// Create the output file
-	captionImagePath = fmt.Sprintf("images/%s.png", hash)
-	outFile, err := os.Create(captionImagePath)
-	if err != nil {
-		fmt.Println("Unable to create the file for writing")
-		return ""
+// createCaptionImage draws a caption card the size of a GIF frame in theme,
+// with byline under the caption unless it is "". Caption frames only ever
+// end up inside GIFs, so they are never stored on their own.
+func createCaptionImage(caption, byline string, theme *CaptionTheme, fonts FontChain) (image.Image, error) {
+	img := image.NewRGBA(image.Rect(0, 0, drawingSize, drawingSize))
+	theme.drawBackground(img)
+	fonts = theme.fonts(fonts)
+	textColor := &image.Uniform{theme.textColor}
+
+	rect := img.Bounds().Inset(theme.Padding)
+	if byline != "" {
+		// the byline takes a single line at the bottom, at half the size
+		// captions start at
+		size := max(theme.MinFontSize, theme.MaxFontSize/2)
+		bylineLayout := layoutText(fonts, "— "+byline, rect.Dx(), int(math.Ceil(size*1.5)), size, size)
+		bylineLayout.align = theme.Align
+		bylineRect := image.Rect(rect.Min.X, rect.Max.Y-bylineLayout.height(), rect.Max.X, rect.Max.Y)
+		if err := drawTextLayout(img, bylineRect, bylineLayout, textColor); err != nil {
+			return nil, err
+		}
+		rect.Max.Y = bylineRect.Min.Y - theme.Padding
 	}
-	defer outFile.Close()
-
-	// Save the image in PNG format
-	err = png.Encode(outFile, img)
-	if err != nil {
-		fmt.Println("Error encoding image to PNG")
-		return ""
+	layout := layoutText(fonts, caption, rect.Dx(), rect.Dy(), theme.MaxFontSize, theme.MinFontSize)
+	layout.align = theme.Align
+	if err := drawTextLayout(img, rect, layout, textColor); err != nil {
+		return nil, err
 	}
-
-	return captionImagePath
+	return img, nil
 }
 
-func renameImage(oldPath, newPath string) error {
-	err := os.Rename(oldPath, newPath)
-	if err != nil {
-		return err
-	}
-	return nil
+// drawCaptionText lays text out centred in rect of img, wrapping it onto as
+// many lines as it needs and shrinking it from maxFontSize until it fits
+func drawCaptionText(img *image.RGBA, rect image.Rectangle, fonts FontChain, caption string, maxFontSize, minFontSize float64, textColor image.Image) error {
+	// allow some padding around the text
+	padding := min(40, rect.Dx()/8, rect.Dy()/8)
+	layout := layoutText(fonts, caption, rect.Dx()-padding, rect.Dy()-padding, maxFontSize, minFontSize)
+	return drawTextLayout(img, rect, layout, textColor)
 }
 
-func getNonSubmissionImagePath(captionOrDrawing string) string {
-	_imageName := nonSubmissionImageName_drawing
+// getNonSubmissionImage returns the placeholder shown for a missing caption
+// or drawing
+func getNonSubmissionImage(captionOrDrawing string, theme *CaptionTheme, fonts FontChain) (image.Image, error) {
 	_string := nonSubmissionString_drawing
 
 	if captionOrDrawing == "caption" {
-		_imageName = nonSubmissionImageName_caption
 		_string = nonSubmissionString_caption
 	} else if captionOrDrawing == "drawing" {
-		_imageName = nonSubmissionImageName_drawing
 		_string = nonSubmissionString_drawing
 	} else {
-		fmt.Println("Error: invalid argument for getNonSubmissionImagePath()")
-		return ""
+		return nil, fmt.Errorf("invalid argument for getNonSubmissionImage()")
 	}
 
-	imagePath := imagesDir + string(os.PathSeparator) + _imageName
-	if _, err := os.Stat(imagePath); os.IsNotExist(err) {
-		newImagePath := createCaptionImage(_string)
-		err := renameImage(newImagePath, imagePath)
-		if err != nil {
-			fmt.Println("Error renaming image:", err)
-			return ""
-		}
-	}
-
-	return imagePath
+	return createCaptionImage(_string, "", theme, fonts)
 }
 
-func createGif(drawings, captions []string) string {
+// renderChain builds the reveal animation of a chain in the job's format.
+// Captions get frames of their own or are overlaid on the drawings, following
+// the job's caption layout. Drawings which were submitted as strokes are
+// shown being drawn over replayDuration centiseconds, or less when the
+// chain's replays would run past maxChainReplayFrames between them, before the
+// finished drawing is held. It runs on a render worker, so it only uses what the job
+// was given and never the game state. The stored file comes back holding a
+// reference for finishRender to release.
+func renderChain(job *RenderJob) (string, error) {
+	exporter, ok := animationExporters[job.format]
+	if !ok {
+		return "", fmt.Errorf("unknown export format %q", job.format)
+	}
+
 	// Ensure the number of drawings and captions match
-	if len(drawings) != len(captions) {
-		fmt.Println("Error: number of drawings and captions do not match")
-		return ""
+	if len(job.drawingPaths) != len(job.captions) {
+		return "", fmt.Errorf("number of drawings and captions do not match")
 	}
 
-	var gifImages gif.GIF
+	animation := &Animation{}
+	frames := framePipeline()
+	overlay := job.captionLayout == "overlay"
 
-	for i := 0; i < len(drawings); i++ {
-		// Create caption image
-		caption := captions[i]
-		captionImagePath := ""
-		if caption == "" {
-			captionImagePath = getNonSubmissionImagePath("caption")
-		} else {
-			captionImagePath = createCaptionImage(captions[i])
-		}
-		if captionImagePath == "" {
-			fmt.Println("Error creating caption image")
-			return ""
+	// the replays share the chain's replay frames, so in a long chain each
+	// drawing is replayed faster
+	replayDuration, replays := job.replayDuration, 0
+	for _, strokes := range job.strokes {
+		if strokes != nil {
+			replays++
 		}
+	}
+	if replays > 0 {
+		replayDuration = min(replayDuration, maxChainReplayFrames/replays*strokeReplayFrameDelay)
+	}
 
-		// Load caption image
-		captionImg, err := loadImage(captionImagePath)
+	if job.pacing.titleCard {
+		titleImg, err := createCaptionImage(job.gameName+" - chain "+strconv.Itoa(job.chain+1), "", job.captionTheme, job.fonts)
 		if err != nil {
-			fmt.Println("Error loading caption image:", err)
-			return ""
+			return "", fmt.Errorf("error creating title card: %v", err)
 		}
+		if err := animation.Add(frames.process(titleImg), job.pacing.captionDuration); err != nil {
+			return "", err
+		}
+	}
 
-		// Convert to paletted image
-		captionPaletted := toPaletted(captionImg)
-
-		// Add to GIF frames with 3 seconds delay (300 units)
-		gifImages.Image = append(gifImages.Image, captionPaletted)
-		gifImages.Delay = append(gifImages.Delay, 300)
+	for i := 0; i < len(job.drawingPaths); i++ {
+		var err error
+		if !overlay {
+			// Create caption image
+			var captionImg image.Image
+			if job.captions[i] == "" {
+				captionImg, err = getNonSubmissionImage("caption", job.captionTheme, job.fonts)
+			} else {
+				byline := ""
+				if job.captionTheme.Byline {
+					byline = job.authors[i]
+				}
+				captionImg, err = createCaptionImage(job.captions[i], byline, job.captionTheme, job.fonts)
+			}
+			if err != nil {
+				return "", fmt.Errorf("error creating caption image: %v", err)
+			}
 
-		// Get drawing image path
-		drawingUrl := drawings[i]
-		if drawingUrl == "" {
-			drawingUrl = "/" + getNonSubmissionImagePath("drawing")
-			// The / is added to ensure the string is parsed correctly in the next step
-		}
-		drawingImagePath := parseImagePathFromUrl(drawingUrl)
-		if drawingImagePath == "" {
-			fmt.Println("Error parsing drawing image path")
-			return ""
+			if err := animation.Add(frames.process(captionImg), job.pacing.captionFrameDuration(job.captions[i])); err != nil {
+				return "", err
+			}
 		}
 
 		// Load drawing image
-		drawingImg, err := loadImage(drawingImagePath)
+		var drawingImg image.Image
+		if job.drawingPaths[i] != "" {
+			drawingImg, err = loadImage(job.drawingPaths[i])
+		} else {
+			drawingImg, err = getNonSubmissionImage("drawing", job.captionTheme, job.fonts)
+		}
 		if err != nil {
-			fmt.Println("Error loading drawing image:", err)
-			return ""
+			return "", fmt.Errorf("error loading drawing image: %v", err)
 		}
 
-		// Convert to paletted image
-		drawingPaletted := toPaletted(drawingImg)
+		// overlaid, a drawing carries the prompt it was drawn from above it
+		// and the caption guessed from it below, which the stroke replay
+		// leaves off so as not to give it away
+		prompt, guess := "", ""
+		if overlay {
+			prompt = overlayCaption(job.captions[i])
+			if i+1 < len(job.captions) {
+				guess = overlayCaption(job.captions[i+1])
+			}
+		}
 
-		// Add to GIF frames with 5 seconds delay (500 units)
-		gifImages.Image = append(gifImages.Image, drawingPaletted)
-		gifImages.Delay = append(gifImages.Delay, 500)
-	}
+		if job.strokes[i] != nil && replayDuration > 0 {
+			err = strokeReplayFrames(job.strokes[i], replayDuration, frames, func(replayFrame image.Image, delay int) error {
+				captioned, err := overlayCaptions(replayFrame, job.fonts, prompt, "")
+				if err != nil {
+					return fmt.Errorf("error overlaying captions: %v", err)
+				}
+				return animation.Add(captioned, delay)
+			})
+			if err != nil {
+				return "", err
+			}
+		}
 
-	// Ensure the gifs directory exists
-	if _, err := os.Stat("gifs"); os.IsNotExist(err) {
-		err = os.Mkdir("gifs", os.ModePerm)
+		drawingFrame, err := overlayCaptions(frames.process(drawingImg), job.fonts, prompt, guess)
 		if err != nil {
-			fmt.Println("Error creating gifs directory:", err)
-			return ""
+			return "", fmt.Errorf("error overlaying captions: %v", err)
+		}
+		drawingDuration := job.pacing.drawingDuration
+		if overlay {
+			drawingDuration = job.pacing.overlayFrameDuration(prompt, guess)
+		}
+		if err := animation.Add(drawingFrame, drawingDuration); err != nil {
+			return "", err
 		}
+		job.render.rendered.Add(1)
 	}
 
-	// Get the hash from the first drawing to name the GIF
-	firstDrawingImagePath := parseImagePathFromUrl(drawings[0])
-	gifHash := extractHashFromImagePath(firstDrawingImagePath)
-	gifFilePath := fmt.Sprintf("gifs/%s.gif", gifHash)
-
-	// Create the output file
-	outFile, err := os.Create(gifFilePath)
-	if err != nil {
-		fmt.Println("Unable to create the gif file for writing:", err)
-		return ""
+	if job.pacing.endCard {
+		endImg, err := createCaptionImage(endCardText(job.authors), "", job.captionTheme, job.fonts)
+		if err != nil {
+			return "", fmt.Errorf("error creating end card: %v", err)
+		}
+		if err := animation.Add(frames.process(endImg), job.pacing.captionDuration); err != nil {
+			return "", err
+		}
 	}
-	defer outFile.Close()
 
-	// Encode the GIF and write to file
-	err = gif.EncodeAll(outFile, &gifImages)
+	// Encode the animation and store it, named by its content
+	data, err := exporter.Encode(animation, job.pacing.loopCount)
 	if err != nil {
-		fmt.Println("Error encoding gif:", err)
-		return ""
+		return "", fmt.Errorf("error encoding %s: %v", job.format, err)
 	}
-	fmt.Println("GIF created successfully")
-	return gifFilePath
-}
-
-func createGifsFromGame(game *Game) []string {
-	// Create a GIF for each prompt drawing chain
-	var gifFilePaths []string
-	for i := 0; i <= len(game.prompts)-1; i++ {
-		// Get the prompt chain and the drawing chain
-		promptChain := game.prompts[i]
-		drawingChain := game.drawings[i]
-
-		// Create a GIF from the prompt chain
-		gifFilePath := createGif(drawingChain, promptChain)
-		if gifFilePath == "" {
-			fmt.Println("Error creating GIF from prompt chain")
-			continue
-		}
-		gifFilePath = baseUrl + "/" + gifFilePath
-		gifFilePaths = append(gifFilePaths, gifFilePath)
+	filePath, err := storeContent(exporter.Prefix(), exporter.Ext(), data)
+	if err != nil {
+		return "", fmt.Errorf("unable to store the %s: %v", job.format, err)
 	}
-
-	return gifFilePaths
+	return filePath, nil
 }
 
 // -An endpoint to end a game
@@ -1302,25 +1732,107 @@ func createGifsFromGame(game *Game) []string {
 // Routine for automatically progressing the game based on a configurable timer
 
 func main() {
-	http.HandleFunc("/createGame", createGame)
-	http.HandleFunc("/listGames", listGames)
-	http.HandleFunc("/listEndedGames", listEndedGames)
-	http.HandleFunc("/getGameState", getGameState)
-	http.HandleFunc("/getEndedGame", getEndedGame)
-	http.HandleFunc("/startGame", startGame)
-	http.HandleFunc("/endGame", endGame)
-	http.HandleFunc("/endRound", endRound)
-	http.HandleFunc("/checkAuthentication", checkAuthentication)
-	http.HandleFunc("/joinGame", joinGame)
-	http.HandleFunc("/submitPrompt", submitPrompt)
+	flag.StringVar(&promptPacksDir, "prompts-dir", promptPacksDir, "directory to load prompt packs from")
+	flag.StringVar(&fontsDir, "fonts-dir", fontsDir, "directory to load TrueType (.ttf) fonts from, which must include "+defaultFontName+".ttf")
+	flag.StringVar(&captionThemesDir, "themes-dir", captionThemesDir, "directory to load caption themes and their textures from")
+	fontFallbacks := flag.String("font-fallbacks", "", "comma separated fonts to try, in order, for characters a game's font lacks. The fonts shipped cover Latin, Greek and Cyrillic, so text in other scripts and emoji needs fonts such as Noto's added to -fonts-dir and named here (default every font, by name, monospaced fonts last)")
+	imageFit := flag.String("image-fit", uploadPipeline.mode, "how uploaded drawings are scaled: "+strings.Join(imageFitModes, ", "))
+	imageResampler := flag.String("image-resampler", "catmullrom", "resampling filter for scaling images: "+strings.Join(imageResamplerNames(), ", "))
+	imageBackground := flag.String("image-background", "#ffffff", "color behind transparent and letterboxed drawings")
+	imageMinSize := flag.Int("image-min-size", uploadPipeline.minDimension, "with -image-fit fit, the smallest a drawing's shortest side is scaled to")
+	imageMaxSize := flag.Int("image-max-size", uploadPipeline.maxDimension, "with -image-fit fit, the largest a drawing's longest side is scaled to")
+	storage := flag.String("storage", "local", "where images and GIFs are kept: local, memory or s3. Instances can share a store, with -storage-shared, but each keeps its own games in memory")
+	flag.BoolVar(&blobStoreShared, "storage-shared", blobStoreShared, "other instances keep images and GIFs in the same -storage-root or S3 bucket and prefix, so never delete any from it since they may still use them")
+	storageRoot := flag.String("storage-root", ".", "with -storage local, the directory images/ and gifs/ are kept in")
+	signedURLs := flag.Bool("signed-urls", false, "hand out signed image and GIF URLs which expire")
+	signedURLExpiry := flag.Duration("signed-url-expiry", time.Hour, "how long signed URLs stay valid")
+	s3Config := s3BlobStoreConfig{accessKey: os.Getenv("AWS_ACCESS_KEY_ID"), secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY")}
+	flag.StringVar(&s3Config.endpoint, "s3-endpoint", "", "S3 API endpoint, e.g. https://s3.us-east-1.amazonaws.com")
+	flag.StringVar(&s3Config.bucket, "s3-bucket", "", "S3 bucket to store images and GIFs in")
+	flag.StringVar(&s3Config.region, "s3-region", "us-east-1", "S3 region")
+	flag.StringVar(&s3Config.prefix, "s3-prefix", "", "prefix for every key in the S3 bucket")
+	flag.StringVar(&s3Config.publicURL, "s3-public-url", "", "URL clients fetch unsigned objects from, if not the bucket")
+	gifPaletteMethod := flag.String("gif-palette", gifPalette.method, "how GIF frames are reduced to 256 colors: "+strings.Join(gifPaletteMethods, ", "))
+	gifPaletteScope := flag.String("gif-palette-scope", gifPalette.scope, "with -gif-palette mediancut, build a palette for each frame or one for the whole GIF: "+strings.Join(gifPaletteScopes, ", "))
+	gifDither := flag.Bool("gif-dither", gifPalette.dither, "dither GIF frames, which suits photos better than flat line art")
+	flag.IntVar(&renderWorkers, "render-workers", renderWorkers, "how many GIFs are rendered at once")
+	retentionDays := flag.Int("retention-days", 30, "days ended games are kept unless starred, 0 keeps them forever")
+	flag.DurationVar(&uploadGracePeriod, "upload-grace", uploadGracePeriod, "how long uploads nobody submitted are kept")
+	flag.DurationVar(&janitorInterval, "janitor-interval", janitorInterval, "how often unused games, uploads and files are cleaned up")
+	flag.Parse()
+	if renderWorkers < 1 {
+		fmt.Println("Invalid render options: -render-workers must be at least 1")
+		os.Exit(1)
+	}
+	if *retentionDays < 0 || uploadGracePeriod < 0 || janitorInterval <= 0 {
+		fmt.Println("Invalid retention options: -retention-days and -upload-grace can't be negative and -janitor-interval must be positive")
+		os.Exit(1)
+	}
+	endedGameRetention = time.Duration(*retentionDays) * 24 * time.Hour
+	err := configureUploadPipeline(*imageFit, *imageResampler, *imageBackground, *imageMinSize, *imageMaxSize)
+	if err != nil {
+		fmt.Println("Invalid image options:", err)
+		os.Exit(1)
+	}
+	err = configureGifPalette(*gifPaletteMethod, *gifPaletteScope, *gifDither)
+	if err != nil {
+		fmt.Println("Invalid GIF options:", err)
+		os.Exit(1)
+	}
+	err = configureBlobStore(*storage, *storageRoot, *signedURLs, *signedURLExpiry, s3Config)
+	if err != nil {
+		fmt.Println("Invalid storage options:", err)
+		os.Exit(1)
+	}
+	fallbacks := []string{}
+	if *fontFallbacks != "" {
+		fallbacks = strings.Split(*fontFallbacks, ",")
+	}
+	if err := loadFonts(fontsDir, fallbacks); err != nil {
+		fmt.Println("Invalid font options:", err)
+		os.Exit(1)
+	}
+	loadCaptionThemes(captionThemesDir)
+	loadPromptPacks(promptPacksDir)
+
+	http.HandleFunc("/createGame", withStateLock(createGame))
+	http.HandleFunc("/listGames", withStateLock(listGames))
+	http.HandleFunc("/listEndedGames", withStateLock(listEndedGames))
+	http.HandleFunc("/getGameState", withStateLock(getGameState))
+	http.HandleFunc("/getEndedGame", withStateLock(getEndedGame))
+	http.HandleFunc("/startGame", withStateLock(startGame))
+	http.HandleFunc("/endGame", withStateLock(endGame))
+	http.HandleFunc("/endRound", withStateLock(endRound))
+	http.HandleFunc("/checkAuthentication", withStateLock(checkAuthentication))
+	http.HandleFunc("/joinGame", withStateLock(joinGame))
+	http.HandleFunc("/submitPrompt", withStateLock(submitPrompt))
+	http.HandleFunc("/submitVote", withStateLock(submitVote))
+	http.HandleFunc("/submitTeamVote", withStateLock(submitTeamVote))
+	http.HandleFunc("/rematch", withStateLock(rematch))
+	http.HandleFunc("/getPlayerMessage", withStateLock(getPlayerQueuedMessage))
+	http.HandleFunc("/listPromptPacks", withStateLock(listPromptPacks))
+	http.HandleFunc("/uploadPromptPack", withStateLock(uploadPromptPack))
+	http.HandleFunc("/listFonts", withStateLock(listFonts))
+	http.HandleFunc("/listCaptionThemes", withStateLock(listCaptionThemes))
+	http.HandleFunc("/retryRender", withStateLock(retryRender))
+	http.HandleFunc("/rerender", withStateLock(rerender))
+	http.HandleFunc("/janitor", withStateLock(runJanitorNow))
+	http.HandleFunc("/starEndedGame", withStateLock(starEndedGame))
+	// these take stateLock only to read and update the games, not while
+	// decoding, drawing or transferring files
 	http.HandleFunc("/submitDrawing", submitDrawing)
 	http.HandleFunc("/uploadDrawing", uploadDrawing)
-	http.HandleFunc("/getPlayerMessage", getPlayerQueuedMessage)
+	http.HandleFunc("/exportEndedGame", exportEndedGame)
+	http.HandleFunc("/importEndedGame", importEndedGame)
 
-	is := http.FileServer(http.Dir("images"))
-	http.Handle("/images/", http.StripPrefix("/images/", is))
 	// example: http://localhost:9119/images/12345678.png
-	gs := http.FileServer(http.Dir("gifs"))
-	http.Handle("/gifs/", http.StripPrefix("/gifs/", gs))
+	http.HandleFunc("/images/", serveBlob)
+	http.HandleFunc("/gifs/", serveBlob)
+	http.HandleFunc("/apngs/", serveBlob)
+	http.HandleFunc("/exports/", serveBlob)
+	go runJanitor()
+	for i := 0; i < renderWorkers; i++ {
+		go runRenderWorker()
+	}
 	http.ListenAndServe(":9119", nil)
 }
@@ -0,0 +1,70 @@
+package main
+
+var (
+	drawFirstStartMessage = "{\"status\": \"OK\", \"message\":\"Draw anything you like!\",\"prompt\":\"Draw anything you like!\"}"
+	freeDrawingPrompt     = "Free drawing!"
+	defaultGameMode       = "classic"
+)
+
+// GameMode decides which phase a round opens with and what players are asked
+// to do when the game starts. The phase logic in _endRound and
+// progressGameIfReady consults the game's mode rather than assuming that
+// every round begins with a prompt.
+type GameMode interface {
+	// Name is the identifier clients pass as gameMode to createGame
+	Name() string
+	// StartMessage is queued for every player when the game starts
+	StartMessage() string
+	// OpensWithDrawing reports whether the given round skips its prompt phase
+	// and goes straight to drawing
+	OpensWithDrawing(round int) bool
+	// SkippedPrompt is written into the prompt slot of every chain for a round
+	// which opens with drawing, so the reveal still has a caption to show
+	SkippedPrompt() string
+}
+
+// classicMode is the original prompt -> drawing -> caption -> drawing chain
+type classicMode struct{}
+
+func (classicMode) Name() string                    { return "classic" }
+func (classicMode) StartMessage() string            { return gameStartedMessage }
+func (classicMode) OpensWithDrawing(round int) bool { return false }
+func (classicMode) SkippedPrompt() string           { return "" }
+
+// drawFirstMode has everyone draw freely in the first round, after which the
+// chain alternates caption -> drawing
+type drawFirstMode struct{}
+
+func (drawFirstMode) Name() string                    { return "drawFirst" }
+func (drawFirstMode) StartMessage() string            { return drawFirstStartMessage }
+func (drawFirstMode) OpensWithDrawing(round int) bool { return round == 0 }
+func (drawFirstMode) SkippedPrompt() string           { return freeDrawingPrompt }
+
+var gameModes = map[string]GameMode{
+	classicMode{}.Name():   classicMode{},
+	drawFirstMode{}.Name(): drawFirstMode{},
+}
+
+// getGameMode looks up a mode by name, falling back to the classic mode when
+// no name is given. The second return value is false for unknown names.
+func getGameMode(modeName string) (GameMode, bool) {
+	if modeName == "" {
+		modeName = defaultGameMode
+	}
+	mode, ok := gameModes[modeName]
+	return mode, ok
+}
+
+// openRound moves the game into the first phase of its current round. Rounds
+// which open with drawing have their prompt slots filled in with the mode's
+// placeholder so progressGameIfReady only waits on drawings.
+func openRound(game *Game) {
+	if !game.mode.OpensWithDrawing(game.currentRound) {
+		game.promptsSet = false
+		return
+	}
+	for i := range game.prompts {
+		game.prompts[i][game.currentRound] = game.mode.SkippedPrompt()
+	}
+	game.promptsSet = true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+var (
+	// how captions appear in reveal animations. "frames" shows each caption
+	// on a frame of its own before the drawing made from it, and "overlay"
+	// shows them as banners on the drawings instead.
+	captionLayouts       = []string{"frames", "overlay"}
+	defaultCaptionLayout = "frames"
+	// banners grow to fit their caption, up to a quarter of the frame
+	bannerMaxHeightRatio = 4
+	bannerPadding        = 16
+	bannerMaxFontSize    = 40.0
+	bannerMinFontSize    = 20.0
+	// banners are tinted to match what they cover so they sit lightly on the
+	// drawing, but are opaque enough that the text always stands out
+	bannerLightTint = color.NRGBA{255, 255, 255, 200}
+	bannerDarkTint  = color.NRGBA{0, 0, 0, 170}
+)
+
+func isCaptionLayout(layout string) bool {
+	for _, l := range captionLayouts {
+		if l == layout {
+			return true
+		}
+	}
+	return false
+}
+
+func captionLayoutError() string {
+	return "captionLayout must be one of " + strings.Join(captionLayouts, ", ")
+}
+
+// averageLuminance measures how light rect of img is on average, from 0 for
+// black to 1 for white
+func averageLuminance(img *image.RGBA, rect image.Rectangle) float64 {
+	rect = rect.Intersect(img.Bounds())
+	if rect.Empty() {
+		return 1
+	}
+	total := 0.0
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(rect.Min.X, y):img.PixOffset(rect.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			total += 0.299*float64(row[i]) + 0.587*float64(row[i+1]) + 0.114*float64(row[i+2])
+		}
+	}
+	return total / 255 / float64(rect.Dx()*rect.Dy())
+}
+
+// drawBanner lays caption out across the top or bottom of a frame, on a band
+// just tall enough to hold it. Captions too long for the largest banner are
+// cut short with an ellipsis.
+func drawBanner(frame *image.RGBA, fonts FontChain, caption string, atTop bool) error {
+	bounds := frame.Bounds()
+	maxHeight := bounds.Dy() / bannerMaxHeightRatio
+	layout := layoutText(fonts, caption, bounds.Dx()-2*bannerPadding, maxHeight-2*bannerPadding, bannerMaxFontSize, bannerMinFontSize)
+	height := min(maxHeight, layout.height()+2*bannerPadding)
+
+	band := image.Rect(bounds.Min.X, bounds.Max.Y-height, bounds.Max.X, bounds.Max.Y)
+	if atTop {
+		band = image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Min.Y+height)
+	}
+	tint, textColor := bannerLightTint, image.Black
+	if averageLuminance(frame, band) < 0.5 {
+		tint, textColor = bannerDarkTint, image.White
+	}
+	draw.Draw(frame, band, &image.Uniform{tint}, image.Point{}, draw.Over)
+	return drawTextLayout(frame, band.Inset(bannerPadding/2), layout, textColor)
+}
+
+// overlayCaptions puts prompt in a banner across the top of a drawing frame
+// and guess in one across the bottom. Either is left off when it is "".
+func overlayCaptions(frame image.Image, fonts FontChain, prompt, guess string) (image.Image, error) {
+	img := toRGBA(frame)
+	if prompt != "" {
+		if err := drawBanner(img, fonts, prompt, true); err != nil {
+			return nil, err
+		}
+	}
+	if guess != "" {
+		if err := drawBanner(img, fonts, guess, false); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
+
+// overlayCaption is the banner text for a caption, which is the placeholder
+// when nobody wrote one
+func overlayCaption(caption string) string {
+	if caption == "" {
+		return nonSubmissionString_caption
+	}
+	return caption
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	defaultCaptionDurationPerChar = 4
+	defaultMaxCaptionDuration     = 1000
+	// the longest any frame can be shown, in centiseconds
+	maxFrameDuration = 6000
+	maxLoopCount     = 1000
+)
+
+// RevealPacing is how the reveal animations of a game are timed. It is chosen
+// when the game is created and kept with the ended game, so re-rendering
+// gives the same animations unless it is changed.
+type RevealPacing struct {
+	// how long caption and drawing frames are shown, in centiseconds
+	captionDuration int
+	drawingDuration int
+	// added to captionDuration for each character of a caption, up to
+	// maxCaptionDuration in all, so longer captions stay up for longer
+	captionDurationPerChar int
+	maxCaptionDuration     int
+	// how many times the animation plays, or 0 to loop forever
+	loopCount int
+	// whether the animation opens with a card naming the game and chain, and
+	// closes with one naming who made it
+	titleCard bool
+	endCard   bool
+}
+
+func defaultRevealPacing() RevealPacing {
+	return RevealPacing{
+		captionDuration:        defaultCaptionDuration,
+		drawingDuration:        defaultDrawingDuration,
+		captionDurationPerChar: defaultCaptionDurationPerChar,
+		maxCaptionDuration:     defaultMaxCaptionDuration,
+	}
+}
+
+// parseRevealPacing reads the pacing fields of a request body, keeping the
+// settings of pacing for any which aren't given
+func parseRevealPacing(bodyObj map[string]string, pacing RevealPacing) (RevealPacing, error) {
+	ints := []struct {
+		field string
+		value *int
+	}{
+		{"captionDuration", &pacing.captionDuration},
+		{"drawingDuration", &pacing.drawingDuration},
+		{"captionDurationPerChar", &pacing.captionDurationPerChar},
+		{"maxCaptionDuration", &pacing.maxCaptionDuration},
+		{"loopCount", &pacing.loopCount},
+	}
+	for _, setting := range ints {
+		if bodyObj[setting.field] == "" {
+			continue
+		}
+		value, err := strconv.Atoi(bodyObj[setting.field])
+		if err != nil {
+			return pacing, fmt.Errorf("%s must be an integer", setting.field)
+		}
+		*setting.value = value
+	}
+	bools := []struct {
+		field string
+		value *bool
+	}{
+		{"titleCard", &pacing.titleCard},
+		{"endCard", &pacing.endCard},
+	}
+	for _, setting := range bools {
+		if bodyObj[setting.field] == "" {
+			continue
+		}
+		value, err := strconv.ParseBool(bodyObj[setting.field])
+		if err != nil {
+			return pacing, fmt.Errorf("%s must be true or false", setting.field)
+		}
+		*setting.value = value
+	}
+	return pacing, pacing.validate()
+}
+
+func (p RevealPacing) validate() error {
+	if p.captionDuration < 1 || p.captionDuration > maxFrameDuration {
+		return fmt.Errorf("captionDuration must be between 1 and %d centiseconds", maxFrameDuration)
+	}
+	if p.drawingDuration < 1 || p.drawingDuration > maxFrameDuration {
+		return fmt.Errorf("drawingDuration must be between 1 and %d centiseconds", maxFrameDuration)
+	}
+	if p.captionDurationPerChar < 0 || p.captionDurationPerChar > maxFrameDuration {
+		return fmt.Errorf("captionDurationPerChar must be between 0 and %d centiseconds", maxFrameDuration)
+	}
+	if p.maxCaptionDuration < 0 || p.maxCaptionDuration > maxFrameDuration {
+		return fmt.Errorf("maxCaptionDuration must be between 0 and %d centiseconds", maxFrameDuration)
+	}
+	if p.loopCount < 0 || p.loopCount > maxLoopCount {
+		return fmt.Errorf("loopCount must be between 0 and %d", maxLoopCount)
+	}
+	return nil
+}
+
+// captionFrameDuration is how long a caption is shown. It never drops below
+// captionDuration, even if maxCaptionDuration is lower.
+func (p RevealPacing) captionFrameDuration(caption string) int {
+	duration := p.captionDuration + p.captionDurationPerChar*utf8.RuneCountInString(caption)
+	return max(p.captionDuration, min(duration, p.maxCaptionDuration))
+}
+
+// overlayFrameDuration is how long a drawing with its captions overlaid is
+// shown: drawingDuration, or as long as either caption would be shown on its
+// own if that is longer. Each caption is overlaid twice, as a guess and then
+// as the next prompt, so the times aren't added together.
+func (p RevealPacing) overlayFrameDuration(prompt, guess string) int {
+	duration := max(p.drawingDuration, p.captionFrameDuration(prompt))
+	if guess != "" {
+		duration = max(duration, p.captionFrameDuration(guess))
+	}
+	return duration
+}
+
+// endCardText credits everyone who made a chain, in the order they joined in
+func endCardText(authors []string) string {
+	names := []string{}
+	seen := make(map[string]bool)
+	for _, author := range authors {
+		if author != "" && !seen[author] {
+			seen[author] = true
+			names = append(names, author)
+		}
+	}
+	if len(names) == 0 {
+		return "The end"
+	}
+	return "The end - made by " + strings.Join(names, ", ")
+}
+
+func revealPacingToJSON(p RevealPacing) string {
+	pacingJson := "{\"captionDuration\": " + strconv.Itoa(p.captionDuration) + ","
+	pacingJson += "\"drawingDuration\": " + strconv.Itoa(p.drawingDuration) + ","
+	pacingJson += "\"captionDurationPerChar\": " + strconv.Itoa(p.captionDurationPerChar) + ","
+	pacingJson += "\"maxCaptionDuration\": " + strconv.Itoa(p.maxCaptionDuration) + ","
+	pacingJson += "\"loopCount\": " + strconv.Itoa(p.loopCount) + ","
+	pacingJson += "\"titleCard\": " + strconv.FormatBool(p.titleCard) + ","
+	pacingJson += "\"endCard\": " + strconv.FormatBool(p.endCard) + "}"
+	return pacingJson
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"sort"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+var (
+	gifPaletteMethods = []string{"mediancut", "plan9"}
+	gifPaletteScopes  = []string{"frame", "gif"}
+	// how reveal GIF frames are reduced to 256 colors, set from the command
+	// line in main()
+	gifPalette = PaletteOptions{method: "mediancut", scope: "frame", dither: true}
+	// at most this many pixels of each frame are sampled to build a palette
+	maxPaletteSamples = 250000
+)
+
+// PaletteOptions says how full color frames become paletted GIF frames.
+//
+//   - "mediancut" builds a palette from the colors the frames actually use,
+//     repeatedly splitting the most populous box of colors along its widest
+//     channel. With scope "frame" each frame gets its own palette, and with
+//     "gif" one palette is shared by every frame of the GIF, which makes the
+//     file smaller but costs colors when frames differ a lot.
+//   - "plan9" maps every frame onto the fixed Plan 9 palette, as the server
+//     always used to.
+//
+// Dithering spreads the error of each pixel onto its neighbours, which
+// smooths gradients in photos but adds speckle to flat line art. Pixels which
+// are mostly transparent get a transparent palette entry of their own.
+type PaletteOptions struct {
+	method string
+	scope  string
+	dither bool
+}
+
+func isGifPaletteMethod(method string) bool {
+	for _, m := range gifPaletteMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func isGifPaletteScope(scope string) bool {
+	for _, s := range gifPaletteScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// configureGifPalette sets up gifPalette from the command line flags
+func configureGifPalette(method, scope string, dither bool) error {
+	if !isGifPaletteMethod(method) {
+		return fmt.Errorf("GIF palette must be one of %s", strings.Join(gifPaletteMethods, ", "))
+	}
+	if !isGifPaletteScope(scope) {
+		return fmt.Errorf("GIF palette scope must be one of %s", strings.Join(gifPaletteScopes, ", "))
+	}
+	gifPalette = PaletteOptions{method: method, scope: scope, dither: dither}
+	return nil
+}
+
+// colorHistogram counts colors at 5 bits per channel, keeping the sum of the
+// full colors in each bin so the palette can use their true average
+type colorHistogram struct {
+	counts [32768]int
+	sums   [32768][3]int
+	// whether any pixel was mostly transparent
+	transparent bool
+}
+
+func histogramBin(r, g, b uint8) int {
+	return int(r>>3)<<10 | int(g>>3)<<5 | int(b>>3)
+}
+
+// toRGBA returns img as an *image.RGBA starting at the origin, copying it only
+// if it isn't one already
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	return rgba
+}
+
+// add samples img into the histogram. Colors are alpha-premultiplied, so
+// opaque pixels are counted as they are and mostly transparent ones are
+// left to the transparent entry.
+func (h *colorHistogram) add(img *image.RGBA) {
+	pixels := len(img.Pix) / 4
+	step := max(1, pixels/maxPaletteSamples)
+	for i := 0; i < pixels; i++ {
+		p := img.Pix[i*4 : i*4+4]
+		if p[3] < 128 {
+			h.transparent = true
+			continue
+		}
+		if i%step != 0 {
+			continue
+		}
+		bin := histogramBin(p[0], p[1], p[2])
+		h.counts[bin]++
+		h.sums[bin][0] += int(p[0])
+		h.sums[bin][1] += int(p[1])
+		h.sums[bin][2] += int(p[2])
+	}
+}
+
+// colorBox is a set of histogram bins which becomes one palette entry
+type colorBox struct {
+	bins  []int
+	count int
+}
+
+// widestChannel returns the channel (0 red, 1 green, 2 blue) the box spans
+// the most of, and how far it spans
+func (b *colorBox) widestChannel() (int, int) {
+	lo := [3]int{31, 31, 31}
+	hi := [3]int{0, 0, 0}
+	for _, bin := range b.bins {
+		for c, v := range [3]int{bin >> 10, bin >> 5 & 31, bin & 31} {
+			lo[c] = min(lo[c], v)
+			hi[c] = max(hi[c], v)
+		}
+	}
+	channel := 0
+	for c := 1; c < 3; c++ {
+		if hi[c]-lo[c] > hi[channel]-lo[channel] {
+			channel = c
+		}
+	}
+	return channel, hi[channel] - lo[channel]
+}
+
+// medianCut builds a palette of at most size colors from the histogram
+func (h *colorHistogram) medianCut(size int) color.Palette {
+	all := colorBox{}
+	for bin, count := range h.counts {
+		if count > 0 {
+			all.bins = append(all.bins, bin)
+			all.count += count
+		}
+	}
+	boxes := []colorBox{}
+	if len(all.bins) > 0 {
+		boxes = append(boxes, all)
+	}
+	for len(boxes) < size {
+		// split the box holding the most pixels, weighted by how spread out
+		// its colors are, so large smooth areas like skin get more shades
+		best, bestScore := -1, 0
+		for i := range boxes {
+			if len(boxes[i].bins) < 2 {
+				continue
+			}
+			_, spread := boxes[i].widestChannel()
+			if score := boxes[i].count * (spread + 1); score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best < 0 {
+			break
+		}
+		box := boxes[best]
+		channel, _ := box.widestChannel()
+		shift := uint(10 - 5*channel)
+		sort.Slice(box.bins, func(i, j int) bool {
+			return box.bins[i]>>shift&31 < box.bins[j]>>shift&31
+		})
+		split, seen := 1, h.counts[box.bins[0]]
+		for split < len(box.bins)-1 && seen+h.counts[box.bins[split]] <= box.count/2 {
+			seen += h.counts[box.bins[split]]
+			split++
+		}
+		boxes[best] = colorBox{bins: box.bins[:split], count: seen}
+		boxes = append(boxes, colorBox{bins: box.bins[split:], count: box.count - seen})
+	}
+
+	colors := color.Palette{}
+	for _, box := range boxes {
+		var sum [3]int
+		for _, bin := range box.bins {
+			sum[0] += h.sums[bin][0]
+			sum[1] += h.sums[bin][1]
+			sum[2] += h.sums[bin][2]
+		}
+		colors = append(colors, color.RGBA{uint8(sum[0] / box.count), uint8(sum[1] / box.count), uint8(sum[2] / box.count), 255})
+	}
+	if len(colors) == 0 {
+		colors = append(colors, color.RGBA{0, 0, 0, 255})
+	}
+	return colors
+}
+
+// palette makes a palette for the colors counted in the histogram. A
+// transparent entry comes first if any of them need it.
+func (h *colorHistogram) palette(options PaletteOptions) color.Palette {
+	size := 256
+	colors := color.Palette{}
+	if h.transparent {
+		colors = append(colors, color.RGBA{})
+		size--
+	}
+	if options.method == "plan9" {
+		if h.transparent {
+			// make room by dropping the darkest blue, keeping black and white
+			return append(append(colors, palette.Plan9[0]), palette.Plan9[2:]...)
+		}
+		return append(colors, palette.Plan9...)
+	}
+	return append(colors, h.medianCut(size)...)
+}
+
+// mapToPalette converts a frame to the palette, dithering it if asked to
+func mapToPalette(frame *image.RGBA, colors color.Palette, dither bool) *image.Paletted {
+	paletted := image.NewPaletted(frame.Bounds(), colors)
+	if dither {
+		draw.FloydSteinberg.Draw(paletted, frame.Bounds(), frame, frame.Bounds().Min)
+		return paletted
+	}
+	transparent := -1
+	if _, _, _, a := colors[0].RGBA(); a == 0 {
+		transparent = 0
+	}
+	// without dithering neighbouring pixels are independent, so the nearest
+	// entry only needs finding once for each histogram bin
+	var nearest [32768]int16
+	for i := range nearest {
+		nearest[i] = -1
+	}
+	for i := 0; i < len(paletted.Pix); i++ {
+		p := frame.Pix[i*4 : i*4+4]
+		if p[3] < 128 && transparent >= 0 {
+			paletted.Pix[i] = uint8(transparent)
+			continue
+		}
+		bin := histogramBin(p[0], p[1], p[2])
+		if nearest[bin] < 0 {
+			nearest[bin] = int16(colors.Index(color.RGBA{p[0], p[1], p[2], 255}))
+		}
+		paletted.Pix[i] = uint8(nearest[bin])
+	}
+	return paletted
+}
+
+// quantizeAnimation turns the animation's frames into GIF frames, with how
+// each is disposed of. A frame drawn over the one before it only holds the
+// part which changed. With scope "gif" the shared palette is returned as
+// well, to go in the GIF's global color table.
+func quantizeAnimation(animation *Animation, options PaletteOptions) ([]*image.Paletted, []byte, color.Palette) {
+	var shared color.Palette
+	if options.scope == "gif" && options.method != "plan9" {
+		histogram := &colorHistogram{}
+		animation.replay(func(canvas *image.RGBA, changed image.Rectangle, frame animationFrame) error {
+			histogram.add(canvas)
+			return nil
+		})
+		shared = histogram.palette(options)
+	} else if options.method == "plan9" {
+		// the fixed palette only depends on whether a frame is transparent
+		histogram := &colorHistogram{}
+		for _, frame := range animation.frames {
+			histogram.transparent = histogram.transparent || frame.transparent
+		}
+		shared = histogram.palette(options)
+	}
+
+	paletted := []*image.Paletted{}
+	disposals := []byte{}
+	animation.replay(func(canvas *image.RGBA, changed image.Rectangle, frame animationFrame) error {
+		rect := canvas.Bounds()
+		if len(disposals) > 0 && disposals[len(disposals)-1] == gif.DisposalNone && !frame.transparent {
+			rect = changed
+			if rect.Empty() {
+				// nothing changed, so a single pixel stands in for the frame
+				rect = image.Rect(0, 0, 1, 1)
+			}
+		}
+		region := image.NewRGBA(rect)
+		draw.Draw(region, rect, canvas, rect.Min, draw.Src)
+		colors := shared
+		if colors == nil {
+			histogram := &colorHistogram{}
+			histogram.add(region)
+			colors = histogram.palette(options)
+		}
+		paletted = append(paletted, mapToPalette(region, colors, options.dither))
+		// clear transparent frames before the next one, rather than letting
+		// the previous frame show through
+		disposal := byte(gif.DisposalNone)
+		if _, _, _, a := colors[0].RGBA(); a == 0 {
+			disposal = gif.DisposalBackground
+		}
+		disposals = append(disposals, disposal)
+		return nil
+	})
+	if options.scope != "gif" {
+		return paletted, disposals, nil
+	}
+	return paletted, disposals, shared
+}
+
+// encodeGif quantizes the animation and encodes it as a GIF which plays
+// loopCount times, or forever if loopCount is 0
+func encodeGif(animation *Animation, loopCount int, options PaletteOptions) ([]byte, error) {
+	if len(animation.frames) == 0 {
+		return nil, fmt.Errorf("a GIF needs at least one frame")
+	}
+	paletted, disposals, shared := quantizeAnimation(animation, options)
+	delays := make([]int, len(animation.frames))
+	for i, frame := range animation.frames {
+		delays[i] = frame.delay
+	}
+	bounds := paletted[0].Bounds()
+	encoded := gif.GIF{
+		Image:    paletted,
+		Delay:    delays,
+		Disposal: disposals,
+		Config:   image.Config{Width: bounds.Dx(), Height: bounds.Dy()},
+	}
+	// a GIF's loop count is how many times it repeats after playing once,
+	// with -1 for not repeating at all
+	if loopCount > 0 {
+		encoded.LoopCount = loopCount - 1
+		if loopCount == 1 {
+			encoded.LoopCount = -1
+		}
+	}
+	if shared != nil {
+		encoded.Config.ColorModel = shared
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, &encoded); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"math"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+// benchmarkFrames makes stand-ins for drawings, letterboxed onto GIF frames:
+// a soft gradient like a photo, and flat line art
+func benchmarkFrames() []image.Image {
+	gradient := image.NewRGBA(image.Rect(0, 0, drawingSize, drawingSize))
+	for y := 0; y < drawingSize; y++ {
+		for x := 0; x < drawingSize; x++ {
+			dx, dy := float64(x-drawingSize/2), float64(y-drawingSize/2)
+			t := math.Min(1, math.Sqrt(dx*dx+dy*dy)/float64(drawingSize/2))
+			gradient.SetRGBA(x, y, color.RGBA{uint8(240 - 90*t), uint8(190 - 110*t), uint8(160 - 120*t), 255})
+		}
+	}
+	lineArt := image.NewRGBA(image.Rect(0, 0, drawingSize, drawingSize))
+	draw.Draw(lineArt, lineArt.Bounds(), &image.Uniform{drawingBackground}, image.Point{}, draw.Src)
+	for i := 0; i < 12; i++ {
+		offset := 60 + i*75
+		draw.Draw(lineArt, image.Rect(offset, 40, offset+6, drawingSize-40), &image.Uniform{color.RGBA{0, 0, 0, 255}}, image.Point{}, draw.Src)
+		draw.Draw(lineArt, image.Rect(40, offset, drawingSize-40, offset+6), &image.Uniform{color.RGBA{200, 30, 30, 255}}, image.Point{}, draw.Src)
+	}
+	pipeline := framePipeline()
+	return []image.Image{pipeline.process(gradient), pipeline.process(lineArt)}
+}
+
+// meanError is how far the GIF's frames are from the originals, as the mean
+// difference per color channel out of 255. A GIF frame may only cover the
+// part of the original which changed.
+func meanError(frames []image.Image, paletted []*image.Paletted) float64 {
+	total, samples := 0.0, 0
+	for i, frame := range frames {
+		original := toRGBA(frame)
+		rect := paletted[i].Bounds()
+		for j, index := range paletted[i].Pix {
+			r, g, b, _ := paletted[i].Palette[index].RGBA()
+			p := original.Pix[original.PixOffset(rect.Min.X+j%rect.Dx(), rect.Min.Y+j/rect.Dx()):]
+			total += math.Abs(float64(r>>8)-float64(p[0])) + math.Abs(float64(g>>8)-float64(p[1])) + math.Abs(float64(b>>8)-float64(p[2]))
+			samples += 3
+		}
+	}
+	return total / float64(samples)
+}
+
+// benchmarkEncodeGif encodes the stand-in frames with options, reporting the
+// size of the GIF and how far its colors are from the frames'
+func benchmarkEncodeGif(b *testing.B, options PaletteOptions) {
+	frames := benchmarkFrames()
+	animation := &Animation{}
+	for _, frame := range frames {
+		if err := animation.Add(frame, 500); err != nil {
+			b.Fatal(err)
+		}
+	}
+	var data []byte
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		data, err = encodeGif(animation, 0, options)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	decoded, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(len(data)), "bytes/gif")
+	b.ReportMetric(meanError(frames, decoded.Image), "error/channel")
+}
+
+// plan9 with dithering is how GIFs were made before adaptive palettes
+func BenchmarkEncodeGifPlan9Dither(b *testing.B) {
+	benchmarkEncodeGif(b, PaletteOptions{method: "plan9", scope: "frame", dither: true})
+}
+
+func BenchmarkEncodeGifPlan9(b *testing.B) {
+	benchmarkEncodeGif(b, PaletteOptions{method: "plan9", scope: "frame", dither: false})
+}
+
+func BenchmarkEncodeGifMedianCutFrameDither(b *testing.B) {
+	benchmarkEncodeGif(b, PaletteOptions{method: "mediancut", scope: "frame", dither: true})
+}
+
+func BenchmarkEncodeGifMedianCutFrame(b *testing.B) {
+	benchmarkEncodeGif(b, PaletteOptions{method: "mediancut", scope: "frame", dither: false})
+}
+
+func BenchmarkEncodeGifMedianCutGlobalDither(b *testing.B) {
+	benchmarkEncodeGif(b, PaletteOptions{method: "mediancut", scope: "gif", dither: true})
+}
+
+func BenchmarkEncodeGifMedianCutGlobal(b *testing.B) {
+	benchmarkEncodeGif(b, PaletteOptions{method: "mediancut", scope: "gif", dither: false})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/math/fixed"
+)
+
+// PDFWriter builds a PDF file object by object. Objects are numbered as they
+// are reserved, so they can refer to each other before they are written.
+type PDFWriter struct {
+	buf bytes.Buffer
+	// where each object starts in the file, indexed by object number
+	offsets []int
+}
+
+func newPDFWriter() *PDFWriter {
+	p := &PDFWriter{offsets: []int{0}}
+	// the binary comment tells tools the file isn't plain text
+	p.buf.WriteString("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n")
+	return p
+}
+
+// reserve numbers an object to be written later
+func (p *PDFWriter) reserve() int {
+	p.offsets = append(p.offsets, 0)
+	return len(p.offsets) - 1
+}
+
+func (p *PDFWriter) writeObject(id int, object string) {
+	p.offsets[id] = p.buf.Len()
+	fmt.Fprintf(&p.buf, "%d 0 obj\n%s\nendobj\n", id, object)
+}
+
+// writeStream writes an object holding data, with the entries of dict added
+// to its dictionary
+func (p *PDFWriter) writeStream(id int, dict string, data []byte) {
+	p.offsets[id] = p.buf.Len()
+	fmt.Fprintf(&p.buf, "%d 0 obj\n<<%s /Length %d>>\nstream\n", id, dict, len(data))
+	p.buf.Write(data)
+	p.buf.WriteString("\nendstream\nendobj\n")
+}
+
+// finish writes the cross-reference table and trailer and returns the file
+func (p *PDFWriter) finish(root, info int) []byte {
+	xref := p.buf.Len()
+	fmt.Fprintf(&p.buf, "xref\n0 %d\n0000000000 65535 f \n", len(p.offsets))
+	for _, offset := range p.offsets[1:] {
+		fmt.Fprintf(&p.buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&p.buf, "trailer\n<</Size %d /Root %d 0 R /Info %d 0 R>>\nstartxref\n%d\n%%%%EOF\n", len(p.offsets), root, info, xref)
+	return p.buf.Bytes()
+}
+
+// deflate compresses a stream for /FlateDecode
+func deflate(data []byte) []byte {
+	var buf bytes.Buffer
+	writer := zlib.NewWriter(&buf)
+	writer.Write(data)
+	writer.Close()
+	return buf.Bytes()
+}
+
+// pdfString encodes text as a PDF text string, in UTF-16 so that any
+// character survives
+func pdfString(text string) string {
+	var b strings.Builder
+	b.WriteString("<FEFF")
+	for _, unit := range utf16.Encode([]rune(text)) {
+		fmt.Fprintf(&b, "%04X", unit)
+	}
+	b.WriteString(">")
+	return b.String()
+}
+
+// PDFFont embeds a TrueType font in a PDF. Text is written as glyph indexes
+// rather than in an encoding, so every glyph the font has can be shown.
+type PDFFont struct {
+	name       string
+	source     *LoadedFont
+	font       *truetype.Font
+	data       []byte
+	unitsPerEm int32
+	// the glyphs shown so far, and the character each one stands for so
+	// that text copied out of the PDF comes out right
+	used map[truetype.Index]rune
+}
+
+func newPDFFont(f *LoadedFont) *PDFFont {
+	return &PDFFont{
+		name:       pdfName(f.name),
+		source:     f,
+		font:       f.font,
+		data:       f.data,
+		unitsPerEm: f.font.FUnitsPerEm(),
+		used:       make(map[truetype.Index]rune),
+	}
+}
+
+// pdfName turns a font's name into a PDF name, replacing anything but
+// letters, digits, hyphens and underscores, which would need escaping
+func pdfName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// units converts a measurement in font units to thousandths of an em, which
+// is what PDF font metrics are given in
+func (f *PDFFont) units(v int32) int {
+	return int(v) * 1000 / int(f.unitsPerEm)
+}
+
+func (f *PDFFont) glyphAdvance(index truetype.Index) int32 {
+	return int32(f.font.HMetric(fixed.Int26_6(f.unitsPerEm), index).AdvanceWidth)
+}
+
+// show gives text as an array for the TJ operator, kerned as the font says.
+// Kerning is given in thousandths of an em, moving the next glyph back.
+func (f *PDFFont) show(text string) string {
+	var b strings.Builder
+	b.WriteString("[<")
+	prev, hasPrev := truetype.Index(0), false
+	for _, r := range text {
+		index := f.font.Index(r)
+		if _, ok := f.used[index]; !ok {
+			f.used[index] = r
+		}
+		if hasPrev {
+			if kern := f.units(int32(f.source.kern(fixed.Int26_6(f.unitsPerEm), prev, index))); kern != 0 {
+				fmt.Fprintf(&b, "> %d <", -kern)
+			}
+		}
+		fmt.Fprintf(&b, "%04X", index)
+		prev, hasPrev = index, true
+	}
+	b.WriteString(">]")
+	return b.String()
+}
+
+// write embeds the font as the reserved object id. It must be called after
+// all the text has been encoded, as only the widths of glyphs which were
+// used are written.
+func (f *PDFFont) write(p *PDFWriter, id int) {
+	descendantId := p.reserve()
+	descriptorId := p.reserve()
+	fileId := p.reserve()
+	toUnicodeId := p.reserve()
+
+	glyphs := []truetype.Index{}
+	for index := range f.used {
+		glyphs = append(glyphs, index)
+	}
+	sort.Slice(glyphs, func(i, j int) bool { return glyphs[i] < glyphs[j] })
+
+	p.writeObject(id, fmt.Sprintf("<</Type /Font /Subtype /Type0 /BaseFont /%s /Encoding /Identity-H /DescendantFonts [%d 0 R] /ToUnicode %d 0 R>>", f.name, descendantId, toUnicodeId))
+
+	var widths strings.Builder
+	for _, index := range glyphs {
+		fmt.Fprintf(&widths, "%d [%d] ", index, f.units(f.glyphAdvance(index)))
+	}
+	p.writeObject(descendantId, fmt.Sprintf("<</Type /Font /Subtype /CIDFontType2 /BaseFont /%s /CIDSystemInfo <</Registry (Adobe) /Ordering (Identity) /Supplement 0>> /FontDescriptor %d 0 R /CIDToGIDMap /Identity /W [%s]>>", f.name, descriptorId, widths.String()))
+
+	bounds := f.font.Bounds(fixed.Int26_6(f.unitsPerEm))
+	ascent, descent := f.units(int32(bounds.Max.Y)), f.units(int32(bounds.Min.Y))
+	p.writeObject(descriptorId, fmt.Sprintf("<</Type /FontDescriptor /FontName /%s /Flags 32 /FontBBox [%d %d %d %d] /ItalicAngle 0 /Ascent %d /Descent %d /CapHeight %d /StemV 80 /FontFile2 %d 0 R>>",
+		f.name, f.units(int32(bounds.Min.X)), descent, f.units(int32(bounds.Max.X)), ascent, ascent, descent, ascent, fileId))
+	p.writeStream(fileId, fmt.Sprintf("/Filter /FlateDecode /Length1 %d", len(f.data)), deflate(f.data))
+
+	var cmap strings.Builder
+	cmap.WriteString("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n")
+	cmap.WriteString("/CIDSystemInfo <</Registry (Adobe) /Ordering (UCS) /Supplement 0>> def\n")
+	cmap.WriteString("/CMapName /Adobe-Identity-UCS def\n/CMapType 2 def\n")
+	cmap.WriteString("1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n")
+	// a bfchar block holds at most 100 entries
+	for start := 0; start < len(glyphs); start += 100 {
+		block := glyphs[start:min(start+100, len(glyphs))]
+		fmt.Fprintf(&cmap, "%d beginbfchar\n", len(block))
+		for _, index := range block {
+			fmt.Fprintf(&cmap, "<%04X> <", index)
+			for _, unit := range utf16.Encode([]rune{f.used[index]}) {
+				fmt.Fprintf(&cmap, "%04X", unit)
+			}
+			cmap.WriteString(">\n")
+		}
+		cmap.WriteString("endbfchar\n")
+	}
+	cmap.WriteString("endcmap\nCMapName currentdict /CMap defineresource pop\nend\nend\n")
+	p.writeStream(toUnicodeId, "/Filter /FlateDecode", deflate([]byte(cmap.String())))
+}
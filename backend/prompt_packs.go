@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	promptPacksDir        = "prompts"
+	adminSecret           = os.Getenv("PT_ADMIN_SECRET")
+	promptPacks           = make(map[string]*PromptPack)
+	startingPromptOptions = []string{"assign", "choose", "fill"}
+	promptChoiceCount     = 3
+	choosePromptMessage   = "{\"status\": \"OK\", \"message\":\"Pick a starting prompt!\",\"startPrompt\":\"Pick a starting prompt!\""
+)
+
+// PromptPack is a named list of starting prompts, loaded from a JSON or YAML
+// file in promptPacksDir or uploaded through /uploadPromptPack
+type PromptPack struct {
+	Name    string   `json:"name" yaml:"name"`
+	Prompts []string `json:"prompts" yaml:"prompts"`
+}
+
+// parsePromptPack decodes a pack from JSON or YAML depending on the file
+// extension. Blank and repeated entries are dropped so that drawing from a
+// pack never hands out the same prompt twice.
+func parsePromptPack(fileName string, data []byte) (*PromptPack, error) {
+	pack := &PromptPack{}
+	var err error
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		err = json.Unmarshal(data, pack)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, pack)
+	default:
+		return nil, fmt.Errorf("unsupported prompt pack extension %q", filepath.Ext(fileName))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if pack.Name == "" {
+		pack.Name = strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+	}
+
+	seen := make(map[string]bool)
+	prompts := []string{}
+	for _, prompt := range pack.Prompts {
+		prompt = strings.TrimSpace(prompt)
+		if prompt == "" || seen[prompt] {
+			continue
+		}
+		if utf8.RuneCountInString(prompt) > maxPromptLength {
+			return nil, fmt.Errorf("prompt pack %q has a prompt longer than %d characters", pack.Name, maxPromptLength)
+		}
+		seen[prompt] = true
+		prompts = append(prompts, prompt)
+	}
+	if len(prompts) == 0 {
+		return nil, fmt.Errorf("prompt pack %q has no prompts", pack.Name)
+	}
+	pack.Prompts = prompts
+	return pack, nil
+}
+
+func loadPromptPacks(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("Error reading prompt packs directory:", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			fmt.Println("Error reading prompt pack:", err)
+			continue
+		}
+		pack, err := parsePromptPack(entry.Name(), data)
+		if err != nil {
+			fmt.Println("Error parsing prompt pack "+entry.Name()+":", err)
+			continue
+		}
+		promptPacks[pack.Name] = pack
+	}
+	fmt.Println("Loaded", len(promptPacks), "prompt packs")
+}
+
+func isStartingPromptOption(option string) bool {
+	for _, o := range startingPromptOptions {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// drawPackPrompt returns a random prompt from the game's pack which has not
+// yet been handed out in this game, or "" once the pack is exhausted
+func drawPackPrompt(game *Game) string {
+	if game.promptPack == nil {
+		return ""
+	}
+	remaining := []string{}
+	for _, prompt := range game.promptPack.Prompts {
+		if !game.usedPackPrompts[prompt] {
+			remaining = append(remaining, prompt)
+		}
+	}
+	if len(remaining) == 0 {
+		return ""
+	}
+	prompt := remaining[mrand.Intn(len(remaining))]
+	game.usedPackPrompts[prompt] = true
+	return prompt
+}
+
+// packPromptsNeeded is how many distinct pack entries startGame must be able
+// to hand out for the game's starting prompt option. With "fill" nobody may
+// submit a prompt, which takes an entry for every seat.
+func packPromptsNeeded(game *Game) int {
+	switch game.startingPrompts {
+	case "assign", "fill":
+		return seatCount(game)
+	case "choose":
+		return seatCount(game) * promptChoiceCount
+	}
+	return 0
+}
+
+// applyStartingPrompts runs when the game starts. "assign" fills in every
+// player's first prompt and moves straight on to drawing, "choose" offers
+// each player a few pack entries to pick from, and "fill" waits for the
+// prompt round to end (see fillMissingStartingPrompts).
+func applyStartingPrompts(game *Game) {
+	if game.promptPack == nil || game.mode.OpensWithDrawing(0) {
+		return
+	}
+	switch game.startingPrompts {
+	case "assign":
+		for i := range game.teams {
+			game.prompts[i][0] = drawPackPrompt(game)
+		}
+		progressGameIfReady(game)
+	case "choose":
+		for _, team := range game.teams {
+			choices := []string{}
+			for len(choices) < promptChoiceCount {
+				choices = append(choices, drawPackPrompt(game))
+			}
+			game.promptChoices[team.teamName] = choices
+			queueTeamMessage(team, choosePromptMessage+",\"promptChoices\": "+jsonStringList(choices)+"}")
+		}
+	}
+}
+
+// fillMissingStartingPrompts is called as the first prompt round ends. Teams
+// who were offered choices but never picked get their first choice, and with
+// the "fill" option anyone who didn't submit gets a fresh pack entry.
+func fillMissingStartingPrompts(game *Game) {
+	if game.promptPack == nil || game.currentRound != 0 {
+		return
+	}
+	for i, team := range game.teams {
+		if game.prompts[i][0] != "" {
+			continue
+		}
+		switch game.startingPrompts {
+		case "choose":
+			game.prompts[i][0] = game.promptChoices[team.teamName][0]
+		case "fill":
+			game.prompts[i][0] = drawPackPrompt(game)
+		}
+	}
+}
+
+// isPromptChoice reports whether prompt is one of the choices the team was
+// offered, for games which use the "choose" starting prompt option
+func isPromptChoice(game *Game, teamName, prompt string) bool {
+	for _, choice := range game.promptChoices[teamName] {
+		if choice == prompt {
+			return true
+		}
+	}
+	return false
+}
+
+func listPromptPacks(w http.ResponseWriter, r *http.Request) {
+	allowCors(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if r.Method == "GET" {
+		responseStr := "{\"status\":\"OK\", \"promptPacks\": ["
+		for name, pack := range promptPacks {
+			responseStr += "{\"name\": " + jsonString(name) + ", \"prompts\": " + fmt.Sprint(len(pack.Prompts)) + "},"
+		}
+		if len(promptPacks) > 0 {
+			responseStr = responseStr[:len(responseStr)-1]
+		}
+		responseStr += "]}"
+		fmt.Fprint(w, responseStr)
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// An admin endpoint which adds or replaces a prompt pack. The pack is saved to
+// promptPacksDir so that it is loaded again when the server restarts.
+func uploadPromptPack(w http.ResponseWriter, r *http.Request) {
+	allowCors(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if r.Method == "POST" {
+		err := r.ParseMultipartForm(1 << 20)
+		if err != nil {
+			http.Error(w, "Error parsing multipart form", http.StatusBadRequest)
+			return
+		}
+		if adminSecret == "" || r.FormValue("adminSecret") != adminSecret {
+			http.Error(w, "Admin not authenticated", http.StatusUnauthorized)
+			return
+		}
+
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Error retrieving the file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		data, err := io.ReadAll(file)
+		if err != nil {
+			http.Error(w, "Error reading the file", http.StatusBadRequest)
+			return
+		}
+		pack, err := parsePromptPack(header.Filename, data)
+		if err != nil {
+			http.Error(w, "Error parsing prompt pack: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if _, err := os.Stat(promptPacksDir); os.IsNotExist(err) {
+			err = os.Mkdir(promptPacksDir, os.ModePerm)
+			if err != nil {
+				http.Error(w, "Error creating prompt packs directory", http.StatusInternalServerError)
+				return
+			}
+		}
+		packJson, err := json.MarshalIndent(pack, "", "  ")
+		if err != nil {
+			http.Error(w, "Error encoding prompt pack", http.StatusInternalServerError)
+			return
+		}
+		packFileName := strings.NewReplacer("/", "_", "\\", "_", "..", "_").Replace(pack.Name) + ".json"
+		err = os.WriteFile(filepath.Join(promptPacksDir, packFileName), packJson, 0644)
+		if err != nil {
+			http.Error(w, "Unable to save the prompt pack", http.StatusInternalServerError)
+			return
+		}
+		promptPacks[pack.Name] = pack
+
+		responseStr := "{\"status\": \"OK\", \"message\": \"Prompt pack uploaded\", \"name\": " + jsonString(pack.Name) + ", \"prompts\": " + fmt.Sprint(len(pack.Prompts)) + "}"
+		fmt.Fprint(w, responseStr)
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
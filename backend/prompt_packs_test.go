@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestFillNeedsAPromptForEverySeat(t *testing.T) {
+	game := &Game{startingPrompts: "fill", usedPackPrompts: make(map[string]bool)}
+	for _, name := range []string{"p1", "p2", "p3"} {
+		player := &Player{playerName: name}
+		game.players = append(game.players, player)
+		game.teams = append(game.teams, &Team{teamName: name, members: []*Player{player}})
+		game.prompts = append(game.prompts, []string{""})
+	}
+	game.promptPack = &PromptPack{Prompts: []string{"a cat", "a hat"}}
+	if needed := packPromptsNeeded(game); len(game.promptPack.Prompts) >= needed {
+		t.Fatalf("a pack of %d prompts is enough for %d seats, needing %d", len(game.promptPack.Prompts), len(game.players), needed)
+	}
+
+	// nobody submitted a prompt, and the pack has one for everyone
+	game.promptPack.Prompts = append(game.promptPack.Prompts, "a bat")
+	if needed := packPromptsNeeded(game); len(game.promptPack.Prompts) < needed {
+		t.Fatalf("a pack of %d prompts isn't enough for %d seats, needing %d", len(game.promptPack.Prompts), len(game.players), needed)
+	}
+	fillMissingStartingPrompts(game)
+	for i, prompts := range game.prompts {
+		if prompts[0] == "" {
+			t.Errorf("seat %d was left without a prompt", i)
+		}
+	}
+}
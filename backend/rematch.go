@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+var rematchAvailableMessage = "{\"status\": \"OK\", \"message\":\"A rematch is available!\""
+
+// gameSeries lists the ids of the ended games in the same series of rematches
+// as endedGame, oldest first
+func gameSeries(endedGame *EndedGame) []string {
+	// imported games can link up in a loop, so each game is only visited once
+	seen := map[string]bool{endedGame.gameId: true}
+	first := endedGame
+	for first.previousGameId != "" && !seen[first.previousGameId] {
+		previous, ok := endedGames[first.previousGameId]
+		if !ok {
+			break
+		}
+		seen[previous.gameId] = true
+		first = previous
+	}
+	series := []string{}
+	inSeries := map[string]bool{}
+	for game := first; game != nil && !inSeries[game.gameId]; {
+		series = append(series, game.gameId)
+		inSeries[game.gameId] = true
+		next, ok := endedGames[game.nextGameId]
+		if !ok {
+			break
+		}
+		game = next
+	}
+	return series
+}
+
+func inRunningGame(playerName string) bool {
+	for _, game := range games {
+		if getPlayerIndex(playerName, game) != -1 {
+			return true
+		}
+	}
+	return false
+}
+
+// rematchGameName names a rematch after the first game of its series, numbered
+// by its place in the series and kept unique among the running games
+func rematchGameName(endedGame *EndedGame) string {
+	series := gameSeries(endedGame)
+	baseName := endedGames[series[0]].gameName
+	number := len(series) + 1
+	gameName := fmt.Sprintf("%s #%d", baseName, number)
+	for {
+		if _, ok := games[gameName]; !ok {
+			return gameName
+		}
+		number++
+		gameName = fmt.Sprintf("%s #%d", baseName, number)
+	}
+}
+
+// An endpoint for a player of an ended game to set up a rematch with the same
+// settings. Everyone who played is sent an invite to join the new game.
+func rematch(w http.ResponseWriter, r *http.Request) {
+	allowCors(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if r.Method == "POST" {
+		bodyObj := parseBodyObject(r)
+		playerName := bodyObj["playerName"]
+		playerSecret := bodyObj["playerSecret"]
+
+		if !authenticatePlayer(playerName, playerSecret) {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Player not authenticated\"}"
+			fmt.Fprintf(w, responseStr)
+			return
+		}
+		endedGame, ok := endedGames[bodyObj["gameId"]]
+		if !ok {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Game not found\"}"
+			fmt.Fprintf(w, responseStr)
+			return
+		}
+		playedInGame := false
+		for _, name := range endedGame.players {
+			if name == playerName {
+				playedInGame = true
+			}
+		}
+		if !playedInGame {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Player did not play in this game\"}"
+			fmt.Fprintf(w, responseStr)
+			return
+		}
+
+		// a second request for the same rematch points at the game already created
+		if endedGame.nextGameId != "" {
+			for _, game := range games {
+				if game.gameId == endedGame.nextGameId {
+					responseStr := "{\"status\": \"OK\", \"message\": \"Rematch already created\", \"gameName\": " + jsonString(game.gameName) + "}"
+					fmt.Fprintf(w, responseStr)
+					return
+				}
+			}
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"This game has already been rematched\"}"
+			fmt.Fprintf(w, responseStr)
+			return
+		}
+
+		mode, ok := getGameMode(endedGame.gameMode)
+		if !ok {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Unknown gameMode " + endedGame.gameMode + "\"}"
+			fmt.Fprintf(w, responseStr)
+			return
+		}
+		var promptPack *PromptPack
+		if endedGame.promptPack != "" {
+			promptPack, ok = promptPacks[endedGame.promptPack]
+			if !ok {
+				responseStr := "{\"status\": \"ERROR\", \"message\": \"Prompt pack " + endedGame.promptPack + " is no longer available\"}"
+				fmt.Fprintf(w, responseStr)
+				return
+			}
+		}
+
+		game := newGame(rematchGameName(endedGame), playerName, endedGame.roundTimer, endedGame.totalRounds, mode)
+		game.promptPack = promptPack
+		game.startingPrompts = endedGame.startingPrompts
+		game.teamSize = endedGame.teamSize
+		game.teamSubmission = endedGame.teamSubmission
+		game.replayDuration = endedGame.replayDuration
+		game.exportFormat = endedGame.exportFormat
+		game.pacing = endedGame.pacing
+		game.captionLayout = endedGame.captionLayout
+		game.font = endedGame.font
+		game.captionTheme = endedGame.captionTheme
+		game.previousGameId = endedGame.gameId
+		games[game.gameName] = game
+		endedGame.nextGameId = game.gameId
+
+		// players who have already moved on to another running game keep the
+		// messages for that game
+		for _, name := range endedGame.players {
+			if p, ok := players[name]; ok && !inRunningGame(name) {
+				p.queuedMessage = rematchAvailableMessage + ",\"rematchGameName\": " + jsonString(game.gameName) + ",\"previousGameId\": \"" + endedGame.gameId + "\"}"
+			}
+		}
+
+		responseStr := "{\"status\": \"OK\", \"message\": \"Rematch created\", \"gameName\": " + jsonString(game.gameName) + "}"
+		fmt.Fprintf(w, responseStr)
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
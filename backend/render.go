@@ -0,0 +1,441 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// each worker holds every frame of the GIF it is building, so the default
+	// stays small on machines with many cores
+	renderWorkers = min(runtime.NumCPU(), 4)
+	renderQueue   = newRenderQueue()
+)
+
+// ChainRender tracks the export of one chain of an ended game in one format.
+// Apart from rendered, which the worker counts up as it goes, it is only
+// touched holding stateLock.
+type ChainRender struct {
+	// pending, rendering, done or failed
+	status string
+	// the blob key of the finished file
+	file     string
+	err      string
+	attempts int
+	// how many of the chain's entries have been drawn
+	rendered atomic.Int32
+	total    int
+}
+
+// RenderJob is everything a worker needs to render a chain, copied out of the
+// game state so the worker never has to read it
+type RenderJob struct {
+	gameId   string
+	gameName string
+	chain    int
+	format   string
+	render   *ChainRender
+	// the blob key of each drawing, or "" where nobody submitted one
+	drawingPaths []string
+	captions     []string
+	strokes      []*StrokeDrawing
+	// who made each entry, for the end card
+	authors       []string
+	pacing        RevealPacing
+	captionLayout string
+	fonts         FontChain
+	captionTheme  *CaptionTheme
+	// how long each stroke replay takes, in centiseconds
+	replayDuration int
+}
+
+// RenderQueue hands render jobs to the workers in the order they were queued.
+// It never blocks whoever queues a job, so a game can end while holding
+// stateLock however many GIFs are waiting.
+type RenderQueue struct {
+	mu    sync.Mutex
+	ready *sync.Cond
+	jobs  []*RenderJob
+}
+
+func newRenderQueue() *RenderQueue {
+	queue := &RenderQueue{}
+	queue.ready = sync.NewCond(&queue.mu)
+	return queue
+}
+
+func (q *RenderQueue) push(job *RenderJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.jobs = append(q.jobs, job)
+	q.ready.Signal()
+}
+
+// pop waits for a job and takes it off the queue
+func (q *RenderQueue) pop() *RenderJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.jobs) == 0 {
+		q.ready.Wait()
+	}
+	job := q.jobs[0]
+	q.jobs = q.jobs[1:]
+	return job
+}
+
+// newRenderJob snapshots a chain of an ended game for rendering. Must be
+// called holding stateLock.
+func newRenderJob(endedGame *EndedGame, format string, chain int) *RenderJob {
+	job := &RenderJob{
+		gameId:         endedGame.gameId,
+		gameName:       endedGame.gameName,
+		chain:          chain,
+		format:         format,
+		render:         endedGame.renders[format][chain],
+		captions:       endedGame.prompts[chain],
+		pacing:         endedGame.pacing,
+		captionLayout:  endedGame.captionLayout,
+		fonts:          fontChain(endedGame.font),
+		captionTheme:   captionTheme(endedGame.captionTheme),
+		replayDuration: endedGame.replayDuration,
+	}
+	for round, imageId := range endedGame.drawings[chain] {
+		path := ""
+		if registered, ok := imageRegistry[imageId]; ok {
+			path = registered.path
+		}
+		job.drawingPaths = append(job.drawingPaths, path)
+		job.strokes = append(job.strokes, endedGame.strokes[imageId])
+		job.authors = append(job.authors, teamEntryAuthor(endedGame.teams, chain, round))
+	}
+	return job
+}
+
+// queueRender puts a chain back to pending and queues it. Must be called
+// holding stateLock.
+func queueRender(endedGame *EndedGame, format string, chain int) {
+	render := endedGame.renders[format][chain]
+	render.status = "pending"
+	render.err = ""
+	render.rendered.Store(0)
+	renderQueue.push(newRenderJob(endedGame, format, chain))
+}
+
+// queueGameRenders sets up and queues an export of every chain of a game in
+// the format, unless that has already been done. Must be called holding
+// stateLock.
+func queueGameRenders(endedGame *EndedGame, format string) {
+	if _, ok := endedGame.renders[format]; ok {
+		return
+	}
+	endedGame.renders[format] = make([]*ChainRender, len(endedGame.prompts))
+	for i := range endedGame.prompts {
+		endedGame.renders[format][i] = &ChainRender{total: len(endedGame.prompts[i])}
+		queueRender(endedGame, format, i)
+	}
+}
+
+// jobRenders finds the renders of the game a job was queued for: an ended
+// game's, or those of a game whose players are voting on its reveal. Must be
+// called holding stateLock.
+func jobRenders(job *RenderJob) (map[string][]*ChainRender, bool) {
+	if endedGame, ok := endedGames[job.gameId]; ok {
+		return endedGame.renders, true
+	}
+	if game, ok := games[job.gameName]; ok && game.gameId == job.gameId && game.renders != nil {
+		return game.renders, true
+	}
+	return nil, false
+}
+
+// runRenderWorker renders queued exports for as long as the server runs
+func runRenderWorker() {
+	for {
+		job := renderQueue.pop()
+		stateLock.Lock()
+		if renders, ok := jobRenders(job); !ok || renders[job.format][job.chain] != job.render {
+			// the game was cleaned up or re-rendered while the job waited
+			stateLock.Unlock()
+			continue
+		}
+		job.render.status = "rendering"
+		job.render.attempts++
+		stateLock.Unlock()
+
+		filePath, err := renderChain(job)
+
+		stateLock.Lock()
+		finishRender(job, filePath, err)
+		stateLock.Unlock()
+	}
+}
+
+// finishRender records how a job went. Must be called holding stateLock.
+func finishRender(job *RenderJob, filePath string, err error) {
+	if err == nil {
+		// renderChain stored the file holding a reference to it, which is
+		// dropped once the render has one of its own
+		defer releaseBlob(filePath)
+	}
+	if renders, ok := jobRenders(job); !ok || renders[job.format][job.chain] != job.render {
+		// the game was cleaned up while it was being rendered
+		return
+	}
+	if err != nil {
+		fmt.Println("Error creating", job.format, "for game", job.gameId, "chain", job.chain, ":", err)
+		job.render.status = "failed"
+		job.render.err = err.Error()
+		return
+	}
+	fmt.Println("Created", job.format, "for game", job.gameId, "chain", job.chain)
+	job.render.status = "done"
+	job.render.file = filePath
+	retainBlob(filePath)
+}
+
+// renderStatus sums up the renders of a game: done once every chain is, failed
+// once nothing is left to try but something failed, pending until a worker
+// picks the first one up, and rendering in between
+func renderStatus(renders []*ChainRender) string {
+	counts := map[string]int{}
+	for _, render := range renders {
+		counts[render.status]++
+	}
+	switch {
+	case counts["done"] == len(renders):
+		return "done"
+	case counts["pending"]+counts["rendering"] == 0:
+		return "failed"
+	case counts["pending"] == len(renders):
+		return "pending"
+	default:
+		return "rendering"
+	}
+}
+
+// renderedURLs lists the URLs of the finished files, leaving out any which
+// aren't ready
+func renderedURLs(renders []*ChainRender, baseURL string) []string {
+	urls := []string{}
+	for _, render := range renders {
+		if render.file != "" {
+			urls = append(urls, blobStore.URL(render.file, baseURL))
+		}
+	}
+	return urls
+}
+
+func rendersToJSON(renders []*ChainRender, baseURL string) string {
+	rendersJson := "["
+	for i, render := range renders {
+		fileURL := ""
+		if render.file != "" {
+			fileURL = blobStore.URL(render.file, baseURL)
+		}
+		rendersJson += "{\"chain\": " + strconv.Itoa(i) + ", \"status\": \"" + render.status + "\""
+		rendersJson += ", \"rendered\": " + strconv.Itoa(int(render.rendered.Load())) + ", \"total\": " + strconv.Itoa(render.total)
+		rendersJson += ", \"attempts\": " + strconv.Itoa(render.attempts) + ", \"error\": " + jsonString(render.err)
+		rendersJson += ", \"url\": " + jsonString(fileURL) + "}"
+		if i < len(renders)-1 {
+			rendersJson += ","
+		}
+	}
+	return rendersJson + "]"
+}
+
+func playedInEndedGame(endedGame *EndedGame, playerName string) bool {
+	for _, name := range endedGame.players {
+		if name == playerName {
+			return true
+		}
+	}
+	return false
+}
+
+// An endpoint for a player of an ended game to retry the exports which failed
+// to render. format and chain narrow it down to one format or one chain,
+// otherwise every failed one is retried.
+func retryRender(w http.ResponseWriter, r *http.Request) {
+	allowCors(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if r.Method == "POST" {
+		bodyObj := parseBodyObject(r)
+		playerName := bodyObj["playerName"]
+		playerSecret := bodyObj["playerSecret"]
+
+		if !authenticatePlayer(playerName, playerSecret) {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Player not authenticated\"}"
+			fmt.Fprint(w, responseStr)
+			return
+		}
+		endedGame, ok := endedGames[bodyObj["gameId"]]
+		if !ok {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Game not found\"}"
+			fmt.Fprint(w, responseStr)
+			return
+		}
+		if !playedInEndedGame(endedGame, playerName) {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Player did not play in this game\"}"
+			fmt.Fprint(w, responseStr)
+			return
+		}
+
+		formats := []string{}
+		for _, format := range exportFormats {
+			if _, ok := endedGame.renders[format]; ok && (bodyObj["format"] == "" || bodyObj["format"] == format) {
+				formats = append(formats, format)
+			}
+		}
+		if bodyObj["format"] != "" && len(formats) == 0 {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Nothing has been rendered in that format\"}"
+			fmt.Fprint(w, responseStr)
+			return
+		}
+
+		retried := []string{}
+		for _, format := range formats {
+			renders := endedGame.renders[format]
+			chains := []int{}
+			if bodyObj["chain"] != "" {
+				chain, err := strconv.Atoi(bodyObj["chain"])
+				if err != nil || chain < 0 || chain >= len(renders) {
+					responseStr := "{\"status\": \"ERROR\", \"message\": \"Invalid chain\"}"
+					fmt.Fprint(w, responseStr)
+					return
+				}
+				if renders[chain].status == "failed" {
+					chains = append(chains, chain)
+				}
+			} else {
+				for i, render := range renders {
+					if render.status == "failed" {
+						chains = append(chains, i)
+					}
+				}
+			}
+			for _, chain := range chains {
+				queueRender(endedGame, format, chain)
+				retried = append(retried, "{\"format\": \""+format+"\", \"chain\": "+strconv.Itoa(chain)+"}")
+			}
+		}
+		if len(retried) == 0 {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Only failed renders can be retried\"}"
+			fmt.Fprint(w, responseStr)
+			return
+		}
+		responseStr := "{\"status\": \"OK\", \"message\": \"Retrying " + strconv.Itoa(len(retried)) + " renders\", \"retried\": [" + strings.Join(retried, ",") + "]}"
+		fmt.Fprint(w, responseStr)
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// An endpoint for a player of an ended game to change how its reveal
+// animations are paced and laid out, the font they are set in or the theme of
+// their caption cards, and render them all again. Settings which aren't given
+// are kept, and the new ones are kept with the game so later renders match.
+func rerender(w http.ResponseWriter, r *http.Request) {
+	allowCors(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if r.Method == "POST" {
+		bodyObj := parseBodyObject(r)
+		playerName := bodyObj["playerName"]
+		playerSecret := bodyObj["playerSecret"]
+
+		if !authenticatePlayer(playerName, playerSecret) {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Player not authenticated\"}"
+			fmt.Fprint(w, responseStr)
+			return
+		}
+		endedGame, ok := endedGames[bodyObj["gameId"]]
+		if !ok {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Game not found\"}"
+			fmt.Fprint(w, responseStr)
+			return
+		}
+		if !playedInEndedGame(endedGame, playerName) {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Player did not play in this game\"}"
+			fmt.Fprint(w, responseStr)
+			return
+		}
+		pacing, err := parseRevealPacing(bodyObj, endedGame.pacing)
+		if err != nil {
+			fmt.Fprint(w, "{\"status\": \"ERROR\", \"message\": "+jsonString(err.Error())+"}")
+			return
+		}
+		captionLayout := endedGame.captionLayout
+		if bodyObj["captionLayout"] != "" {
+			if !isCaptionLayout(bodyObj["captionLayout"]) {
+				responseStr := "{\"status\": \"ERROR\", \"message\": \"" + captionLayoutError() + "\"}"
+				fmt.Fprint(w, responseStr)
+				return
+			}
+			captionLayout = bodyObj["captionLayout"]
+		}
+		font := endedGame.font
+		if bodyObj["font"] != "" {
+			if _, ok := loadedFonts[bodyObj["font"]]; !ok {
+				fmt.Fprint(w, "{\"status\": \"ERROR\", \"message\": "+jsonString("Unknown font "+bodyObj["font"])+"}")
+				return
+			}
+			font = bodyObj["font"]
+		}
+		theme := endedGame.captionTheme
+		if bodyObj["captionTheme"] != "" {
+			if _, ok := captionThemes[bodyObj["captionTheme"]]; !ok {
+				fmt.Fprint(w, "{\"status\": \"ERROR\", \"message\": "+jsonString("Unknown captionTheme "+bodyObj["captionTheme"])+"}")
+				return
+			}
+			theme = bodyObj["captionTheme"]
+		}
+		replayDuration := endedGame.replayDuration
+		if bodyObj["replaySeconds"] != "" {
+			replaySeconds, err := parseReplaySeconds(bodyObj["replaySeconds"])
+			if err != nil {
+				fmt.Fprint(w, "{\"status\": \"ERROR\", \"message\": "+jsonString(err.Error())+"}")
+				return
+			}
+			replayDuration = replaySeconds * 100
+		}
+
+		endedGame.pacing = pacing
+		endedGame.captionLayout = captionLayout
+		endedGame.captionTheme = theme
+		endedGame.replayDuration = replayDuration
+		if font != endedGame.font {
+			// storyboards, posters and booklets are set in the font too, so
+			// they are drawn again the next time they are asked for
+			for kind, key := range endedGame.exports {
+				releaseBlob(key)
+				delete(endedGame.exports, kind)
+			}
+			endedGame.font = font
+		}
+		count := 0
+		for format, renders := range endedGame.renders {
+			// fresh renders replace the old ones, so any job still working on
+			// an old one is thrown away when it finishes
+			for chain, render := range renders {
+				if render.file != "" {
+					releaseBlob(render.file)
+				}
+				renders[chain] = &ChainRender{total: render.total}
+				queueRender(endedGame, format, chain)
+				count++
+			}
+		}
+		responseStr := "{\"status\": \"OK\", \"message\": \"Re-rendering " + strconv.Itoa(count) + " animations\", \"pacing\": " + revealPacingToJSON(pacing) + ", \"captionLayout\": \"" + captionLayout + "\", \"font\": " + jsonString(font) + ", \"captionTheme\": " + jsonString(theme) + ", \"replaySeconds\": " + strconv.Itoa(replayDuration/100) + "}"
+		fmt.Fprint(w, responseStr)
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
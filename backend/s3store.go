@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type s3BlobStoreConfig struct {
+	// endpoint is the scheme and host of the S3 API, such as
+	// https://s3.eu-west-1.amazonaws.com or http://localhost:9000
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	// prepended to every key, so several deployments can share a bucket
+	prefix string
+	// where clients fetch unsigned URLs from if not the bucket itself, such
+	// as a CDN in front of it
+	publicURL string
+	presign   bool
+	expiry    time.Duration
+}
+
+// s3BlobStore keeps blobs in an S3 compatible bucket, addressed path style
+// (endpoint/bucket/key) so it works with MinIO and similar servers too.
+// Requests are signed with AWS Signature Version 4.
+type s3BlobStore struct {
+	config s3BlobStoreConfig
+	client *http.Client
+}
+
+func newS3BlobStore(config s3BlobStoreConfig) (*s3BlobStore, error) {
+	if config.endpoint == "" || config.bucket == "" {
+		return nil, fmt.Errorf("S3 storage needs an endpoint and a bucket")
+	}
+	if config.accessKey == "" || config.secretKey == "" {
+		return nil, fmt.Errorf("S3 storage needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if config.presign && (config.expiry <= 0 || config.expiry > 7*24*time.Hour) {
+		return nil, fmt.Errorf("presigned S3 URLs must expire within 7 days")
+	}
+	if config.region == "" {
+		config.region = "us-east-1"
+	}
+	config.endpoint = strings.TrimSuffix(config.endpoint, "/")
+	config.publicURL = strings.TrimSuffix(config.publicURL, "/")
+	return &s3BlobStore{config: config, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+// s3URIEncode percent-encodes everything but the unreserved characters, as
+// SigV4 canonical requests require
+func s3URIEncode(s string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(s) {
+		if ('A' <= b && b <= 'Z') || ('a' <= b && b <= 'z') || ('0' <= b && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && !encodeSlash) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *s3BlobStore) objectPath(key string) string {
+	return "/" + s.config.bucket + "/" + s.config.prefix + key
+}
+
+func (s *s3BlobStore) scope(now time.Time) string {
+	return now.Format("20060102") + "/" + s.config.region + "/s3/aws4_request"
+}
+
+// signature signs a canonical request made at now
+func (s *s3BlobStore) signature(now time.Time, canonicalRequest string) string {
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + s.scope(now) + "\n" + sha256Hex([]byte(canonicalRequest))
+	signingKey := hmacSHA256([]byte("AWS4"+s.config.secretKey), now.Format("20060102"))
+	signingKey = hmacSHA256(signingKey, s.config.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+}
+
+// canonicalQuery sorts and encodes query parameters for signing
+func canonicalQuery(query url.Values) string {
+	keys := []string{}
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, key := range keys {
+		for _, value := range query[key] {
+			pairs = append(pairs, s3URIEncode(key, true)+"="+s3URIEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func (s *s3BlobStore) do(method, key string, body []byte, contentType string) (*http.Response, error) {
+	endpoint, err := url.Parse(s.config.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	payloadHash := sha256Hex(body)
+	objectPath := s3URIEncode(s.objectPath(key), false)
+
+	headers := map[string]string{
+		"host":                 endpoint.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           now.Format("20060102T150405Z"),
+	}
+	if contentType != "" {
+		headers["content-type"] = contentType
+	}
+	headerNames := []string{}
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	canonicalHeaders := ""
+	for _, name := range headerNames {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+	canonicalRequest := method + "\n" + objectPath + "\n\n" + canonicalHeaders + "\n" + signedHeaders + "\n" + payloadHash
+
+	req, err := http.NewRequest(method, s.config.endpoint+objectPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range headerNames {
+		if name != "host" {
+			req.Header.Set(name, headers[name])
+		}
+	}
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.config.accessKey+"/"+s.scope(now)+", SignedHeaders="+signedHeaders+", Signature="+s.signature(now, canonicalRequest))
+	return s.client.Do(req)
+}
+
+// s3Error turns an unexpected response into an error, including the start of
+// the XML error document S3 sends back
+func s3Error(method, key string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("S3 %s %s: %s %s", method, key, resp.Status, strings.TrimSpace(string(body)))
+}
+
+func (s *s3BlobStore) Put(key string, data []byte) error {
+	resp, err := s.do("PUT", key, data, blobContentType(key))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("PUT", key, resp)
+	}
+	return nil
+}
+
+func (s *s3BlobStore) Get(key string) ([]byte, error) {
+	resp, err := s.do("GET", key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errBlobNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error("GET", key, resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *s3BlobStore) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3Error("DELETE", key, resp)
+	}
+	return nil
+}
+
+func (s *s3BlobStore) Exists(key string) bool {
+	resp, err := s.do("HEAD", key, nil, "")
+	if err != nil {
+		fmt.Println("Error checking S3 object:", err)
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// URL points clients straight at the bucket (or publicURL), either as a
+// plain URL, which needs the objects to be publicly readable, or as a
+// presigned URL which expires
+func (s *s3BlobStore) URL(key, baseURL string) string {
+	if !s.config.presign {
+		if s.config.publicURL != "" {
+			return s.config.publicURL + "/" + s3URIEncode(s.config.prefix+key, false)
+		}
+		return s.config.endpoint + s3URIEncode(s.objectPath(key), false)
+	}
+	endpoint, err := url.Parse(s.config.endpoint)
+	if err != nil {
+		return ""
+	}
+	now := time.Now().UTC()
+	objectPath := s3URIEncode(s.objectPath(key), false)
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.config.accessKey+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(s.config.expiry.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	canonicalRequest := "GET\n" + objectPath + "\n" + canonicalQuery(query) + "\nhost:" + endpoint.Host + "\n\nhost\nUNSIGNED-PAYLOAD"
+	return s.config.endpoint + objectPath + "?" + canonicalQuery(query) + "&X-Amz-Signature=" + s.signature(now, canonicalRequest)
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-process stand-in for an S3 bucket. It checks the SigV4
+// signature of every request the way S3 does, working it out independently of
+// s3BlobStore, and keeps objects in memory.
+type fakeS3 struct {
+	accessKey string
+	secretKey string
+	region    string
+
+	mu      sync.Mutex
+	objects map[string]fakeS3Object
+	// the time presigned URLs are checked against
+	now time.Time
+}
+
+type fakeS3Object struct {
+	data        []byte
+	contentType string
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	fake := &fakeS3{
+		accessKey: "AKIDEXAMPLE",
+		secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		region:    "us-east-1",
+		objects:   make(map[string]fakeS3Object),
+		now:       time.Now().UTC(),
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func (f *fakeS3) signingKey(date string) []byte {
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	return mac(mac(mac(mac([]byte("AWS4"+f.secretKey), date), f.region), "s3"), "aws4_request")
+}
+
+// sign works out the signature of a canonical request sent at amzDate
+func (f *fakeS3) sign(amzDate, canonicalRequest string) string {
+	date := amzDate[:8]
+	scope := date + "/" + f.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	h := hmac.New(sha256.New, f.signingKey(date))
+	h.Write([]byte(stringToSign))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (f *fakeS3) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	io.WriteString(w, "<Error><Code>"+code+"</Code></Error>")
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	var ok bool
+	if r.URL.Query().Get("X-Amz-Signature") != "" {
+		ok = f.checkPresigned(w, r)
+	} else {
+		ok = f.checkAuthorization(w, r, body)
+	}
+	if !ok {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	objectPath := r.URL.EscapedPath()
+	switch r.Method {
+	case "PUT":
+		f.objects[objectPath] = fakeS3Object{data: body, contentType: r.Header.Get("Content-Type")}
+		w.WriteHeader(http.StatusOK)
+	case "GET", "HEAD":
+		object, found := f.objects[objectPath]
+		if !found {
+			f.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Type", object.contentType)
+		w.Write(object.data)
+	case "DELETE":
+		delete(f.objects, objectPath)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.fail(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// checkAuthorization checks a request signed in its Authorization header
+func (f *fakeS3) checkAuthorization(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		f.fail(w, http.StatusForbidden, "AccessDenied")
+		return false
+	}
+	fields := map[string]string{}
+	for _, field := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ", ") {
+		name, value, _ := strings.Cut(field, "=")
+		fields[name] = value
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	if len(amzDate) != 16 || fields["Credential"] != f.accessKey+"/"+amzDate[:8]+"/"+f.region+"/s3/aws4_request" {
+		f.fail(w, http.StatusForbidden, "InvalidAccessKeyId")
+		return false
+	}
+	payloadHash := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(payloadHash[:]) {
+		f.fail(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch")
+		return false
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	for _, required := range []string{"host", "x-amz-content-sha256", "x-amz-date"} {
+		if !containsString(signedHeaders, required) {
+			f.fail(w, http.StatusForbidden, "AccessDenied")
+			return false
+		}
+	}
+	canonicalHeaders := ""
+	for _, name := range signedHeaders {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		canonicalHeaders += name + ":" + strings.TrimSpace(value) + "\n"
+	}
+	canonicalRequest := r.Method + "\n" + r.URL.EscapedPath() + "\n" + fakeCanonicalQuery(r.URL.Query()) + "\n" +
+		canonicalHeaders + "\n" + fields["SignedHeaders"] + "\n" + r.Header.Get("X-Amz-Content-Sha256")
+	if !hmac.Equal([]byte(fields["Signature"]), []byte(f.sign(amzDate, canonicalRequest))) {
+		f.fail(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return false
+	}
+	return true
+}
+
+// checkPresigned checks a request signed in its query string, which is only
+// good until the expiry it carries
+func (f *fakeS3) checkPresigned(w http.ResponseWriter, r *http.Request) bool {
+	query := r.URL.Query()
+	amzDate := query.Get("X-Amz-Date")
+	signedAt, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || query.Get("X-Amz-Algorithm") != "AWS4-HMAC-SHA256" || query.Get("X-Amz-SignedHeaders") != "host" ||
+		query.Get("X-Amz-Credential") != f.accessKey+"/"+amzDate[:8]+"/"+f.region+"/s3/aws4_request" {
+		f.fail(w, http.StatusForbidden, "AuthorizationQueryParametersError")
+		return false
+	}
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || expires <= 0 || expires > 7*24*60*60 {
+		f.fail(w, http.StatusForbidden, "AuthorizationQueryParametersError")
+		return false
+	}
+	f.mu.Lock()
+	now := f.now
+	f.mu.Unlock()
+	if now.After(signedAt.Add(time.Duration(expires) * time.Second)) {
+		f.fail(w, http.StatusForbidden, "AccessDenied")
+		return false
+	}
+
+	signature := query.Get("X-Amz-Signature")
+	query.Del("X-Amz-Signature")
+	canonicalRequest := r.Method + "\n" + r.URL.EscapedPath() + "\n" + fakeCanonicalQuery(query) + "\nhost:" + r.Host + "\n\nhost\nUNSIGNED-PAYLOAD"
+	if !hmac.Equal([]byte(signature), []byte(f.sign(amzDate, canonicalRequest))) {
+		f.fail(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return false
+	}
+	return true
+}
+
+func (f *fakeS3) setNow(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = now
+}
+
+func fakeCanonicalQuery(query url.Values) string {
+	pairs := []string{}
+	for key, values := range query {
+		for _, value := range values {
+			pairs = append(pairs, url.QueryEscape(key)+"="+url.QueryEscape(value))
+		}
+	}
+	sort.Strings(pairs)
+	// QueryEscape writes spaces as +, which SigV4 wants as %20
+	return strings.ReplaceAll(strings.Join(pairs, "&"), "+", "%20")
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func newTestS3BlobStore(t *testing.T, fake *fakeS3, server *httptest.Server, config s3BlobStoreConfig) *s3BlobStore {
+	config.endpoint = server.URL
+	config.bucket = "pt-test"
+	if config.accessKey == "" {
+		config.accessKey = fake.accessKey
+	}
+	if config.secretKey == "" {
+		config.secretKey = fake.secretKey
+	}
+	store, err := newS3BlobStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestS3BlobStoreRoundTrip(t *testing.T) {
+	fake, server := newFakeS3(t)
+	store := newTestS3BlobStore(t, fake, server, s3BlobStoreConfig{prefix: "deploy/"})
+	key := "images/1a2b3c4d.png"
+	data := []byte("\x89PNG not really")
+
+	if err := store.Put(key, data); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	object, ok := fake.objects["/pt-test/deploy/"+key]
+	if !ok {
+		t.Fatalf("object not stored under the bucket and prefix, have %v", fake.objects)
+	}
+	if object.contentType != "image/png" {
+		t.Errorf("stored with content type %q, want image/png", object.contentType)
+	}
+	if !store.Exists(key) {
+		t.Error("Exists is false after Put")
+	}
+	got, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("Get returned %q, want %q", got, data)
+	}
+
+	if err := store.Delete(key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if store.Exists(key) {
+		t.Error("Exists is true after Delete")
+	}
+	if _, err := store.Get(key); !errors.Is(err, errBlobNotFound) {
+		t.Errorf("Get after Delete returned %v, want errBlobNotFound", err)
+	}
+	// deleting what is already gone is not an error, as with S3
+	if err := store.Delete(key); err != nil {
+		t.Errorf("Delete of a missing key: %v", err)
+	}
+}
+
+func TestS3BlobStoreGetMissing(t *testing.T) {
+	fake, server := newFakeS3(t)
+	store := newTestS3BlobStore(t, fake, server, s3BlobStoreConfig{})
+	if _, err := store.Get("gifs/missing.gif"); !errors.Is(err, errBlobNotFound) {
+		t.Errorf("Get of a missing key returned %v, want errBlobNotFound", err)
+	}
+	if store.Exists("gifs/missing.gif") {
+		t.Error("Exists is true for a missing key")
+	}
+}
+
+func TestS3BlobStoreSignsKeysNeedingEncoding(t *testing.T) {
+	fake, server := newFakeS3(t)
+	store := newTestS3BlobStore(t, fake, server, s3BlobStoreConfig{prefix: "a prefix/"})
+	key := "exports/poster game+1.png"
+	if err := store.Put(key, []byte("poster")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got, err := store.Get(key); err != nil || string(got) != "poster" {
+		t.Errorf("Get returned %q, %v", got, err)
+	}
+}
+
+func TestS3BlobStoreWrongSecret(t *testing.T) {
+	fake, server := newFakeS3(t)
+	store := newTestS3BlobStore(t, fake, server, s3BlobStoreConfig{secretKey: "not the secret"})
+	err := store.Put("images/1a2b3c4d.png", []byte("data"))
+	if err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Errorf("Put with the wrong secret returned %v, want a signature error", err)
+	}
+	if len(fake.objects) != 0 {
+		t.Error("an unsigned Put was stored")
+	}
+}
+
+func TestS3BlobStorePresignedURLExpiry(t *testing.T) {
+	fake, server := newFakeS3(t)
+	store := newTestS3BlobStore(t, fake, server, s3BlobStoreConfig{presign: true, expiry: time.Hour})
+	key := "gifs/chain.gif"
+	if err := store.Put(key, []byte("GIF89a")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	signedURL := store.URL(key, "http://unused")
+	if !strings.HasPrefix(signedURL, server.URL+"/pt-test/"+key+"?") {
+		t.Fatalf("presigned URL %q doesn't point at the bucket", signedURL)
+	}
+
+	fetch := func() int {
+		resp, err := http.Get(signedURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := fetch(); status != http.StatusOK {
+		t.Errorf("fresh presigned URL got %d, want 200", status)
+	}
+	fake.setNow(time.Now().UTC().Add(59 * time.Minute))
+	if status := fetch(); status != http.StatusOK {
+		t.Errorf("presigned URL within its expiry got %d, want 200", status)
+	}
+	fake.setNow(time.Now().UTC().Add(61 * time.Minute))
+	if status := fetch(); status != http.StatusForbidden {
+		t.Errorf("expired presigned URL got %d, want 403", status)
+	}
+
+	fake.setNow(time.Now().UTC())
+	tampered := strings.Replace(signedURL, "X-Amz-Expires=3600", "X-Amz-Expires=7200", 1)
+	if tampered == signedURL {
+		t.Fatal("presigned URL has no X-Amz-Expires=3600")
+	}
+	resp, err := http.Get(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("presigned URL with a changed expiry got %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestS3BlobStorePresignExpiryLimit(t *testing.T) {
+	for _, expiry := range []time.Duration{0, 8 * 24 * time.Hour} {
+		_, err := newS3BlobStore(s3BlobStoreConfig{endpoint: "http://localhost:9000", bucket: "b", accessKey: "a", secretKey: "s", presign: true, expiry: expiry})
+		if err == nil {
+			t.Errorf("presigned URLs expiring after %v were accepted", expiry)
+		}
+	}
+}
+
+func TestS3BlobStoreUnsignedURL(t *testing.T) {
+	store, err := newS3BlobStore(s3BlobStoreConfig{endpoint: "http://localhost:9000/", bucket: "b", accessKey: "a", secretKey: "s", prefix: "p/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := store.URL("images/x y.png", ""), "http://localhost:9000/b/p/images/x%20y.png"; got != want {
+		t.Errorf("URL = %q, want %q", got, want)
+	}
+	store.config.publicURL = "https://cdn.example.com"
+	if got, want := store.URL("images/x.png", ""), "https://cdn.example.com/p/images/x.png"; got != want {
+		t.Errorf("URL with a public URL = %q, want %q", got, want)
+	}
+}
+
+func TestServeBlobRefusesPresignedS3(t *testing.T) {
+	fake, server := newFakeS3(t)
+	for _, presign := range []bool{false, true} {
+		store := newTestS3BlobStore(t, fake, server, s3BlobStoreConfig{presign: presign, expiry: time.Hour})
+		if err := store.Put("gifs/chain.gif", []byte("GIF89a")); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		saved := blobStore
+		blobStore = store
+		recorder := httptest.NewRecorder()
+		serveBlob(recorder, httptest.NewRequest("GET", "/gifs/chain.gif", nil))
+		blobStore = saved
+
+		want := http.StatusOK
+		if presign {
+			// the bucket's presigned URLs would expire, but this wouldn't
+			want = http.StatusForbidden
+		}
+		if recorder.Code != want {
+			t.Errorf("with presign %v, fetching through the server got %d, want %d", presign, recorder.Code, want)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import "unicode"
+
+// ArabicForms are where the contextual forms of an Arabic letter start in the
+// presentation forms blocks: isolated, then final, then initial and medial for
+// letters which join to the letter after them as well as the one before
+type ArabicForms struct {
+	isolated rune
+	// 1 for letters which join to nothing, 2 for those which only join to
+	// the letter before them and 4 for those which join on both sides
+	count int
+}
+
+var (
+	arabicForms = map[rune]ArabicForms{
+		'ء': {0xFE80, 1}, 'آ': {0xFE81, 2}, 'أ': {0xFE83, 2}, 'ؤ': {0xFE85, 2},
+		'إ': {0xFE87, 2}, 'ئ': {0xFE89, 4}, 'ا': {0xFE8D, 2}, 'ب': {0xFE8F, 4},
+		'ة': {0xFE93, 2}, 'ت': {0xFE95, 4}, 'ث': {0xFE99, 4}, 'ج': {0xFE9D, 4},
+		'ح': {0xFEA1, 4}, 'خ': {0xFEA5, 4}, 'د': {0xFEA9, 2}, 'ذ': {0xFEAB, 2},
+		'ر': {0xFEAD, 2}, 'ز': {0xFEAF, 2}, 'س': {0xFEB1, 4}, 'ش': {0xFEB5, 4},
+		'ص': {0xFEB9, 4}, 'ض': {0xFEBD, 4}, 'ط': {0xFEC1, 4}, 'ظ': {0xFEC5, 4},
+		'ع': {0xFEC9, 4}, 'غ': {0xFECD, 4}, 'ف': {0xFED1, 4}, 'ق': {0xFED5, 4},
+		'ك': {0xFED9, 4}, 'ل': {0xFEDD, 4}, 'م': {0xFEE1, 4}, 'ن': {0xFEE5, 4},
+		'ه': {0xFEE9, 4}, 'و': {0xFEED, 2}, 'ى': {0xFEEF, 2}, 'ي': {0xFEF1, 4},
+		// the extra letters of Persian and Urdu
+		'پ': {0xFB56, 4}, 'چ': {0xFB7A, 4}, 'ژ': {0xFB8A, 2}, 'ک': {0xFB8E, 4},
+		'گ': {0xFB92, 4}, 'ی': {0xFBFC, 4},
+	}
+	// lam followed by alef is always written as a ligature, which like alef
+	// only joins to the letter before it
+	lamAlefLigatures = map[rune]rune{
+		'آ': 0xFEF5, 'أ': 0xFEF7, 'إ': 0xFEF9, 'ا': 0xFEFB,
+	}
+	// tatweel stretches the join between letters, so it joins on both sides
+	// without having forms of its own
+	tatweel = 'ـ'
+)
+
+// joinsAfter reports whether r joins to the letter after it
+func joinsAfter(r rune) bool {
+	return r == tatweel || arabicForms[r].count == 4
+}
+
+// joinsBefore reports whether r joins to the letter before it
+func joinsBefore(r rune) bool {
+	return r == tatweel || arabicForms[r].count >= 2
+}
+
+// shapeArabic gives each Arabic letter of line the form which joins it up to
+// the letters around it, as fonts draw each character on its own. Marks such
+// as vowel signs are skipped over when looking for the letters around. Letters
+// stay as they are if has, such as the has of the chain they are drawn in,
+// reports no glyph for the form they would take.
+func shapeArabic(line string, has func(rune) bool) string {
+	runes := []rune(line)
+	// the letter before and after each character, skipping marks
+	neighbour := func(i, step int) rune {
+		for i += step; i >= 0 && i < len(runes); i += step {
+			if !unicode.Is(unicode.Mn, runes[i]) {
+				return runes[i]
+			}
+		}
+		return 0
+	}
+
+	shaped := make([]rune, 0, len(runes))
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		forms, ok := arabicForms[r]
+		if !ok {
+			shaped = append(shaped, r)
+			continue
+		}
+		joinedBefore := joinsAfter(neighbour(i, -1))
+		if r == 'ل' && i+1 < len(runes) {
+			if ligature, ok := lamAlefLigatures[runes[i+1]]; ok {
+				if joinedBefore {
+					ligature++
+				}
+				if has(ligature) {
+					shaped = append(shaped, ligature)
+					i++
+					continue
+				}
+			}
+		}
+		joinedAfter := forms.count == 4 && joinsBefore(neighbour(i, 1))
+		form := forms.isolated
+		switch {
+		case joinedBefore && joinedAfter:
+			form += 3
+		case joinedAfter:
+			form += 2
+		case joinedBefore && forms.count >= 2:
+			form += 1
+		}
+		if !has(form) {
+			form = r
+		}
+		shaped = append(shaped, form)
+	}
+	return string(shaped)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// hasEveryForm stands in for a chain with an Arabic font, which has every
+// presentation form
+func hasEveryForm(r rune) bool {
+	return true
+}
+
+func TestShapeArabic(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []rune
+	}{
+		{name: "isolated", text: "ب", want: []rune{0xFE8F}},
+		{name: "initial and final", text: "بب", want: []rune{0xFE91, 0xFE90}},
+		{name: "medial", text: "ببب", want: []rune{0xFE91, 0xFE92, 0xFE90}},
+		// dal only joins to the letter before it
+		{name: "right joining first", text: "دب", want: []rune{0xFEA9, 0xFE8F}},
+		{name: "right joining last", text: "بد", want: []rune{0xFE91, 0xFEAA}},
+		{name: "hamza joins to nothing", text: "بءب", want: []rune{0xFE8F, 0xFE80, 0xFE8F}},
+		{name: "lam alef ligature", text: "لا", want: []rune{0xFEFB}},
+		{name: "joined lam alef ligature", text: "بلا", want: []rune{0xFE91, 0xFEFC}},
+		{name: "marks are skipped over", text: "بَب", want: []rune{0xFE91, 0x064E, 0xFE90}},
+		{name: "tatweel joins", text: "بـ", want: []rune{0xFE91, 'ـ'}},
+		{name: "words don't join across spaces", text: "بب بب", want: []rune{0xFE91, 0xFE90, ' ', 0xFE91, 0xFE90}},
+		{name: "persian letters", text: "پی", want: []rune{0xFB58, 0xFBFD}},
+		{name: "other scripts are left alone", text: "abc", want: []rune("abc")},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := []rune(shapeArabic(test.text, hasEveryForm)); string(got) != string(test.want) {
+				t.Errorf("shapeArabic(%q) = %s, want %s", test.text, codePoints(got), codePoints(test.want))
+			}
+		})
+	}
+}
+
+func TestShapeArabicWithoutForms(t *testing.T) {
+	// letters are left as they are where there is no glyph for their form
+	hasNoForms := func(r rune) bool {
+		return false
+	}
+	for _, text := range []string{"ببب", "لا", "بلا"} {
+		if got := shapeArabic(text, hasNoForms); got != text {
+			t.Errorf("shapeArabic(%q) with no forms = %s, want it unchanged", text, codePoints([]rune(got)))
+		}
+	}
+}
+
+func TestShapeArabicIsIdempotent(t *testing.T) {
+	// lines are shaped when wrapped and again when drawn
+	for _, text := range []string{"بببب", "بلا بد", "سلام عليكم"} {
+		once := shapeArabic(text, hasEveryForm)
+		if twice := shapeArabic(once, hasEveryForm); twice != once {
+			t.Errorf("shaping %q again gave %s, want %s", text, codePoints([]rune(twice)), codePoints([]rune(once)))
+		}
+	}
+}
+
+// codePoints lists runes as code points, for failures involving characters
+// which look alike
+func codePoints(runes []rune) string {
+	s := ""
+	for i, r := range runes {
+		if i > 0 {
+			s += " "
+		}
+		s += fmt.Sprintf("%04X", r)
+	}
+	return s
+}
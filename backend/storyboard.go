@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+var (
+	// storyboards lay a chain out as a comic strip, one panel wide
+	storyboardPanelWidth  = 640
+	storyboardCaptionSize = 200
+	storyboardLabelHeight = 48
+	storyboardTitleHeight = 96
+	storyboardPadding     = 24
+	storyboardBorder      = color.RGBA{210, 210, 210, 255}
+	storyboardLabelColor  = color.RGBA{90, 90, 90, 255}
+	posterMaxColumns      = 4
+	posterColumnWidth     = 360
+	exportKinds           = []string{"storyboard", "poster", "booklet", "archive"}
+	exportContentTypes    = map[string]string{"storyboard": "image/png", "poster": "image/png", "booklet": "application/pdf", "archive": "application/zip"}
+	exportFileExtensions  = map[string]string{"storyboard": ".png", "poster": ".png", "booklet": ".pdf", "archive": ".zip"}
+	// the exports being drawn, by game ID and exportKey, so asking for one
+	// again while it is drawn doesn't draw it twice. Only touched holding
+	// stateLock.
+	exportsDrawing = make(map[string]*ExportDrawing)
+	// posters and booklets of big games take as much time and memory as a
+	// GIF, so no more are drawn at once than there are render workers
+	exportSlots = make(chan struct{}, renderWorkers)
+)
+
+// ExportGame is what the exports need from an ended game, copied out of the
+// game state so they can be drawn without holding stateLock
+type ExportGame struct {
+	gameName string
+	endedAt  time.Time
+	// each player, or each team and its members when played in teams
+	players []string
+	chains  []StoryboardChain
+	fonts   FontChain
+}
+
+// ExportDrawing is an export being drawn in the background
+type ExportDrawing struct {
+	// what went wrong, once drawing it has failed
+	err string
+}
+
+// StoryboardChain is what the exports need from a chain
+type StoryboardChain struct {
+	captions []string
+	// the blob key of each drawing, or "" where nobody submitted one
+	drawingPaths []string
+	authors      []string
+}
+
+// exportSnapshot copies what the exports need out of an ended game. Must be
+// called holding stateLock.
+func exportSnapshot(endedGame *EndedGame) *ExportGame {
+	game := &ExportGame{
+		gameName: endedGame.gameName,
+		endedAt:  endedGame.endedAt,
+		chains:   storyboardChains(endedGame),
+		fonts:    fontChain(endedGame.font),
+	}
+	if len(endedGame.teams) == 0 {
+		game.players = endedGame.players
+	}
+	for _, team := range endedGame.teams {
+		if len(team.members) == 1 && team.members[0].playerName == team.teamName {
+			// a team of one, as every player is outside of team games
+			game.players = append(game.players, team.teamName)
+			continue
+		}
+		members := []string{}
+		for _, member := range team.members {
+			members = append(members, member.playerName)
+		}
+		game.players = append(game.players, team.teamName+": "+strings.Join(members, ", "))
+	}
+	return game
+}
+
+// storyboardChains snapshots the chains of an ended game. Must be called
+// holding stateLock.
+func storyboardChains(endedGame *EndedGame) []StoryboardChain {
+	chains := []StoryboardChain{}
+	for c, captions := range endedGame.prompts {
+		chain := StoryboardChain{captions: captions}
+		for round := range captions {
+			path := ""
+			if round < len(endedGame.drawings[c]) {
+				if registered, ok := imageRegistry[endedGame.drawings[c][round]]; ok {
+					path = registered.path
+				}
+			}
+			chain.drawingPaths = append(chain.drawingPaths, path)
+			chain.authors = append(chain.authors, teamEntryAuthor(endedGame.teams, c, round))
+		}
+		chains = append(chains, chain)
+	}
+	return chains
+}
+
+// entryLabel says which round an entry is from and who made it, when that is
+// known
+func entryLabel(round int, author string) string {
+	label := "Round " + strconv.Itoa(round+1)
+	if author != "" {
+		label += " - " + author
+	}
+	return label
+}
+
+// fillRect paints rect of img with a solid color
+func fillRect(img *image.RGBA, rect image.Rectangle, c color.Color) {
+	draw.Draw(img, rect, &image.Uniform{c}, image.Point{}, draw.Src)
+}
+
+// framedPanel draws a one pixel border just inside rect
+func framedPanel(img *image.RGBA, rect image.Rectangle) {
+	fillRect(img, image.Rect(rect.Min.X, rect.Min.Y, rect.Max.X, rect.Min.Y+1), storyboardBorder)
+	fillRect(img, image.Rect(rect.Min.X, rect.Max.Y-1, rect.Max.X, rect.Max.Y), storyboardBorder)
+	fillRect(img, image.Rect(rect.Min.X, rect.Min.Y, rect.Min.X+1, rect.Max.Y), storyboardBorder)
+	fillRect(img, image.Rect(rect.Max.X-1, rect.Min.Y, rect.Max.X, rect.Max.Y), storyboardBorder)
+}
+
+// renderStoryboard lays a chain out top to bottom: a title, then for each
+// round a label with the round and who made it, the caption in a panel and
+// the drawing under it. Captions use the same text layout as the GIFs.
+func renderStoryboard(chain StoryboardChain, title string, fonts FontChain) (*image.RGBA, error) {
+	width := storyboardPanelWidth + 2*storyboardPadding
+	entryHeight := storyboardLabelHeight + storyboardCaptionSize + storyboardPanelWidth + storyboardPadding
+	height := storyboardTitleHeight + len(chain.captions)*entryHeight + storyboardPadding
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	fillRect(img, img.Bounds(), color.White)
+
+	if err := drawCaptionText(img, image.Rect(0, 0, width, storyboardTitleHeight), fonts, title, 40, 16, image.Black); err != nil {
+		return nil, err
+	}
+	panels := &ImagePipeline{
+		mode:       "letterbox",
+		width:      storyboardPanelWidth,
+		height:     storyboardPanelWidth,
+		resampler:  uploadPipeline.resampler,
+		background: uploadPipeline.background,
+	}
+	y := storyboardTitleHeight
+	for round, caption := range chain.captions {
+		x := storyboardPadding
+		label := entryLabel(round, chain.authors[round])
+		labelRect := image.Rect(x, y, x+storyboardPanelWidth, y+storyboardLabelHeight)
+		if err := drawCaptionText(img, labelRect, fonts, label, 22, 12, &image.Uniform{storyboardLabelColor}); err != nil {
+			return nil, err
+		}
+		y += storyboardLabelHeight
+
+		if caption == "" {
+			caption = nonSubmissionString_caption
+		}
+		captionRect := image.Rect(x, y, x+storyboardPanelWidth, y+storyboardCaptionSize)
+		if err := drawCaptionText(img, captionRect, fonts, caption, 36, 12, image.Black); err != nil {
+			return nil, err
+		}
+		framedPanel(img, captionRect)
+		y += storyboardCaptionSize
+
+		var drawing image.Image
+		var err error
+		if chain.drawingPaths[round] != "" {
+			drawing, err = loadImage(chain.drawingPaths[round])
+		} else {
+			drawing, err = getNonSubmissionImage("drawing", captionTheme(defaultCaptionThemeName), fonts)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error loading drawing image: %v", err)
+		}
+		drawingRect := image.Rect(x, y, x+storyboardPanelWidth, y+storyboardPanelWidth)
+		draw.Draw(img, drawingRect, panels.process(drawing), image.Point{}, draw.Over)
+		framedPanel(img, drawingRect)
+		y += storyboardPanelWidth + storyboardPadding
+	}
+	return img, nil
+}
+
+// renderPoster arranges the storyboards of every chain of a game in a grid
+// under the game's name
+func renderPoster(chains []StoryboardChain, gameName string, fonts FontChain) (*image.RGBA, error) {
+	if len(chains) == 0 {
+		return nil, fmt.Errorf("the game has no chains")
+	}
+	columns := min(len(chains), posterMaxColumns)
+	strips := []image.Image{}
+	rowHeights := make([]int, (len(chains)+columns-1)/columns)
+	for i, chain := range chains {
+		strip, err := renderStoryboard(chain, "Chain "+strconv.Itoa(i+1), fonts)
+		if err != nil {
+			return nil, err
+		}
+		scaled := &ImagePipeline{
+			mode:       "letterbox",
+			width:      posterColumnWidth,
+			height:     posterColumnWidth * strip.Bounds().Dy() / strip.Bounds().Dx(),
+			resampler:  uploadPipeline.resampler,
+			background: color.RGBA{255, 255, 255, 255},
+		}
+		scaledStrip := scaled.process(strip)
+		strips = append(strips, scaledStrip)
+		rowHeights[i/columns] = max(rowHeights[i/columns], scaledStrip.Bounds().Dy())
+	}
+
+	width := columns*posterColumnWidth + (columns+1)*storyboardPadding
+	height := storyboardTitleHeight + storyboardPadding
+	for _, rowHeight := range rowHeights {
+		height += rowHeight + storyboardPadding
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	fillRect(img, img.Bounds(), color.White)
+	if err := drawCaptionText(img, image.Rect(0, 0, width, storyboardTitleHeight), fonts, gameName, 56, 16, image.Black); err != nil {
+		return nil, err
+	}
+	y := storyboardTitleHeight
+	for i, strip := range strips {
+		if i > 0 && i%columns == 0 {
+			y += rowHeights[i/columns-1] + storyboardPadding
+		}
+		x := storyboardPadding + (i%columns)*(posterColumnWidth+storyboardPadding)
+		draw.Draw(img, strip.Bounds().Add(image.Pt(x, y)), strip, image.Point{}, draw.Src)
+	}
+	return img, nil
+}
+
+// exportKey names a cached export of an ended game
+func exportKey(kind string, chain int) string {
+	if kind == "storyboard" {
+		return kind + "-" + strconv.Itoa(chain)
+	}
+	return kind
+}
+
+// exportFileName is the name an export is downloaded as
+func exportFileName(gameName, kind string, chain int) string {
+	name := strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '-'
+	}, gameName)
+	if kind == "storyboard" {
+		name += "-chain-" + strconv.Itoa(chain+1)
+	} else {
+		name += "-" + kind
+	}
+	return name + exportFileExtensions[kind]
+}
+
+// exportURL is where an export of an ended game can be downloaded
+func exportURL(baseURL, gameId, kind string, chain int) string {
+	query := url.Values{}
+	query.Set("gameId", gameId)
+	query.Set("export", kind)
+	if kind == "storyboard" {
+		query.Set("chain", strconv.Itoa(chain))
+	}
+	return baseURL + "/exportEndedGame?" + query.Encode()
+}
+
+// exportsToJSON lists the downloads of an ended game
+func exportsToJSON(endedGame *EndedGame, baseURL string) string {
+	storyboards := []string{}
+	for chain := range endedGame.prompts {
+		storyboards = append(storyboards, exportURL(baseURL, endedGame.gameId, "storyboard", chain))
+	}
+	exportsJson := "{\"poster\": " + jsonString(exportURL(baseURL, endedGame.gameId, "poster", 0)) + ","
+	exportsJson += "\"booklet\": " + jsonString(exportURL(baseURL, endedGame.gameId, "booklet", 0)) + ","
+	exportsJson += "\"archive\": " + jsonString(exportURL(baseURL, endedGame.gameId, "archive", 0)) + ","
+	exportsJson += "\"storyboards\": " + jsonStringList(storyboards) + "}"
+	return exportsJson
+}
+
+// renderExport draws an export from a snapshot of the game
+func renderExport(kind string, chain int, game *ExportGame) ([]byte, error) {
+	var img *image.RGBA
+	var err error
+	switch kind {
+	case "storyboard":
+		img, err = renderStoryboard(game.chains[chain], game.gameName+" - chain "+strconv.Itoa(chain+1), game.fonts)
+	case "poster":
+		img, err = renderPoster(game.chains, game.gameName, game.fonts)
+	case "booklet":
+		return renderBooklet(game)
+	default:
+		return nil, fmt.Errorf("unknown export %q", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// drawExport draws an export in the background and keeps it with the game,
+// unless the game has gone or its font has changed since the snapshot was
+// taken
+func drawExport(gameId, kind string, chain int, snapshot *ExportGame, font string) {
+	exportSlots <- struct{}{}
+	data, err := renderExport(kind, chain, snapshot)
+	<-exportSlots
+	key := ""
+	if err == nil {
+		key, err = storeContent("exports", exportFileExtensions[kind], data)
+	}
+
+	stateLock.Lock()
+	defer stateLock.Unlock()
+	if key != "" {
+		// the reference storeContent took, dropped once the game has its own
+		defer releaseBlob(key)
+	}
+	endedGame, ok := endedGames[gameId]
+	if err != nil {
+		fmt.Println("Error exporting game", gameId, ":", err)
+		if ok {
+			// kept until whoever asked for it next asks, to tell them
+			exportsDrawing[gameId+"/"+exportKey(kind, chain)].err = "Error creating the export"
+			return
+		}
+	}
+	delete(exportsDrawing, gameId+"/"+exportKey(kind, chain))
+	if err != nil {
+		return
+	}
+	if ok && endedGame.exports[exportKey(kind, chain)] == "" && endedGame.font == font {
+		endedGame.exports[exportKey(kind, chain)] = key
+		retainBlob(key)
+	}
+}
+
+// An endpoint to download a storyboard of one chain of an ended game, or a
+// poster, printable booklet or zip archive of the whole game. Exports other
+// than archives are drawn in the background the first time they are asked
+// for, and kept with the game after that. Until one is ready, asking for it
+// gets 202 Accepted and a Retry-After header.
+func exportEndedGame(w http.ResponseWriter, r *http.Request) {
+	allowCors(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if r.Method == "GET" {
+		kind := r.URL.Query().Get("export")
+		if _, ok := exportContentTypes[kind]; !ok {
+			http.Error(w, "export must be one of "+strings.Join(exportKinds, ", "), http.StatusBadRequest)
+			return
+		}
+
+		stateLock.Lock()
+		endedGame, ok := endedGames[r.URL.Query().Get("gameId")]
+		if !ok {
+			stateLock.Unlock()
+			http.Error(w, "Game not found", http.StatusNotFound)
+			return
+		}
+		chain := 0
+		if kind == "storyboard" {
+			var err error
+			chain, err = strconv.Atoi(r.URL.Query().Get("chain"))
+			if err != nil || chain < 0 || chain >= len(endedGame.prompts) {
+				stateLock.Unlock()
+				http.Error(w, "Invalid chain", http.StatusBadRequest)
+				return
+			}
+		}
+		gameId := endedGame.gameId
+		gameName := endedGame.gameName
+		if kind == "archive" {
+			// archives hold renders which may still be on their way, so they
+			// are made afresh each time rather than kept
+			manifest := archiveManifest(endedGame)
+			stateLock.Unlock()
+			w.Header().Set("Content-Type", exportContentTypes[kind])
+			w.Header().Set("Content-Disposition", "attachment; filename=\""+exportFileName(gameName, kind, chain)+"\"")
+			if err := writeArchive(w, manifest); err != nil {
+				fmt.Println("Error writing the archive of game", gameId, ":", err)
+			}
+			return
+		}
+		key := endedGame.exports[exportKey(kind, chain)]
+		stateLock.Unlock()
+
+		var data []byte
+		var err error
+		if key != "" {
+			data, err = blobStore.Get(key)
+		}
+		if key == "" || err != nil {
+			stateLock.Lock()
+			endedGame, ok := endedGames[gameId]
+			if !ok {
+				stateLock.Unlock()
+				http.Error(w, "Game not found", http.StatusNotFound)
+				return
+			}
+			if err != nil && endedGame.exports[exportKey(kind, chain)] == key {
+				// the stored export can't be read, so it is drawn again
+				fmt.Println("Error reading export", key, ":", err)
+				releaseBlob(key)
+				delete(endedGame.exports, exportKey(kind, chain))
+			}
+			drawing, ok := exportsDrawing[gameId+"/"+exportKey(kind, chain)]
+			if ok && drawing.err != "" {
+				// report the failure once, and draw it again if asked again
+				delete(exportsDrawing, gameId+"/"+exportKey(kind, chain))
+				stateLock.Unlock()
+				http.Error(w, drawing.err, http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				exportsDrawing[gameId+"/"+exportKey(kind, chain)] = &ExportDrawing{}
+				go drawExport(gameId, kind, chain, exportSnapshot(endedGame), endedGame.font)
+			}
+			stateLock.Unlock()
+			w.Header().Set("Retry-After", "2")
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprint(w, "{\"status\": \"PENDING\", \"message\": \"The export is being drawn, ask again shortly\"}")
+			return
+		}
+
+		w.Header().Set("Content-Type", exportContentTypes[kind])
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+exportFileName(gameName, kind, chain)+"\"")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
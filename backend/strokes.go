@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+var (
+	drawingSize     = 1024
+	minCanvasSize   = 64
+	maxCanvasSize   = 4096
+	maxStrokes      = 5000
+	maxStrokePoints = 100000
+	maxStrokeWidth  = 200.0
+	// the widest brush radius once a stroke is scaled up to drawingSize, in
+	// pixels, however small the client's canvas
+	maxBrushRadius = 64.0
+	// how many pixels a drawing's segments may cover between them at
+	// drawingSize, counting the bounding box of each one. Rasterizing costs
+	// about this much, so it keeps any drawing to around a second of work.
+	maxStrokeCoverage   = 32 * drawingSize * drawingSize
+	strokeToolOptions   = []string{"pen", "eraser"}
+	drawingBackground   = color.RGBA{255, 255, 255, 255}
+	defaultStrokeColor  = "#000000"
+	defaultCanvasLength = 1024
+)
+
+// Replaying strokes in the reveal GIF. Durations are in centiseconds like GIF
+// frame delays, apart from maxReplayPause which is in stroke milliseconds.
+var (
+	defaultReplaySeconds = 3
+	// what each frame of a replay changed is held in memory until the GIF is
+	// encoded, so replays can't run long
+	maxReplaySeconds             = 30
+	strokeReplayFrameDelay       = 10
+	maxReplayPause         int64 = 500
+	// the replays of a chain share this many frames, however many drawings
+	// it has
+	maxChainReplayFrames = maxReplaySeconds * 100 / strokeReplayFrameDelay
+)
+
+// StrokePoint is a point on the client's canvas. t is the number of
+// milliseconds since the player started drawing.
+type StrokePoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	T int64   `json:"t"`
+}
+
+type Stroke struct {
+	Points []StrokePoint `json:"points"`
+	Color  string        `json:"color"`
+	Width  float64       `json:"width"`
+	Tool   string        `json:"tool"`
+}
+
+// StrokeDrawing is a drawing submitted as vector strokes instead of an
+// uploaded image. Point coordinates and stroke widths are in units of the
+// client's canvas, which is width by height.
+type StrokeDrawing struct {
+	Width   int      `json:"width"`
+	Height  int      `json:"height"`
+	Strokes []Stroke `json:"strokes"`
+}
+
+// parseHexColor parses #rgb, #rrggbb and #rrggbbaa colors
+func parseHexColor(s string) (color.RGBA, error) {
+	hexDigits := strings.TrimPrefix(s, "#")
+	if len(hexDigits) == 3 {
+		hexDigits = string([]byte{hexDigits[0], hexDigits[0], hexDigits[1], hexDigits[1], hexDigits[2], hexDigits[2]})
+	}
+	if len(hexDigits) == 6 {
+		hexDigits += "ff"
+	}
+	if !strings.HasPrefix(s, "#") || len(hexDigits) != 8 {
+		return color.RGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	value, err := strconv.ParseUint(hexDigits, 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid color %q", s)
+	}
+	// color.RGBA is alpha-premultiplied
+	r, g, b, a := uint32(value>>24), uint32(value>>16&0xff), uint32(value>>8&0xff), uint32(value&0xff)
+	return color.RGBA{uint8(r * a / 255), uint8(g * a / 255), uint8(b * a / 255), uint8(a)}, nil
+}
+
+// validateStrokeDrawing checks a submitted stroke drawing and fills in the
+// defaults for anything the client left out
+func validateStrokeDrawing(drawing *StrokeDrawing) error {
+	if drawing.Width == 0 && drawing.Height == 0 {
+		drawing.Width = defaultCanvasLength
+		drawing.Height = defaultCanvasLength
+	}
+	if drawing.Width < minCanvasSize || drawing.Height < minCanvasSize || drawing.Width > maxCanvasSize || drawing.Height > maxCanvasSize {
+		return fmt.Errorf("canvas size must be between %d and %d", minCanvasSize, maxCanvasSize)
+	}
+	if len(drawing.Strokes) == 0 {
+		return fmt.Errorf("drawing has no strokes")
+	}
+	if len(drawing.Strokes) > maxStrokes {
+		return fmt.Errorf("drawing has more than %d strokes", maxStrokes)
+	}
+
+	totalPoints := 0
+	for i := range drawing.Strokes {
+		stroke := &drawing.Strokes[i]
+		if stroke.Tool == "" {
+			stroke.Tool = "pen"
+		}
+		validTool := false
+		for _, tool := range strokeToolOptions {
+			if stroke.Tool == tool {
+				validTool = true
+			}
+		}
+		if !validTool {
+			return fmt.Errorf("stroke %d: tool must be one of %s", i, strings.Join(strokeToolOptions, ", "))
+		}
+		if stroke.Color == "" {
+			stroke.Color = defaultStrokeColor
+		}
+		if _, err := parseHexColor(stroke.Color); err != nil {
+			return fmt.Errorf("stroke %d: %v", i, err)
+		}
+		if math.IsNaN(stroke.Width) || stroke.Width <= 0 || stroke.Width > maxStrokeWidth {
+			return fmt.Errorf("stroke %d: width must be greater than 0 and at most %v", i, maxStrokeWidth)
+		}
+		if len(stroke.Points) == 0 {
+			return fmt.Errorf("stroke %d has no points", i)
+		}
+		totalPoints += len(stroke.Points)
+		if totalPoints > maxStrokePoints {
+			return fmt.Errorf("drawing has more than %d points", maxStrokePoints)
+		}
+		for j, point := range stroke.Points {
+			if math.IsNaN(point.X) || math.IsNaN(point.Y) || point.X < 0 || point.Y < 0 || point.X > float64(drawing.Width) || point.Y > float64(drawing.Height) {
+				return fmt.Errorf("stroke %d point %d is outside the canvas", i, j)
+			}
+			if point.T < 0 || (j > 0 && point.T < stroke.Points[j-1].T) {
+				return fmt.Errorf("stroke %d point %d: timestamps must not go backwards", i, j)
+			}
+		}
+	}
+	if strokeCoverage(drawing) > float64(maxStrokeCoverage) {
+		return fmt.Errorf("drawing's strokes cover more than %d pixels between them", maxStrokeCoverage)
+	}
+	return nil
+}
+
+// strokeScale is how far a drawing's canvas units are scaled up to draw it at
+// drawingSize
+func strokeScale(drawing *StrokeDrawing) (float64, float64) {
+	width, height := drawingCanvasSize(drawing)
+	return float64(width) / float64(drawing.Width), float64(height) / float64(drawing.Height)
+}
+
+// brushRadius is the radius of a stroke's brush at a scale, in pixels
+func brushRadius(stroke *Stroke, scaleX, scaleY float64) float64 {
+	return math.Min(stroke.Width*(scaleX+scaleY)/4, maxBrushRadius)
+}
+
+// strokeCoverage adds up the bounding boxes of every segment of a drawing at
+// drawingSize, which drawStrokeSegments scans a pixel at a time
+func strokeCoverage(drawing *StrokeDrawing) float64 {
+	scaleX, scaleY := strokeScale(drawing)
+	coverage := 0.0
+	for i := range drawing.Strokes {
+		stroke := &drawing.Strokes[i]
+		side := 2*brushRadius(stroke, scaleX, scaleY) + 3
+		if len(stroke.Points) == 1 {
+			coverage += side * side
+		}
+		for j := 1; j < len(stroke.Points); j++ {
+			a, b := stroke.Points[j-1], stroke.Points[j]
+			coverage += (math.Abs(b.X-a.X)*scaleX + side) * (math.Abs(b.Y-a.Y)*scaleY + side)
+		}
+	}
+	return coverage
+}
+
+// drawStrokeSegments paints points [from, to) of a stroke onto img, which is
+// drawingSize on its longest side. Each segment is painted as a round-capped
+// capsule into a coverage mask first, so overlapping segments of a
+// translucent stroke don't darken where they join.
+func drawStrokeSegments(img *image.RGBA, drawing *StrokeDrawing, stroke *Stroke, from, to int) {
+	if from >= to {
+		return
+	}
+	scaleX := float64(img.Bounds().Dx()) / float64(drawing.Width)
+	scaleY := float64(img.Bounds().Dy()) / float64(drawing.Height)
+	radius := brushRadius(stroke, scaleX, scaleY)
+
+	strokeColor, _ := parseHexColor(stroke.Color)
+	if stroke.Tool == "eraser" {
+		strokeColor = drawingBackground
+	}
+
+	// the segment into point `from` is included so that a stroke drawn in
+	// several calls stays joined up
+	start := from
+	if start > 0 {
+		start--
+	}
+	points := make([][2]float64, 0, to-start)
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, p := range stroke.Points[start:to] {
+		x, y := p.X*scaleX, p.Y*scaleY
+		points = append(points, [2]float64{x, y})
+		minX, minY = math.Min(minX, x), math.Min(minY, y)
+		maxX, maxY = math.Max(maxX, x), math.Max(maxY, y)
+	}
+	bounds := image.Rect(int(minX-radius-1), int(minY-radius-1), int(maxX+radius+2), int(maxY+radius+2)).Intersect(img.Bounds())
+	if bounds.Empty() {
+		return
+	}
+	mask := image.NewAlpha(bounds)
+
+	for i := range points {
+		a := points[i]
+		b := a
+		if i+1 < len(points) {
+			b = points[i+1]
+		} else if len(points) > 1 {
+			continue
+		}
+		segmentBounds := image.Rect(int(math.Min(a[0], b[0])-radius-1), int(math.Min(a[1], b[1])-radius-1), int(math.Max(a[0], b[0])+radius+2), int(math.Max(a[1], b[1])+radius+2)).Intersect(bounds)
+		dx, dy := b[0]-a[0], b[1]-a[1]
+		lengthSquared := dx*dx + dy*dy
+		for y := segmentBounds.Min.Y; y < segmentBounds.Max.Y; y++ {
+			for x := segmentBounds.Min.X; x < segmentBounds.Max.X; x++ {
+				// distance from the pixel centre to the closest point on the segment
+				px, py := float64(x)+0.5, float64(y)+0.5
+				t := 0.0
+				if lengthSquared > 0 {
+					t = math.Max(0, math.Min(1, ((px-a[0])*dx+(py-a[1])*dy)/lengthSquared))
+				}
+				distance := math.Hypot(px-(a[0]+t*dx), py-(a[1]+t*dy))
+				coverage := math.Max(0, math.Min(1, radius+0.5-distance))
+				if coverage == 0 {
+					continue
+				}
+				offset := mask.PixOffset(x, y)
+				if alpha := uint8(coverage * 255); alpha > mask.Pix[offset] {
+					mask.Pix[offset] = alpha
+				}
+			}
+		}
+	}
+	draw.DrawMask(img, bounds, &image.Uniform{strokeColor}, image.Point{}, mask, bounds.Min, draw.Over)
+}
+
+// drawingCanvasSize is the size of a canvas with the drawing's aspect ratio
+// whose longest side is drawingSize
+func drawingCanvasSize(drawing *StrokeDrawing) (int, int) {
+	width, height := drawingSize, drawingSize
+	if drawing.Width > drawing.Height {
+		height = max(1, drawingSize*drawing.Height/drawing.Width)
+	} else if drawing.Height > drawing.Width {
+		width = max(1, drawingSize*drawing.Width/drawing.Height)
+	}
+	return width, height
+}
+
+// newDrawingCanvas makes a canvas with the drawing's aspect ratio whose longest
+// side is drawingSize
+func newDrawingCanvas(drawing *StrokeDrawing) *image.RGBA {
+	width, height := drawingCanvasSize(drawing)
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), &image.Uniform{drawingBackground}, image.Point{}, draw.Src)
+	return img
+}
+
+// rasterizeStrokes renders a stroke drawing at drawingSize, keeping the
+// client's aspect ratio
+func rasterizeStrokes(drawing *StrokeDrawing) *image.RGBA {
+	img := newDrawingCanvas(drawing)
+	for i := range drawing.Strokes {
+		stroke := &drawing.Strokes[i]
+		drawStrokeSegments(img, drawing, stroke, 0, len(stroke.Points))
+	}
+	return img
+}
+
+// parseReplaySeconds reads how many seconds each stroke replay of a game takes
+func parseReplaySeconds(value string) (int, error) {
+	replaySeconds, err := strconv.Atoi(value)
+	if err != nil || replaySeconds < 0 || replaySeconds > maxReplaySeconds {
+		return 0, fmt.Errorf("replaySeconds must be an integer between 0 and %d", maxReplaySeconds)
+	}
+	return replaySeconds, nil
+}
+
+// strokeTimeline gives every point of a drawing a replay time in
+// milliseconds. Idle time between points is capped at maxReplayPause so a
+// player who stopped to think doesn't leave the replay standing still.
+func strokeTimeline(drawing *StrokeDrawing) ([][]int64, int64) {
+	timeline := make([][]int64, len(drawing.Strokes))
+	var replayTime int64
+	previous := int64(-1)
+	for i, stroke := range drawing.Strokes {
+		timeline[i] = make([]int64, len(stroke.Points))
+		for j, point := range stroke.Points {
+			if previous >= 0 {
+				delta := point.T - previous
+				if delta < 0 {
+					delta = 0
+				}
+				if delta > maxReplayPause {
+					delta = maxReplayPause
+				}
+				replayTime += delta
+			}
+			previous = point.T
+			timeline[i][j] = replayTime
+		}
+	}
+	return timeline, replayTime
+}
+
+// strokeReplayFrames renders a drawing being drawn, squeezed into duration
+// centiseconds, handing each frame to add as soon as it is drawn rather than
+// holding on to them all. The frames stop short of the finished drawing, which
+// the caller adds as the frame that is held. Each frame goes through frames so
+// it matches the size of the rest of the GIF.
+func strokeReplayFrames(drawing *StrokeDrawing, duration int, frames *ImagePipeline, add func(frame image.Image, delay int) error) error {
+	frameCount := duration / strokeReplayFrameDelay
+	if frameCount < 1 {
+		return nil
+	}
+	timeline, totalTime := strokeTimeline(drawing)
+
+	canvas := newDrawingCanvas(drawing)
+	progress := make([]int, len(drawing.Strokes))
+	for frame := 1; frame < frameCount; frame++ {
+		cutoff := totalTime * int64(frame) / int64(frameCount)
+		for i := range drawing.Strokes {
+			to := progress[i]
+			for to < len(timeline[i]) && timeline[i][to] <= cutoff {
+				to++
+			}
+			drawStrokeSegments(canvas, drawing, &drawing.Strokes[i], progress[i], to)
+			progress[i] = to
+		}
+		if err := add(frames.process(canvas), strokeReplayFrameDelay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+var (
+	teamSubmissionOptions = []string{"first", "vote"}
+	teamDraftsMessage     = "{\"status\": \"OK\", \"message\":\"Pick your team's entry!\""
+)
+
+// Team is one seat in the rotation. Without team mode every player sits in a
+// team of their own, named after them, so the chain logic only deals in seats.
+type Team struct {
+	teamName string
+	members  []*Player
+	// with the "vote" submission option, each member's draft for the current
+	// phase in submission order, and which member's draft each member picked
+	draftOrder []string
+	drafts     map[string]string
+	draftVotes map[string]string
+}
+
+func isTeamSubmissionOption(option string) bool {
+	for _, o := range teamSubmissionOptions {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// seatCount is how many seats the game's players fill for its team size
+func seatCount(game *Game) int {
+	if game.teamSize <= 1 {
+		return len(game.players)
+	}
+	return (len(game.players) + game.teamSize - 1) / game.teamSize
+}
+
+// buildTeams seats the (already shuffled) players. Players are dealt out
+// round-robin so team sizes differ by at most one.
+func buildTeams(game *Game) {
+	seats := seatCount(game)
+	game.teams = make([]*Team, seats)
+	for i := range game.teams {
+		teamName := fmt.Sprintf("Team %d", i+1)
+		if game.teamSize <= 1 {
+			teamName = game.players[i].playerName
+		}
+		game.teams[i] = &Team{
+			teamName:   teamName,
+			members:    []*Player{},
+			drafts:     make(map[string]string),
+			draftVotes: make(map[string]string),
+		}
+	}
+	for i, p := range game.players {
+		team := game.teams[i%seats]
+		team.members = append(team.members, p)
+	}
+}
+
+// getSeatIndex returns the index of the player's team in the rotation, or -1
+func getSeatIndex(playerName string, game *Game) int {
+	for i, team := range game.teams {
+		for _, member := range team.members {
+			if member.playerName == playerName {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func queueTeamMessage(team *Team, message string) {
+	for _, member := range team.members {
+		member.queuedMessage = message
+	}
+}
+
+// submitTeamEntry records a member's prompt or drawing for their team's slot
+// in entries, which must still be empty. With the "first" option the first
+// submission wins and "" is returned. With "vote" it is kept as a draft until
+// the team settles on one, and the returned message says what happens next.
+func submitTeamEntry(game *Game, team *Team, playerName string, entries [][]string, chain int, entry string) string {
+	if game.teamSubmission != "vote" || len(team.members) == 1 {
+		entries[chain][game.currentRound] = entry
+		return ""
+	}
+
+	if _, ok := team.drafts[playerName]; !ok {
+		team.draftOrder = append(team.draftOrder, playerName)
+	}
+	team.drafts[playerName] = entry
+	if len(team.drafts) < len(team.members) {
+		return "Draft submitted, waiting for your team"
+	}
+	draftsJson := "["
+	for i, author := range team.draftOrder {
+		draftsJson += "{\"playerName\": " + jsonString(author) + ", \"draft\": " + jsonString(team.drafts[author])
+		// drawing drafts are image IDs, so give clients something to show
+		if _, ok := imageRegistry[team.drafts[author]]; ok {
+			draftsJson += ", \"image\": " + jsonString(imageURL(baseUrlPlaceholder, team.drafts[author]))
+		}
+		draftsJson += "}"
+		if i < len(team.draftOrder)-1 {
+			draftsJson += ","
+		}
+	}
+	draftsJson += "]"
+	queueTeamMessage(team, teamDraftsMessage+",\"drafts\": "+draftsJson+"}")
+	return "Draft submitted, vote for your team's entry"
+}
+
+// pickTeamDraft returns the draft with the most votes, preferring the earlier
+// draft on a tie, and whether it has a majority of the team behind it
+func pickTeamDraft(team *Team) (string, bool) {
+	if len(team.draftOrder) == 0 {
+		return "", false
+	}
+	counts := make(map[string]int)
+	for _, author := range team.draftVotes {
+		counts[author]++
+	}
+	best := team.draftOrder[0]
+	for _, author := range team.draftOrder {
+		if counts[author] > counts[best] {
+			best = author
+		}
+	}
+	return team.drafts[best], counts[best]*2 > len(team.members)
+}
+
+func clearTeamDrafts(team *Team) {
+	team.draftOrder = nil
+	team.drafts = make(map[string]string)
+	team.draftVotes = make(map[string]string)
+}
+
+// resolveTeamDrafts fills in any slot of the current phase which a team left
+// undecided, taking their best draft so far. It runs as the phase ends.
+func resolveTeamDrafts(game *Game, entries [][]string) {
+	for seat, team := range game.teams {
+		chain := (seat + game.currentRound) % len(game.teams)
+		if entries[chain][game.currentRound] == "" {
+			entries[chain][game.currentRound], _ = pickTeamDraft(team)
+		}
+		clearTeamDrafts(team)
+	}
+}
+
+// An endpoint for a team member to pick between their team's drafts in the
+// "vote" submission mode
+func submitTeamVote(w http.ResponseWriter, r *http.Request) {
+	allowCors(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if r.Method == "POST" {
+		bodyObj := parseBodyObject(r)
+
+		gameName := bodyObj["gameName"]
+		playerName := bodyObj["playerName"]
+		playerSecret := bodyObj["playerSecret"]
+		draftAuthor := bodyObj["draftPlayerName"]
+
+		if !authenticatePlayer(playerName, playerSecret) {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Player not authenticated\"}"
+			fmt.Fprintf(w, responseStr)
+			return
+		}
+		game, ok := games[gameName]
+		if !ok {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Game not found\"}"
+			fmt.Fprintf(w, responseStr)
+			return
+		}
+		seat := getSeatIndex(playerName, game)
+		if seat == -1 {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Player not in game\"}"
+			fmt.Fprintf(w, responseStr)
+			return
+		}
+		team := game.teams[seat]
+		if len(team.drafts) < len(team.members) {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Your team is still drafting\"}"
+			fmt.Fprintf(w, responseStr)
+			return
+		}
+		if _, ok := team.drafts[draftAuthor]; !ok {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"draftPlayerName must be a member of your team with a draft\"}"
+			fmt.Fprintf(w, responseStr)
+			return
+		}
+		team.draftVotes[playerName] = draftAuthor
+
+		draft, decided := pickTeamDraft(team)
+		if !decided && len(team.draftVotes) < len(team.members) {
+			responseStr := "{\"status\": \"OK\", \"message\": \"Vote submitted, waiting for your team\"}"
+			fmt.Fprintf(w, responseStr)
+			return
+		}
+		entries := game.prompts
+		if game.promptsSet {
+			entries = game.drawings
+		}
+		entries[(seat+game.currentRound)%len(game.teams)][game.currentRound] = draft
+		clearTeamDrafts(team)
+		responseStr := "{\"status\": \"OK\", \"message\": \"Vote submitted, your team's entry is in\"}"
+		fmt.Fprintf(w, responseStr)
+		progressGameIfReady(game)
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func teamsToJSON(teams []*Team) string {
+	teamsJson := "["
+	for i, team := range teams {
+		names := []string{}
+		for _, member := range team.members {
+			names = append(names, member.playerName)
+		}
+		teamsJson += "{\"teamName\": " + jsonString(team.teamName) + ", \"players\": " + jsonStringList(names) + "}"
+		if i < len(teams)-1 {
+			teamsJson += ","
+		}
+	}
+	teamsJson += "]"
+	return teamsJson
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	captionThemesDir = "themes"
+	// the theme games use unless they pick another. It is built in, though a
+	// theme file of the same name replaces it.
+	defaultCaptionThemeName = "classic"
+	captionThemes           = make(map[string]*CaptionTheme)
+	captionAlignments       = []string{"center", "left", "right"}
+	// the bounds on a theme's font sizes and padding, in pixels
+	minThemeFontSize = 6.0
+	maxThemeFontSize = 160.0
+	maxThemePadding  = drawingSize / 4
+)
+
+// CaptionTheme is how caption cards look: the caption frames of reveal
+// animations, their title and end cards and the placeholders for missing
+// entries. Themes are loaded from JSON or YAML files in captionThemesDir and
+// only read from after that, so render workers share them freely.
+type CaptionTheme struct {
+	Name string `json:"name" yaml:"name"`
+	// a color such as #ffffff, or the top of a gradient running down to
+	// GradientTo when that is set
+	Background string `json:"background" yaml:"background"`
+	GradientTo string `json:"gradientTo" yaml:"gradientTo"`
+	// an image in captionThemesDir tiled over the background, which shows
+	// through wherever the image is transparent
+	Texture   string `json:"texture" yaml:"texture"`
+	TextColor string `json:"textColor" yaml:"textColor"`
+	// the font captions are set in instead of the game's, or "" for the
+	// game's font
+	Font string `json:"font" yaml:"font"`
+	// the text shrinks from MaxFontSize until it fits, and text too long to
+	// fit at MinFontSize is cut short with an ellipsis
+	MaxFontSize float64 `json:"maxFontSize" yaml:"maxFontSize"`
+	MinFontSize float64 `json:"minFontSize" yaml:"minFontSize"`
+	// the space kept clear around the text on every side, in pixels
+	Padding int `json:"padding" yaml:"padding"`
+	// one of captionAlignments
+	Align string `json:"align" yaml:"align"`
+	// whether caption frames name who wrote the caption
+	Byline bool `json:"byline" yaml:"byline"`
+
+	background color.RGBA
+	gradientTo *color.RGBA
+	texture    image.Image
+	textColor  color.RGBA
+}
+
+// newCaptionTheme is a theme with the settings of the classic caption cards:
+// black text on white
+func newCaptionTheme(name string) *CaptionTheme {
+	return &CaptionTheme{
+		Name:        name,
+		Background:  "#ffffff",
+		TextColor:   "#000000",
+		MaxFontSize: 48,
+		MinFontSize: 12,
+		Padding:     20,
+		Align:       "center",
+		background:  color.RGBA{255, 255, 255, 255},
+		textColor:   color.RGBA{0, 0, 0, 255},
+	}
+}
+
+func isCaptionAlignment(align string) bool {
+	for _, a := range captionAlignments {
+		if a == align {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCaptionTheme decodes a theme from JSON or YAML depending on the file
+// extension. Settings the file leaves out keep those of the classic theme.
+// Textures are read from dir.
+func parseCaptionTheme(fileName string, data []byte, dir string) (*CaptionTheme, error) {
+	theme := newCaptionTheme(strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName)))
+	var err error
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		err = json.Unmarshal(data, theme)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, theme)
+	default:
+		return nil, fmt.Errorf("unsupported caption theme extension %q", filepath.Ext(fileName))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := theme.prepare(dir); err != nil {
+		return nil, fmt.Errorf("caption theme %q: %v", theme.Name, err)
+	}
+	return theme, nil
+}
+
+// prepare checks the theme's settings and decodes its colors and texture
+func (t *CaptionTheme) prepare(dir string) error {
+	if t.Name == "" {
+		return fmt.Errorf("a theme needs a name")
+	}
+	var err error
+	if t.background, err = parseHexColor(t.Background); err != nil {
+		return fmt.Errorf("background: %v", err)
+	}
+	if t.GradientTo != "" {
+		gradientTo, err := parseHexColor(t.GradientTo)
+		if err != nil {
+			return fmt.Errorf("gradientTo: %v", err)
+		}
+		t.gradientTo = &gradientTo
+	}
+	if t.textColor, err = parseHexColor(t.TextColor); err != nil {
+		return fmt.Errorf("textColor: %v", err)
+	}
+	if t.Font != "" {
+		if _, ok := loadedFonts[t.Font]; !ok {
+			return fmt.Errorf("unknown font %s", t.Font)
+		}
+	}
+	if t.MinFontSize < minThemeFontSize || t.MaxFontSize > maxThemeFontSize || t.MinFontSize > t.MaxFontSize {
+		return fmt.Errorf("font sizes must be between %g and %g, with minFontSize no more than maxFontSize", minThemeFontSize, maxThemeFontSize)
+	}
+	if t.Padding < 0 || t.Padding > maxThemePadding {
+		return fmt.Errorf("padding must be between 0 and %d", maxThemePadding)
+	}
+	if !isCaptionAlignment(t.Align) {
+		return fmt.Errorf("align must be one of %s", strings.Join(captionAlignments, ", "))
+	}
+	if t.Texture != "" {
+		if !filepath.IsLocal(t.Texture) {
+			return fmt.Errorf("texture must be a file in the themes directory")
+		}
+		file, err := os.Open(filepath.Join(dir, t.Texture))
+		if err != nil {
+			return fmt.Errorf("error opening texture: %v", err)
+		}
+		defer file.Close()
+		if t.texture, _, err = image.Decode(file); err != nil {
+			return fmt.Errorf("error decoding texture: %v", err)
+		}
+		if t.texture.Bounds().Empty() {
+			return fmt.Errorf("texture is empty")
+		}
+	}
+	return nil
+}
+
+// loadCaptionThemes registers the classic theme, then every theme in dir.
+// Files which aren't JSON or YAML are left alone, as textures sit alongside
+// the themes using them.
+func loadCaptionThemes(dir string) {
+	captionThemes[defaultCaptionThemeName] = newCaptionTheme(defaultCaptionThemeName)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Println("Error reading caption themes directory:", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".json", ".yaml", ".yml":
+		default:
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			fmt.Println("Error reading caption theme:", err)
+			continue
+		}
+		theme, err := parseCaptionTheme(entry.Name(), data, dir)
+		if err != nil {
+			fmt.Println("Error parsing caption theme "+entry.Name()+":", err)
+			continue
+		}
+		captionThemes[theme.Name] = theme
+	}
+	fmt.Println("Loaded", len(captionThemes), "caption themes")
+}
+
+func captionThemeNames() []string {
+	names := []string{}
+	for name := range captionThemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// captionTheme looks up a game's theme. Themes this server doesn't have, such
+// as those of games imported from elsewhere, give way to the default theme.
+func captionTheme(name string) *CaptionTheme {
+	if theme, ok := captionThemes[name]; ok {
+		return theme
+	}
+	return captionThemes[defaultCaptionThemeName]
+}
+
+// fonts is the chain the theme's text is set in, given a game's chain
+func (t *CaptionTheme) fonts(gameFonts FontChain) FontChain {
+	if t.Font == "" {
+		return gameFonts
+	}
+	return fontChain(t.Font)
+}
+
+// drawBackground paints the theme's background over img: its color or
+// gradient, with its texture tiled on top
+func (t *CaptionTheme) drawBackground(img *image.RGBA) {
+	bounds := img.Bounds()
+	if t.gradientTo == nil {
+		draw.Draw(img, bounds, &image.Uniform{t.background}, image.Point{}, draw.Src)
+	} else {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			row := image.Rect(bounds.Min.X, y, bounds.Max.X, y+1)
+			draw.Draw(img, row, &image.Uniform{blendColors(t.background, *t.gradientTo, y-bounds.Min.Y, bounds.Dy())}, image.Point{}, draw.Src)
+		}
+	}
+	if t.texture != nil {
+		tile := t.texture.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y += tile.Dy() {
+			for x := bounds.Min.X; x < bounds.Max.X; x += tile.Dx() {
+				draw.Draw(img, image.Rect(x, y, x+tile.Dx(), y+tile.Dy()), t.texture, tile.Min, draw.Over)
+			}
+		}
+	}
+}
+
+// blendColors is the color step of steps along a gradient from one color to
+// another
+func blendColors(from, to color.RGBA, step, steps int) color.RGBA {
+	if steps <= 1 {
+		return from
+	}
+	blend := func(a, b uint8) uint8 {
+		return uint8((int(a)*(steps-1-step) + int(b)*step) / (steps - 1))
+	}
+	return color.RGBA{blend(from.R, to.R), blend(from.G, to.G), blend(from.B, to.B), blend(from.A, to.A)}
+}
+
+func captionThemeToJSON(t *CaptionTheme) string {
+	themeJson := "{\"name\": " + jsonString(t.Name) + ","
+	themeJson += "\"background\": " + jsonString(t.Background) + ","
+	themeJson += "\"gradientTo\": " + jsonString(t.GradientTo) + ","
+	themeJson += "\"texture\": " + jsonString(t.Texture) + ","
+	themeJson += "\"textColor\": " + jsonString(t.TextColor) + ","
+	themeJson += "\"font\": " + jsonString(t.Font) + ","
+	themeJson += "\"maxFontSize\": " + strconv.FormatFloat(t.MaxFontSize, 'f', -1, 64) + ","
+	themeJson += "\"minFontSize\": " + strconv.FormatFloat(t.MinFontSize, 'f', -1, 64) + ","
+	themeJson += "\"padding\": " + strconv.Itoa(t.Padding) + ","
+	themeJson += "\"align\": " + jsonString(t.Align) + ","
+	themeJson += "\"byline\": " + strconv.FormatBool(t.Byline) + "}"
+	return themeJson
+}
+
+// An endpoint listing the caption themes a game can be created with
+func listCaptionThemes(w http.ResponseWriter, r *http.Request) {
+	allowCors(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if r.Method == "GET" {
+		themes := []string{}
+		for _, name := range captionThemeNames() {
+			themes = append(themes, captionThemeToJSON(captionThemes[name]))
+		}
+		responseStr := "{\"status\":\"OK\", \"captionThemes\": [" + strings.Join(themes, ",") + "], \"defaultCaptionTheme\": " + jsonString(defaultCaptionThemeName) + "}"
+		fmt.Fprint(w, responseStr)
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
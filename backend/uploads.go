@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+var (
+	// limits checked against an upload's header before it is decoded, so a
+	// small file can't claim a huge canvas and exhaust memory
+	maxUploadDimension = 8192
+	maxUploadPixels    = 24000000
+	maxUploadsPerRound = 5
+	imageRegistry      = make(map[string]*RegisteredImage)
+	// stands in for the server's URL in queued messages, which are built
+	// outside of any request. getPlayerQueuedMessage fills it in.
+	baseUrlPlaceholder = "{{baseUrl}}"
+)
+
+// RegisteredImage is a drawing saved in the images directory. Games store
+// drawings by image ID, and an image can only be submitted by its owner, to
+// the game and round it was made for.
+type RegisteredImage struct {
+	imageId string
+	path    string
+	owner   string
+	gameId  string
+	round   int
+	// set when the drawing was made from strokes
+	strokes   *StrokeDrawing
+	createdAt time.Time
+}
+
+// registerImage gives a saved drawing a new image ID. Identical drawings share
+// a blob but each upload is registered separately, to its own owner.
+func registerImage(path, owner string, game *Game, strokes *StrokeDrawing) *RegisteredImage {
+	registered := &RegisteredImage{
+		imageId:   generateShortHash(),
+		path:      path,
+		owner:     owner,
+		gameId:    game.gameId,
+		round:     game.currentRound,
+		strokes:   strokes,
+		createdAt: time.Now(),
+	}
+	imageRegistry[registered.imageId] = registered
+	retainBlob(path)
+	return registered
+}
+
+// imageURL resolves an image ID to a URL from the blob store, given the URL
+// the server is being reached at, or returns "" for a missing drawing
+func imageURL(baseURL, imageId string) string {
+	registered, ok := imageRegistry[imageId]
+	if !ok {
+		return ""
+	}
+	return blobStore.URL(registered.path, baseURL)
+}
+
+// imageURLList resolves a chain of drawings for a JSON response
+func imageURLList(baseURL string, imageIds []string) []string {
+	urls := make([]string, len(imageIds))
+	for i, imageId := range imageIds {
+		urls[i] = imageURL(baseURL, imageId)
+	}
+	return urls
+}
+
+// uploadsThisRound counts the images the player has made for the game's
+// current round
+func uploadsThisRound(game *Game, playerName string) int {
+	count := 0
+	for _, registered := range imageRegistry {
+		if registered.gameId == game.gameId && registered.owner == playerName && registered.round == game.currentRound {
+			count++
+		}
+	}
+	return count
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, from 1 to 8, or 1 if
+// the file has none. Phones store photos as the sensor saw them and record
+// how to turn them upright here.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xFF {
+			// fill byte before a marker
+			i++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// metadata segments all come before the image data
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of the TIFF
+// structure inside a JPEG's Exif segment
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		// the orientation is a single SHORT, stored at the start of the value field
+		if order.Uint16(tiff[entry:]) != 0x0112 {
+			continue
+		}
+		if order.Uint16(tiff[entry+2:]) != 3 {
+			return 1
+		}
+		orientation := int(order.Uint16(tiff[entry+8:]))
+		if orientation < 1 || orientation > 8 {
+			return 1
+		}
+		return orientation
+	}
+	return 1
+}
+
+// applyOrientation turns an image upright according to its EXIF orientation
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	w, h := bounds.Dx(), bounds.Dy()
+	dstWidth, dstHeight := w, h
+	if orientation >= 5 {
+		// orientations 5 to 8 turn the image on its side
+		dstWidth, dstHeight = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // upside down and mirrored
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs turning clockwise
+				sx, sy = y, h-1-x
+			case 7: // transverse
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs turning anticlockwise
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
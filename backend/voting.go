@@ -0,0 +1,365 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	votingStartedMessage = "{\"status\": \"OK\", \"message\":\"Vote for your favorites!\",\"voting\": true,\"categories\": [\"funniestCaption\",\"bestDrawing\",\"mostFaithful\"]}"
+	voteCategories       = []string{"funniestCaption", "bestDrawing", "mostFaithful"}
+	// words ignored when measuring how far a chain drifted from its prompt
+	driftStopWords = map[string]bool{"a": true, "an": true, "the": true, "of": true, "and": true, "in": true, "on": true, "at": true, "to": true, "is": true, "with": true}
+)
+
+// Vote is a single player's pick for one category. funniestCaption votes
+// point at a caption (prompts[chain][round]), bestDrawing votes at a drawing
+// (drawings[chain][round]) and mostFaithful votes at a whole chain.
+type Vote struct {
+	voter    string
+	category string
+	chain    int
+	round    int
+}
+
+type Award struct {
+	title   string
+	players []string
+	chain   int
+}
+
+func isVoteCategory(category string) bool {
+	for _, c := range voteCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// entryAuthor returns the name of the team who wrote prompts[chain][round] or
+// drew drawings[chain][round]. submitPrompt and submitDrawing both have teams
+// write into chain (seat + round) % seats.
+func entryAuthor(game *Game, chain, round int) string {
+	return teamEntryAuthor(game.teams, chain, round)
+}
+
+// teamEntryAuthor is entryAuthor for a game's teams, which ended games keep too
+func teamEntryAuthor(teams []*Team, chain, round int) string {
+	n := len(teams)
+	if n == 0 {
+		return ""
+	}
+	return teams[((chain-round)%n+n)%n].teamName
+}
+
+// chainContributors lists every team who wrote or drew something in a chain
+func chainContributors(game *Game, chain int) []string {
+	seen := make(map[string]bool)
+	contributors := []string{}
+	for round := range game.prompts[chain] {
+		name := entryAuthor(game, chain, round)
+		if !seen[name] {
+			seen[name] = true
+			contributors = append(contributors, name)
+		}
+	}
+	return contributors
+}
+
+// _startVoting opens the polls and starts rendering the reveal animations the
+// players vote on, which getGameState reports the progress of
+func _startVoting(game *Game) {
+	game.votingOpen = true
+	reveal := newEndedGame(game)
+	for _, format := range exportFormatsToRender(reveal.exportFormat) {
+		queueGameRenders(reveal, format)
+	}
+	game.renders = reveal.renders
+	for _, p := range game.players {
+		p.queuedMessage = votingStartedMessage
+	}
+}
+
+// progressVotingIfReady ends the game once every player has voted in every category
+func progressVotingIfReady(game *Game) {
+	for _, p := range game.players {
+		if len(game.votes[p.playerName]) < len(voteCategories) {
+			return
+		}
+	}
+	_endGame(game.gameName)
+}
+
+func submitVote(w http.ResponseWriter, r *http.Request) {
+	allowCors(&w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	} else if r.Method == "POST" {
+		bodyObj := parseBodyObject(r)
+
+		gameName := bodyObj["gameName"]
+		playerName := bodyObj["playerName"]
+		playerSecret := bodyObj["playerSecret"]
+		category := bodyObj["category"]
+
+		if !authenticatePlayer(playerName, playerSecret) {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Player not authenticated\"}"
+			fmt.Fprintf(w, responseStr)
+			return
+		}
+		game, ok := games[gameName]
+		if !ok {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Game not found\"}"
+			fmt.Fprintf(w, responseStr)
+			return
+		}
+		if !game.votingOpen {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Voting is not open\"}"
+			fmt.Fprintf(w, responseStr)
+			return
+		}
+		seat := getSeatIndex(playerName, game)
+		if seat == -1 {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"Player not in game\"}"
+			fmt.Fprintf(w, responseStr)
+			return
+		}
+		teamName := game.teams[seat].teamName
+		if !isVoteCategory(category) {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"category must be one of " + strings.Join(voteCategories, ", ") + "\"}"
+			fmt.Fprintf(w, responseStr)
+			return
+		}
+		chain, err := strconv.Atoi(bodyObj["chain"])
+		if err != nil || chain < 0 || chain >= len(game.prompts) {
+			responseStr := "{\"status\": \"ERROR\", \"message\": \"chain must be the index of a chain in the game\"}"
+			fmt.Fprintf(w, responseStr)
+			return
+		}
+
+		round := 0
+		if category != "mostFaithful" {
+			round, err = strconv.Atoi(bodyObj["round"])
+			if err != nil || round < 0 || round >= len(game.prompts[chain]) {
+				responseStr := "{\"status\": \"ERROR\", \"message\": \"round must be the index of an entry in the chain\"}"
+				fmt.Fprintf(w, responseStr)
+				return
+			}
+		}
+		switch category {
+		case "funniestCaption":
+			// the first prompt of a chain is not a caption of anything
+			if round == 0 || game.prompts[chain][round] == "" {
+				responseStr := "{\"status\": \"ERROR\", \"message\": \"There is no caption to vote for\"}"
+				fmt.Fprintf(w, responseStr)
+				return
+			}
+			if entryAuthor(game, chain, round) == teamName {
+				responseStr := "{\"status\": \"ERROR\", \"message\": \"You can't vote for your own caption\"}"
+				fmt.Fprintf(w, responseStr)
+				return
+			}
+		case "bestDrawing":
+			if game.drawings[chain][round] == "" {
+				responseStr := "{\"status\": \"ERROR\", \"message\": \"There is no drawing to vote for\"}"
+				fmt.Fprintf(w, responseStr)
+				return
+			}
+			if entryAuthor(game, chain, round) == teamName {
+				responseStr := "{\"status\": \"ERROR\", \"message\": \"You can't vote for your own drawing\"}"
+				fmt.Fprintf(w, responseStr)
+				return
+			}
+		}
+
+		if game.votes[playerName] == nil {
+			game.votes[playerName] = make(map[string]*Vote)
+		}
+		game.votes[playerName][category] = &Vote{voter: playerName, category: category, chain: chain, round: round}
+		responseStr := "{\"status\": \"OK\", \"message\": \"Vote submitted\"}"
+		fmt.Fprintf(w, responseStr)
+		progressVotingIfReady(game)
+	} else {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// driftWords splits a prompt into lower case words, leaving out punctuation
+// and filler words
+func driftWords(text string) map[string]bool {
+	words := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}) {
+		if !driftStopWords[word] {
+			words[word] = true
+		}
+	}
+	return words
+}
+
+// promptDrift is the Jaccard distance between the words of two prompts: 0 when
+// they share every word and 1 when they share none
+func promptDrift(a, b string) float64 {
+	wordsA := driftWords(a)
+	wordsB := driftWords(b)
+	if len(wordsA) == 0 && len(wordsB) == 0 {
+		return 0
+	}
+	shared := 0
+	for word := range wordsA {
+		if wordsB[word] {
+			shared++
+		}
+	}
+	return 1 - float64(shared)/float64(len(wordsA)+len(wordsB)-shared)
+}
+
+// topScorers returns the names with the highest count, or nil if nobody scored
+func topScorers(counts map[string]int) []string {
+	best := 0
+	for _, count := range counts {
+		if count > best {
+			best = count
+		}
+	}
+	if best == 0 {
+		return nil
+	}
+	names := []string{}
+	for name, count := range counts {
+		if count == best {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tallyVotes turns the game's votes into a score per team and the end of game
+// awards. Without team mode every player is a team of one named after them.
+func tallyVotes(game *Game) (map[string]int, []Award) {
+	scores := make(map[string]int)
+	for _, team := range game.teams {
+		scores[team.teamName] = 0
+	}
+	captionVotes := make(map[string]int)
+	drawingVotes := make(map[string]int)
+	chainVotes := make(map[int]int)
+
+	for _, playerVotes := range game.votes {
+		for _, vote := range playerVotes {
+			switch vote.category {
+			case "funniestCaption":
+				author := entryAuthor(game, vote.chain, vote.round)
+				captionVotes[author]++
+				scores[author]++
+			case "bestDrawing":
+				author := entryAuthor(game, vote.chain, vote.round)
+				drawingVotes[author]++
+				scores[author]++
+			case "mostFaithful":
+				chainVotes[vote.chain]++
+				for _, name := range chainContributors(game, vote.chain) {
+					scores[name]++
+				}
+			}
+		}
+	}
+
+	awards := []Award{}
+	if winners := topScorers(drawingVotes); winners != nil {
+		awards = append(awards, Award{title: "Best Artist", players: winners, chain: -1})
+	}
+	if winners := topScorers(captionVotes); winners != nil {
+		awards = append(awards, Award{title: "Funniest Captioner", players: winners, chain: -1})
+	}
+	faithfulChain := -1
+	for chain, count := range chainVotes {
+		if faithfulChain == -1 || count > chainVotes[faithfulChain] || (count == chainVotes[faithfulChain] && chain < faithfulChain) {
+			faithfulChain = chain
+		}
+	}
+	if faithfulChain != -1 {
+		awards = append(awards, Award{title: "Most Faithful Chain", players: chainContributors(game, faithfulChain), chain: faithfulChain})
+	}
+
+	// Chaos Agent goes to whoever wrote the wildest caption in the chain which
+	// drifted furthest from its first prompt
+	chaosChain := -1
+	chaosDrift := 0.0
+	for chain, prompts := range game.prompts {
+		written := []string{}
+		for _, prompt := range prompts {
+			if prompt != "" {
+				written = append(written, prompt)
+			}
+		}
+		if len(written) < 2 {
+			continue
+		}
+		drift := promptDrift(written[0], written[len(written)-1])
+		if drift > chaosDrift {
+			chaosChain = chain
+			chaosDrift = drift
+		}
+	}
+	if chaosChain != -1 {
+		chaosRound := -1
+		stepDrift := -1.0
+		prompts := game.prompts[chaosChain]
+		for round := 1; round < len(prompts); round++ {
+			if prompts[round] == "" || prompts[round-1] == "" {
+				continue
+			}
+			if drift := promptDrift(prompts[round-1], prompts[round]); drift > stepDrift {
+				chaosRound = round
+				stepDrift = drift
+			}
+		}
+		if chaosRound != -1 {
+			awards = append(awards, Award{title: "Chaos Agent", players: []string{entryAuthor(game, chaosChain, chaosRound)}, chain: chaosChain})
+		}
+	}
+
+	return scores, awards
+}
+
+func scoresToJSON(scores map[string]int) string {
+	names := []string{}
+	for name := range scores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	scoresJson := "{"
+	for i, name := range names {
+		scoresJson += jsonString(name) + ": " + fmt.Sprint(scores[name])
+		if i < len(names)-1 {
+			scoresJson += ","
+		}
+	}
+	scoresJson += "}"
+	return scoresJson
+}
+
+func awardsToJSON(awards []Award) string {
+	awardsJson := "["
+	for i, award := range awards {
+		awardsJson += "{"
+		awardsJson += "\"title\": \"" + award.title + "\","
+		awardsJson += "\"players\": " + jsonStringList(award.players) + ","
+		awardsJson += "\"chain\": " + fmt.Sprint(award.chain)
+		awardsJson += "}"
+		if i < len(awards)-1 {
+			awardsJson += ","
+		}
+	}
+	awardsJson += "]"
+	return awardsJson
+}
@@ -0,0 +1,2 @@
+# POST localhost:9119/getEndedGame?format=apng with gameId=b5888c822e40457d0602e741f0e89024, rendering animated PNGs of the chains if they haven't been yet
+curl -X POST -H "Content-Type: application/json" -d '{"gameId":"b5888c822e40457d0602e741f0e89024"}' "http://localhost:9119/getEndedGame?format=apng"
@@ -0,0 +1,2 @@
+# GET localhost:9119/exportEndedGame with gameId=b5888c822e40457d0602e741f0e89024 and export=archive, saving a zip of the game's manifest, drawings and renders
+curl -o archive.zip "http://localhost:9119/exportEndedGame?gameId=b5888c822e40457d0602e741f0e89024&export=archive"
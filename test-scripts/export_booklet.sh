@@ -0,0 +1,2 @@
+# GET localhost:9119/exportEndedGame with gameId=b5888c822e40457d0602e741f0e89024 and export=booklet, saving a printable PDF of the game, asking again while it is being drawn
+while [ "$(curl -s -o booklet.pdf -w "%{http_code}" "http://localhost:9119/exportEndedGame?gameId=b5888c822e40457d0602e741f0e89024&export=booklet")" = 202 ]; do sleep 2; done
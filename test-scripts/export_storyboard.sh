@@ -0,0 +1,2 @@
+# GET localhost:9119/exportEndedGame with gameId=b5888c822e40457d0602e741f0e89024, export=storyboard and chain=0, saving the comic strip of the first chain, asking again while it is being drawn
+while [ "$(curl -s -o storyboard.png -w "%{http_code}" "http://localhost:9119/exportEndedGame?gameId=b5888c822e40457d0602e741f0e89024&export=storyboard&chain=0")" = 202 ]; do sleep 2; done
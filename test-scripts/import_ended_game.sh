@@ -0,0 +1,4 @@
+# POST localhost:9119/importEndedGame with adminSecret=$PT_ADMIN_SECRET and the archive saved by export_archive.sh, restoring the ended game on this server
+curl -X POST http://localhost:9119/importEndedGame \
+	-F "adminSecret=$PT_ADMIN_SECRET" \
+	-F "file=@archive.zip"
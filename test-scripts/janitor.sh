@@ -0,0 +1,2 @@
+# POST localhost:9119/janitor with adminSecret=$PT_ADMIN_SECRET, reporting what would be cleaned up. Set dryRun to "false" to clean it up now.
+curl -X POST -H "Content-Type: application/json" -d '{"adminSecret":"'"$PT_ADMIN_SECRET"'","dryRun":"true"}' http://localhost:9119/janitor
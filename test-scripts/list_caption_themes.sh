@@ -0,0 +1,2 @@
+# GET localhost:9119/listCaptionThemes to see the caption themes a game can be created or re-rendered with, and the default theme
+curl http://localhost:9119/listCaptionThemes
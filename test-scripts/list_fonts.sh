@@ -0,0 +1,2 @@
+# GET localhost:9119/listFonts to see the fonts a game can be created with, the default font and the fallback fonts tried for characters a font lacks
+curl http://localhost:9119/listFonts
@@ -0,0 +1,2 @@
+# POST localhost:9119/rematch with gameId=b5888c822e40457d0602e741f0e89024, playerName=player1, playerSecret=secret1, setting up a game with the same settings and inviting everyone who played
+curl -X POST -H "Content-Type: application/json" -d '{"gameId":"b5888c822e40457d0602e741f0e89024","playerName":"player1","playerSecret":"secret1"}' http://localhost:9119/rematch
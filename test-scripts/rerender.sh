@@ -0,0 +1,7 @@
+# POST localhost:9119/rerender with gameId=b5888c822e40457d0602e741f0e89024, playerName=player1, playerSecret=secret1, rendering every animation again
+# Any of these can be given to change them first, the pacing ones as for createGame:
+#   captionDuration, drawingDuration, captionDurationPerChar, maxCaptionDuration (centiseconds)
+#   loopCount (0 loops forever), titleCard, endCard
+#   captionLayout (frames or overlay), font (from listFonts), captionTheme (from listCaptionThemes)
+#   replaySeconds
+curl -X POST -H "Content-Type: application/json" -d '{"gameId":"b5888c822e40457d0602e741f0e89024","playerName":"player1","playerSecret":"secret1","drawingDuration":"300","loopCount":"1","titleCard":"true","endCard":"true"}' http://localhost:9119/rerender
@@ -0,0 +1,2 @@
+# POST localhost:9119/retryRender with gameId=b5888c822e40457d0602e741f0e89024, playerName=player1, playerSecret=secret1. Add "chain":"0" to retry a single GIF.
+curl -X POST -H "Content-Type: application/json" -d '{"gameId":"b5888c822e40457d0602e741f0e89024","playerName":"player1","playerSecret":"secret1"}' http://localhost:9119/retryRender
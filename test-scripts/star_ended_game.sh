@@ -0,0 +1,2 @@
+# POST localhost:9119/starEndedGame with adminSecret=$PT_ADMIN_SECRET, gameId=b5888c822e40457d0602e741f0e89024, starred=true
+curl -X POST -H "Content-Type: application/json" -d '{"adminSecret":"'"$PT_ADMIN_SECRET"'","gameId":"b5888c822e40457d0602e741f0e89024","starred":"true"}' http://localhost:9119/starEndedGame
@@ -0,0 +1,2 @@
+# POST localhost:9119/submitDrawing with gameName=test, playerName=player1, playerSecret=secret1 and the drawing as strokes on a 512 by 512 canvas instead of an image ID
+curl -X POST -H "Content-Type: application/json" -d '{"gameName":"test","playerName":"player1","playerSecret":"secret1","strokes":{"width":512,"height":512,"strokes":[{"points":[{"x":100,"y":100,"t":0},{"x":400,"y":150,"t":250},{"x":250,"y":400,"t":600}],"color":"#1e90ff","width":8,"tool":"pen"}]}}' http://localhost:9119/submitDrawing
@@ -0,0 +1,2 @@
+# POST localhost:9119/submitVote with gameName=test, playerName=player1, playerSecret=secret1, category=bestDrawing and the chain and round of the drawing voted for
+curl -X POST -H "Content-Type: application/json" -d '{"gameName":"test","playerName":"player1","playerSecret":"secret1","category":"bestDrawing","chain":"0","round":"1"}' http://localhost:9119/submitVote
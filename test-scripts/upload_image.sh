@@ -1,4 +1,6 @@
 curl -X POST http://localhost:9119/uploadDrawing \
 	-F "playerName=player1" \
 	-F "playerSecret=secret1" \
+	-F "gameName=test" \
+	-F "round=0" \
 	-F "file=@image.png"
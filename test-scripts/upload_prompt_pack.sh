@@ -0,0 +1,3 @@
+curl -X POST http://localhost:9119/uploadPromptPack \
+	-F "adminSecret=$PT_ADMIN_SECRET" \
+	-F "file=@prompts.yaml"